@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	getOrderLedgersTpl = `SELECT order_id, user_id, COALESCE(SUM(-delta) FILTER (WHERE delta < 0), 0), COALESCE(SUM(delta) FILTER (WHERE delta > 0), 0) FROM account WHERE order_id IS NOT NULL AND status=1 GROUP BY order_id, user_id ORDER BY order_id`
+)
+
+var (
+	getOrderLedgersStmt *sql.Stmt
+)
+
+// orderLedgerModel sums up the completed operations made for one order.
+type orderLedgerModel struct {
+	OrderID   int `json:"order_id"`
+	UserID    int `json:"user_id"`
+	Withdrawn int `json:"withdrawn"`
+	Refunded  int `json:"refunded"`
+}
+
+func mustPrepareAdminStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	getOrderLedgersStmt, err = db.PrepareContext(ctx, getOrderLedgersTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// getOrderLedgers lists the money moved for every order. It is used by the
+// reconciliation job of orders.
+func getOrderLedgers(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for orders' ledgers", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rows, err := getOrderLedgersStmt.Query()
+	if err != nil {
+		log.Printf("Failed to get orders' ledgers: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	ledgers := []orderLedgerModel{}
+	for rows.Next() {
+		l := orderLedgerModel{}
+		if err = rows.Scan(&l.OrderID, &l.UserID, &l.Withdrawn, &l.Refunded); err != nil {
+			log.Printf("Failed to scan order's ledger: %s\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ledgers = append(ledgers, l)
+	}
+	data, _ := json.Marshal(ledgers)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
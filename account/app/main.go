@@ -2,13 +2,13 @@ package main
 
 import (
 	"app/tracing"
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"lib/client"
 	"log"
 	"net/http"
 	"os"
@@ -22,8 +22,11 @@ import (
 	"github.com/opentracing/opentracing-go/ext"
 )
 
+// deltaModel is a deposit. OrderID is set when orders refunds an order, only
+// services and admins may set it.
 type deltaModel struct {
-	Delta int `json:"delta"`
+	Delta   int `json:"delta"`
+	OrderID int `json:"order_id,omitempty"`
 }
 
 type withdrawalRequestModel struct {
@@ -46,21 +49,30 @@ type configModel struct {
 	dbPass string
 	host   string
 	port   string
+
+	ordersURL     string
+	clientTimeout time.Duration
+	clientRetries int
 }
 
 const (
-	getBalanceTpl          = `SELECT COALESCE(SUM(delta),0) FROM account WHERE user_id=$1 AND status=1`
-	prepareOperationTpl    = `INSERT INTO account (user_id, request_id, delta, status) VALUES ($1, $2, 0, 0)`
-	updateBalanceTpl       = `UPDATE account SET delta=$3, status=1 WHERE user_id=$1 AND request_id=$2 AND status=0`
-	ordersCallbackEndpoint = "http://orders.proj.svc.cluster.local:9000/orders/callback/account"
+	getBalanceTpl        = `SELECT COALESCE(SUM(delta),0) FROM account WHERE user_id=$1 AND status=1`
+	prepareOperationTpl  = `INSERT INTO account (user_id, request_id, delta, status) VALUES ($1, $2, 0, 0)`
+	updateBalanceTpl     = `UPDATE account SET delta=$3, order_id=NULLIF($4, 0), status=1 WHERE user_id=$1 AND request_id=$2 AND status=0`
+	getOperationOwnerTpl = `SELECT user_id FROM account WHERE request_id=$1`
+	ordersCallbackPath   = "/orders/callback/account"
 )
 
+const roleAdmin = "admin"
+
 var (
-	getbalanceStmt       *sql.Stmt
-	prepareOperationStmt *sql.Stmt
-	updateBalanceStmt    *sql.Stmt
-	tracer               opentracing.Tracer
-	closer               io.Closer
+	getbalanceStmt        *sql.Stmt
+	prepareOperationStmt  *sql.Stmt
+	updateBalanceStmt     *sql.Stmt
+	getOperationOwnerStmt *sql.Stmt
+	ordersClient          *client.Client
+	tracer                opentracing.Tracer
+	closer                io.Closer
 )
 
 func readConf() *configModel {
@@ -72,6 +84,10 @@ func readConf() *configModel {
 		dbPass: "accountpasswd",
 		host:   "0.0.0.0",
 		port:   "80",
+
+		ordersURL:     "http://orders.proj.svc.cluster.local:9000",
+		clientTimeout: client.DefaultTimeout,
+		clientRetries: client.DefaultRetries,
 	}
 	dbHost := os.Getenv("DBHOST")
 	dbPort := os.Getenv("DBPORT")
@@ -80,6 +96,9 @@ func readConf() *configModel {
 	dbPass := os.Getenv("DBPASS")
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
+	ordersURL := os.Getenv("ORDERS_URL")
+	clientTimeout := os.Getenv("CLIENT_TIMEOUT")
+	clientRetries := os.Getenv("CLIENT_RETRIES")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -102,6 +121,23 @@ func readConf() *configModel {
 	if port != "" {
 		cfg.port = port
 	}
+	if ordersURL != "" {
+		cfg.ordersURL = ordersURL
+	}
+	if clientTimeout != "" {
+		if timeout, err := time.ParseDuration(clientTimeout); err == nil {
+			cfg.clientTimeout = timeout
+		} else {
+			log.Printf("Failed to parse [CLIENT_TIMEOUT], using default %s: %s\n", cfg.clientTimeout, err)
+		}
+	}
+	if clientRetries != "" {
+		if retries, err := strconv.Atoi(clientRetries); err == nil {
+			cfg.clientRetries = retries
+		} else {
+			log.Printf("Failed to parse [CLIENT_RETRIES], using default %d: %s\n", cfg.clientRetries, err)
+		}
+	}
 	return cfg
 }
 
@@ -143,13 +179,16 @@ func main() {
 	}
 
 	mustPrepareStmts(ctx, db)
+	ordersClient = client.New(tracer, client.Config{BaseURL: cfg.ordersURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/account/genreq", reqlog(isAuthenticatedMiddleware(newReq))).Methods("GET")
 	r.HandleFunc("/account/get", reqlog(isAuthenticatedMiddleware(get)))
+	r.HandleFunc("/account/get/{id}", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
 	r.HandleFunc("/account/deposit", reqlog(isAuthenticatedMiddleware(deposit))).Methods("POST")
 	r.HandleFunc("/account/withdrawal", reqlog(isAuthenticatedMiddleware(withdrawal))).Methods("POST")
+	r.HandleFunc("/account/admin/orders", reqlog(isAuthenticatedMiddleware(getOrderLedgers))).Methods("GET")
 
 	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
 	if err := http.ListenAndServe(bindOn, r); err != nil {
@@ -174,6 +213,13 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	getOperationOwnerStmt, err = db.PrepareContext(ctx, getOperationOwnerTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	mustPrepareAdminStmts(ctx, db)
 }
 
 func getbalance(id int) (int, error) {
@@ -182,8 +228,8 @@ func getbalance(id int) (int, error) {
 	return balance, err
 }
 
-func updatebalance(uid int, rid string, delta int) error {
-	res, err := updateBalanceStmt.Exec(uid, rid, delta)
+func updatebalance(uid int, rid string, delta, oid int) error {
+	res, err := updateBalanceStmt.Exec(uid, rid, delta, oid)
 	if err != nil {
 		return err
 	}
@@ -197,6 +243,12 @@ func updatebalance(uid int, rid string, delta int) error {
 	return err
 }
 
+func getOperationOwner(rid string) (int, error) {
+	uid := 0
+	err := getOperationOwnerStmt.QueryRow(rid).Scan(&uid)
+	return uid, err
+}
+
 func get(w http.ResponseWriter, r *http.Request) {
 	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
 	span := tracer.StartSpan("got request for current balance", ext.RPCServerOption(spanCtx))
@@ -208,6 +260,17 @@ func get(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if id_, ok := mux.Vars(r)["id"]; ok {
+		if id, err = strconv.Atoi(id_); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !canAccess(r, id) {
+			log.Printf("Could not find any account for user [%d]\n", id)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
 	b, err := getbalance(id)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -260,6 +323,14 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Got wrong header [X-User-Id]: %s", err)
 		return
 	}
+	owner, err := getOperationOwner(rid)
+	if err != nil || !canAccess(r, owner) {
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("Could not find operation [%s] for user [%d]\n", rid, uid)
+		return
+	}
+	// an admin acts on the account the operation was prepared for
+	uid = owner
 	d := deltaModel{}
 	if err = json.NewDecoder(r.Body).Decode(&d); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -271,7 +342,12 @@ func deposit(w http.ResponseWriter, r *http.Request) {
 		log.Println("Failed to update balance: delta value is negative")
 		return
 	}
-	if err = updatebalance(uid, rid, d.Delta); err != nil {
+	if d.OrderID != 0 && !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("User [%d] tried to deposit a refund of order [%d]\n", uid, d.OrderID)
+		return
+	}
+	if err = updatebalance(uid, rid, d.Delta, d.OrderID); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Failed to update balance: %s", err)
 		return
@@ -298,12 +374,26 @@ func withdrawal(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
 		return
 	}
+	owner, err := getOperationOwner(rid)
+	if err != nil || !canAccess(r, owner) {
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("Could not find operation [%s] for user [%d]\n", rid, uid)
+		return
+	}
+	// an admin acts on the account the operation was prepared for
+	uid = owner
 	wr := withdrawalRequestModel{}
 	if err = json.NewDecoder(r.Body).Decode(&wr); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Println("Failed to parse data:", err)
 		return
 	}
+	// the order a debit belongs to is taken from services only, it is what
+	// reconcile sums the ledger by
+	if wr.OrderID != 0 && !isAdmin(r) {
+		log.Printf("User [%d] tried to withdraw for order [%d], the order is ignored\n", uid, wr.OrderID)
+		wr.OrderID = 0
+	}
 	b, err := getbalance(uid)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -316,53 +406,47 @@ func withdrawal(w http.ResponseWriter, r *http.Request) {
 		Price:   wr.WithDrawSum,
 		Status:  false,
 	}
+	// the result is reported even when orders stops waiting, the balance may
+	// have changed already
+	ctx := context.WithoutCancel(r.Context())
 	if wr.WithDrawSum < 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("Got negative withdrawal sum")
-		sendCallback(spanCtx, wc)
+		sendCallback(ctx, spanCtx, wc)
 		return
 	}
 	if wr.WithDrawSum > b {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("There are insufficient funds in the account")
-		sendCallback(spanCtx, wc)
+		sendCallback(ctx, spanCtx, wc)
 		return
 	}
-	if err = updatebalance(uid, rid, -wr.WithDrawSum); err != nil {
+	if err = updatebalance(uid, rid, -wr.WithDrawSum, wr.OrderID); err != nil {
 		log.Printf("Failed to change balance for user [%d]: %s\n", uid, err)
 		w.WriteHeader(http.StatusInternalServerError)
-		sendCallback(spanCtx, wc)
+		sendCallback(ctx, spanCtx, wc)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	wc.Status = true
-	sendCallback(spanCtx, wc)
+	sendCallback(ctx, spanCtx, wc)
 }
 
-func sendCallback(spanCtx opentracing.SpanContext, r *withDrawalResponseModel) {
+// sendCallback is sent once, orders can't tell a repeated payment result
+// from a late one.
+func sendCallback(ctx context.Context, spanCtx opentracing.SpanContext, r *withDrawalResponseModel) {
 	span := tracer.StartSpan("sending callback with payment result", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
-	data, err := json.Marshal(r)
-	if err != nil {
-		log.Printf("Failed to parse data: %s\n", err)
-		return
-	}
-	reqBody := bytes.NewReader(data)
-	req, err := http.NewRequest("POST", ordersCallbackEndpoint, reqBody)
-	if err != nil {
-		log.Printf("Failed callback request: %s\n", err)
-		return
-	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(r.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	_, err := ordersClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   ordersCallbackPath,
+		UserID: r.UserID,
+		Body:   r,
+	}, nil)
 	if err != nil {
 		log.Printf("Failed to call back orders endpoint: %s\n", err)
-		return
 	}
-	defer resp.Body.Close()
 }
 
 func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
@@ -385,3 +469,17 @@ func reqlog(h http.HandlerFunc) http.HandlerFunc {
 		h.ServeHTTP(w, r)
 	}
 }
+
+func isAdmin(r *http.Request) bool {
+	return r.Header.Get("X-User-Role") == roleAdmin
+}
+
+// canAccess reports whether the caller owns the resource or is an admin.
+// Handlers answer 404 when it is false so foreign ids are not leaked.
+func canAccess(r *http.Request, ownerID int) bool {
+	if isAdmin(r) {
+		return true
+	}
+	uid, err := strconv.Atoi(r.Header.Get("X-User-Id"))
+	return err == nil && uid == ownerID
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"lib/client"
+	"lib/servicetest"
+
+	"github.com/google/uuid"
+	"github.com/opentracing/opentracing-go"
+)
+
+// testDB is the test database, main keeps its connection to itself.
+var testDB *sql.DB
+
+// setupTestDB prepares the service against the test database. Orders is
+// replaced with a stub that accepts every call.
+func setupTestDB(t *testing.T) {
+	servicetest.Setup(t, setupService)
+}
+
+func setupService(dsn string) error {
+	db, err := servicetest.OpenDB(dsn, "../chart/templates/initdb.yaml")
+	if err != nil {
+		return err
+	}
+	testDB = db
+	tracer = opentracing.NoopTracer{}
+	mustPrepareStmts(context.Background(), db)
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	}))
+	ordersClient = client.New(tracer, client.Config{BaseURL: stub.URL, Timeout: time.Second})
+	return nil
+}
+
+// newTestOperation prepares an operation on the user's account.
+func newTestOperation(t *testing.T, uid int) string {
+	t.Helper()
+	rid := uuid.New().String()
+	if _, err := prepareOperationStmt.Exec(uid, rid); err != nil {
+		t.Fatal(err)
+	}
+	return rid
+}
+
+func TestBalanceAccess(t *testing.T) {
+	setupTestDB(t)
+
+	for _, c := range servicetest.AccessCallers {
+		t.Run(c.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			get(w, servicetest.NewRequest(http.MethodGet, "/account/get/1", "", c.UID, c.Role, map[string]string{"id": strconv.Itoa(servicetest.Owner)}))
+			if w.Code != c.Want {
+				t.Errorf("status = %d, want %d", w.Code, c.Want)
+			}
+		})
+	}
+}
+
+func TestOperationAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		body    string
+		// delta is the change of the owner's balance
+		delta int
+	}{
+		{name: "deposit", handler: deposit, path: "/account/deposit", body: `{"delta":10}`, delta: 10},
+		{name: "withdrawal", handler: withdrawal, path: "/account/withdrawal", body: `{"order_id":1,"withdrawal_sum":0}`},
+	}
+	for _, tt := range tests {
+		for _, c := range servicetest.AccessCallers {
+			t.Run(tt.name+"/"+c.Name, func(t *testing.T) {
+				before, err := getbalance(servicetest.Owner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := servicetest.NewRequest(http.MethodPost, tt.path, tt.body, c.UID, c.Role, nil)
+				r.Header.Set("X-Request-Id", newTestOperation(t, servicetest.Owner))
+				w := httptest.NewRecorder()
+				tt.handler(w, r)
+				if w.Code != c.Want {
+					t.Fatalf("status = %d, want %d: %s", w.Code, c.Want, w.Body)
+				}
+				want := before
+				if c.Want == http.StatusOK {
+					want += tt.delta
+				}
+				if got, err := getbalance(servicetest.Owner); err != nil || got != want {
+					t.Errorf("balance = %d, %v, want %d", got, err, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRefundDepositAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name string
+		uid  int
+		role string
+		want int
+	}{
+		{name: "owner", uid: servicetest.Owner, want: http.StatusForbidden},
+		{name: "service", uid: servicetest.Owner, role: roleAdmin, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := servicetest.NewRequest(http.MethodPost, "/account/deposit", `{"delta":10,"order_id":7}`, tt.uid, tt.role, nil)
+			r.Header.Set("X-Request-Id", newTestOperation(t, servicetest.Owner))
+			w := httptest.NewRecorder()
+			deposit(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestWithdrawalOrderID(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name string
+		role string
+		want int
+	}{
+		{name: "user", want: 0},
+		{name: "service", role: roleAdmin, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rid := newTestOperation(t, servicetest.Owner)
+			r := servicetest.NewRequest(http.MethodPost, "/account/withdrawal", `{"order_id":7,"withdrawal_sum":0}`, servicetest.Owner, tt.role, nil)
+			r.Header.Set("X-Request-Id", rid)
+			w := httptest.NewRecorder()
+			withdrawal(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var oid int
+			if err := testDB.QueryRow(`SELECT COALESCE(order_id, 0) FROM account WHERE request_id=$1`, rid).Scan(&oid); err != nil {
+				t.Fatal(err)
+			}
+			if oid != tt.want {
+				t.Errorf("order_id = %d, want %d", oid, tt.want)
+			}
+		})
+	}
+}
@@ -28,6 +28,7 @@ type userModel struct {
 	Email     string `json:"email"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	role      string
 }
 
 type loginModel struct {
@@ -52,12 +53,16 @@ var (
 
 const (
 	createUserTpl = `INSERT INTO auth_user (login, password, email, first_name, last_name) VALUES ($1, $2, $3, $4, $5) returning id`
-	getUserTpl    = `SELECT id, login, email, first_name, last_name FROM auth_user WHERE login=$1 AND password=$2`
+	getUserTpl    = `SELECT id, login, email, first_name, last_name, role FROM auth_user WHERE login=$1 AND password=$2`
+	lookupUserTpl = `SELECT id, login, email FROM auth_user WHERE ($1 <> '' AND login=$1) OR ($2 <> '' AND email=$2) ORDER BY id LIMIT 1`
 )
 
+const roleAdmin = "admin"
+
 var (
 	createUserStmt  *sql.Stmt
 	getUserStmt     *sql.Stmt
+	lookupUserStmt  *sql.Stmt
 	getUserListStmt *sql.Stmt
 	updateUserStmt  *sql.Stmt
 	deleteUserStmt  *sql.Stmt
@@ -154,6 +159,7 @@ func main() {
 	r.HandleFunc("/auth", auth)
 	r.HandleFunc("/logout", logout).Methods("GET", "POST")
 	r.HandleFunc("/health", health)
+	r.HandleFunc("/users/lookup", lookup).Methods("GET")
 
 	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
 	if err := http.ListenAndServe(bindOn, r); err != nil {
@@ -173,6 +179,11 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	lookupUserStmt, err = db.PrepareContext(ctx, lookupUserTpl)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func register(w http.ResponseWriter, r *http.Request) {
@@ -269,6 +280,7 @@ func auth(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("X-Email", userInfo.Email)
 			w.Header().Set("X-First-Name", userInfo.FirstName)
 			w.Header().Set("X-Last-Name", userInfo.LastName)
+			w.Header().Set("X-User-Role", userInfo.role)
 			w.WriteHeader(http.StatusOK)
 			data, _ := json.MarshalIndent(userInfo, "", "\t")
 			w.Write(data)
@@ -295,6 +307,42 @@ func logout(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &cookie)
 }
 
+// lookup finds a user by login or email for the other services. It is not
+// exposed by the ingress, and only services calling on their own behalf with
+// the admin role or admins may use it.
+func lookup(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for user lookup", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if r.Header.Get("X-User-Role") != roleAdmin {
+		log.Printf("User [%s] is not allowed to look up users\n", r.Header.Get("X-User-Id"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	login, email := q.Get("login"), q.Get("email")
+	if login == "" && email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Login or email is required"))
+		return
+	}
+	var id int
+	if err := lookupUserStmt.QueryRow(login, email).Scan(&id, &login, &email); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Failed to look up user:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "login": login, "email": email})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 func health(w http.ResponseWriter, r *http.Request) {
 	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
 	span := tracer.StartSpan("got request for current balance", ext.RPCServerOption(spanCtx))
@@ -332,6 +380,7 @@ func getUserByCredentials(l *loginModel) (*userModel, error) {
 	email := new(string)
 	firstName := new(string)
 	lastName := new(string)
+	role := new(string)
 
 	if err = rows.Scan(
 		id,
@@ -339,6 +388,7 @@ func getUserByCredentials(l *loginModel) (*userModel, error) {
 		email,
 		firstName,
 		lastName,
+		role,
 	); err != nil {
 		return nil, err
 	}
@@ -348,6 +398,7 @@ func getUserByCredentials(l *loginModel) (*userModel, error) {
 		Email:     *email,
 		FirstName: *firstName,
 		LastName:  *lastName,
+		role:      *role,
 	}, nil
 }
 
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"lib/servicetest"
+)
+
+// createOwnedEvent creates an event of the test owner with the status, a
+// week ahead so it is open for changes.
+func createOwnedEvent(t *testing.T, status int) int {
+	t.Helper()
+	var id int
+	err := db.QueryRow(`INSERT INTO events (event_name, price, total_slots, starts_at, status, owner_id) VALUES ($1, 1, 10, $2, $3, $4) RETURNING id`,
+		fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano()), time.Now().Add(7*24*time.Hour), status, servicetest.Owner).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// createTestTicketType adds a ticket type to the event and returns its id.
+func createTestTicketType(t *testing.T, eid int) int {
+	t.Helper()
+	var id int
+	if err := db.QueryRow(`INSERT INTO ticket_types (event_id, name, price, quota) VALUES ($1, 'standard', 1, 5) RETURNING id`, eid).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestEventAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		status  int
+		// withType routes to a ticket type of the event
+		withType bool
+	}{
+		{name: "get draft", handler: get, method: http.MethodGet, path: "/events/get/%d", status: eventDraft},
+		{name: "calendar of draft", handler: getEventCalendar, method: http.MethodGet, path: "/events/ics/%d", status: eventDraft},
+		{name: "ticket types of draft", handler: listTicketTypes, method: http.MethodGet, path: "/events/ticket-types/%d", status: eventDraft},
+		{name: "seats of draft", handler: getSeats, method: http.MethodGet, path: "/events/seats/%d", status: eventDraft},
+		{name: "waitlist", handler: getWaitlist, method: http.MethodGet, path: "/events/waitlist/%d", status: eventPublished},
+		{name: "update", handler: updateEvent, method: http.MethodPost, path: "/events/manage/%d", body: `{"price":2}`, status: eventPublished},
+		{name: "publish", handler: publishEvent, method: http.MethodPost, path: "/events/manage/%d/publish", status: eventDraft},
+		{name: "cancel", handler: cancelEvent, method: http.MethodPost, path: "/events/manage/%d/cancel", status: eventPublished},
+		{name: "delete", handler: deleteEvent, method: http.MethodDelete, path: "/events/manage/%d", status: eventDraft},
+		{name: "refund policy", handler: setRefundPolicy, method: http.MethodPost, path: "/events/refund-policy/%d", body: `[{"hours_before":24,"percent":50}]`, status: eventPublished},
+		{name: "pricing", handler: setPricingRules, method: http.MethodPost, path: "/events/pricing/%d", body: `[]`, status: eventPublished},
+		{name: "transfers", handler: setTransfers, method: http.MethodPost, path: "/events/transfers/%d", body: `{"disabled":true}`, status: eventPublished},
+		{name: "create ticket type", handler: createTicketType, method: http.MethodPost, path: "/events/ticket-types/%d", body: `{"name":"vip","price":2,"quota":1}`, status: eventPublished},
+		{name: "update ticket type", handler: updateTicketType, method: http.MethodPost, path: "/events/ticket-types/%d", body: `{"name":"standard","price":2,"quota":5}`, status: eventPublished, withType: true},
+		{name: "delete ticket type", handler: deleteTicketType, method: http.MethodDelete, path: "/events/ticket-types/%d", status: eventPublished, withType: true},
+		{name: "seat layout", handler: setSeatLayout, method: http.MethodPost, path: "/events/seats/%d", body: `{"rows":[{"section":"A","row":"1","from":1,"to":5}]}`, status: eventPublished},
+	}
+	for _, tt := range tests {
+		for _, c := range servicetest.AccessCallers {
+			t.Run(tt.name+"/"+c.Name, func(t *testing.T) {
+				eid := createOwnedEvent(t, tt.status)
+				vars := map[string]string{"id": strconv.Itoa(eid)}
+				if tt.withType {
+					vars["type"] = strconv.Itoa(createTestTicketType(t, eid))
+				}
+				w := httptest.NewRecorder()
+				tt.handler(w, servicetest.NewRequest(tt.method, fmt.Sprintf(tt.path, eid), tt.body, c.UID, c.Role, vars))
+				if w.Code != c.Want {
+					t.Errorf("status = %d, want %d: %s", w.Code, c.Want, w.Body)
+				}
+			})
+		}
+	}
+}
+
+// createTestSeries creates a daily series of the test owner and returns it
+// with its occurrences.
+func createTestSeries(t *testing.T) *seriesModel {
+	t.Helper()
+	start := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second).Format(time.RFC3339)
+	body := fmt.Sprintf(`{"rrule":"FREQ=DAILY;COUNT=3","event":{"event_name":"%s","price":1,"total_slots":10,"starts_at":"%s"}}`, t.Name(), start)
+	w := httptest.NewRecorder()
+	createSeries(w, servicetest.NewRequest(http.MethodPost, "/events/series", body, servicetest.Owner, "", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("createSeries() status = %d: %s", w.Code, w.Body)
+	}
+	s := seriesModel{}
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Occurrences) == 0 {
+		t.Fatal("series has no occurrences")
+	}
+	return &s
+}
+
+func TestSeriesAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		// body is given the series
+		body func(s *seriesModel) string
+	}{
+		{name: "update", handler: updateSeries, path: "/events/series/%d", body: func(*seriesModel) string { return `{"price":2}` }},
+		{name: "cancel dates", handler: cancelSeriesDates, path: "/events/series/%d/cancel", body: func(s *seriesModel) string {
+			return fmt.Sprintf(`{"dates":[%q]}`, s.Occurrences[0].StartsAt.Format(time.RFC3339))
+		}},
+	}
+	for _, tt := range tests {
+		for _, c := range servicetest.AccessCallers {
+			t.Run(tt.name+"/"+c.Name, func(t *testing.T) {
+				s := createTestSeries(t)
+				w := httptest.NewRecorder()
+				r := servicetest.NewRequest(http.MethodPost, fmt.Sprintf(tt.path, s.ID), tt.body(s), c.UID, c.Role, map[string]string{"id": strconv.Itoa(s.ID)})
+				tt.handler(w, r)
+				if w.Code != c.Want {
+					t.Errorf("status = %d, want %d: %s", w.Code, c.Want, w.Body)
+				}
+			})
+		}
+	}
+}
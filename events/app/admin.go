@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	getOrderSlotsTpl = `SELECT order_id, user_id, COUNT(1) FILTER (WHERE status=$1), COUNT(1) FILTER (WHERE status=$2) FROM slots GROUP BY order_id, user_id ORDER BY order_id`
+)
+
+var (
+	getOrderSlotsStmt *sql.Stmt
+)
+
+// orderSlotsModel counts the slots taken by one order.
+type orderSlotsModel struct {
+	OrderID   int `json:"order_id"`
+	UserID    int `json:"user_id"`
+	Held      int `json:"held"`
+	Confirmed int `json:"confirmed"`
+}
+
+func mustPrepareAdminStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	getOrderSlotsStmt, err = db.PrepareContext(ctx, getOrderSlotsTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// getOrderSlots lists the slots of every order. It is used by the
+// reconciliation job of orders.
+func getOrderSlots(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for orders' slots", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rows, err := getOrderSlotsStmt.Query(slotHeld, slotConfirmed)
+	if err != nil {
+		log.Printf("Failed to get orders' slots: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	slots := []orderSlotsModel{}
+	for rows.Next() {
+		s := orderSlotsModel{}
+		if err = rows.Scan(&s.OrderID, &s.UserID, &s.Held, &s.Confirmed); err != nil {
+			log.Printf("Failed to scan order's slots: %s\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		slots = append(slots, s)
+	}
+	data, _ := json.Marshal(slots)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lib/ical"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+func (e *eventModel) calendarEvent() ical.Event {
+	return ical.Event{
+		ID:          e.ID,
+		Summary:     e.Name,
+		Description: e.Description,
+		Location:    ical.Location(e.Venue, e.Address),
+		Start:       *e.StartsAt,
+		End:         e.EndsAt,
+		Cancelled:   e.Status == eventStatusNames[eventCancelled],
+		Modified:    e.UpdatedAt,
+	}
+}
+
+// getEventCalendar handles GET /events/ics/{id}, the event as an .ics file.
+func getEventCalendar(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for event calendar", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e, err := getEvent(id)
+	if err == nil && e.Status == eventStatusNames[eventDraft] && !canManage(r, e.OwnerID) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if e.StartsAt == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Event [%d] has no start yet", id)
+		return
+	}
+	c := ical.Calendar{Events: []ical.Event{e.calendarEvent()}}
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="event-%d.ics"`, id))
+	w.WriteHeader(http.StatusOK)
+	if err = c.Write(w, time.Now()); err != nil {
+		log.Printf("Failed to write calendar of event [%d]: %s\n", id, err)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lib/client"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	eventDraft = iota + 1
+	eventPublished
+	eventCancelled
+)
+
+const (
+	lockEventStatusTpl   = `SELECT status, total_slots FROM events WHERE id=$1 FOR UPDATE`
+	updateEventTpl       = `UPDATE events SET event_name=COALESCE($2, event_name), price=COALESCE($3, price), total_slots=COALESCE($4, total_slots), starts_at=COALESCE($5, starts_at), ends_at=COALESCE($6, ends_at), registration_deadline=COALESCE($7, registration_deadline), venue=COALESCE($8, venue), address=COALESCE($9, address), description=COALESCE($10, description), organizer=COALESCE($11, organizer), tags=COALESCE($12, tags), updated_at=now() WHERE id=$1`
+	publishEventTpl      = `UPDATE events SET status=$2, updated_at=now() WHERE id=$1 AND status=$3`
+	cancelEventTpl       = `UPDATE events SET status=$2, updated_at=now() WHERE id=$1`
+	clearWaitlistTpl     = `DELETE FROM waitlist WHERE event_id=$1 AND status=$2 RETURNING user_id`
+	deleteEventTpl       = `DELETE FROM events WHERE id=$1`
+	deleteTicketTypesTpl = `DELETE FROM ticket_types WHERE event_id=$1`
+	deleteWaitlistTpl    = `DELETE FROM waitlist WHERE event_id=$1`
+	eventOrdersPath      = "/orders/admin/events/"
+	eventOrdersCancelled = "/cancel"
+)
+
+var (
+	lockEventStatusStmt   *sql.Stmt
+	updateEventStmt       *sql.Stmt
+	publishEventStmt      *sql.Stmt
+	cancelEventStmt       *sql.Stmt
+	clearWaitlistStmt     *sql.Stmt
+	deleteEventStmt       *sql.Stmt
+	deleteWaitlistStmt    *sql.Stmt
+	deleteTicketTypesStmt *sql.Stmt
+)
+
+var (
+	errEventClosed    = errors.New("event is not open for orders")
+	errEventCancelled = errors.New("event is cancelled")
+	errBelowOccupied  = errors.New("capacity is below the taken slots")
+	errEventTaken     = errors.New("event has taken slots")
+	errWrongSchedule  = errors.New("wrong schedule")
+)
+
+var eventStatusNames = map[int]string{
+	eventDraft:     "draft",
+	eventPublished: "published",
+	eventCancelled: "cancelled",
+}
+
+// eventUpdateModel lists the fields that can be changed, missing ones are
+// kept. A new price applies to the orders made after the change.
+type eventUpdateModel struct {
+	Name       *string    `json:"event_name"`
+	Price      *int       `json:"price"`
+	TotalSlots *int       `json:"total_slots"`
+	StartsAt   *time.Time `json:"starts_at"`
+
+	EndsAt               *time.Time `json:"ends_at"`
+	RegistrationDeadline *time.Time `json:"registration_deadline"`
+	Venue                *string    `json:"venue"`
+	Address              *string    `json:"address"`
+	Description          *string    `json:"description"`
+	Organizer            *string    `json:"organizer"`
+	Tags                 []string   `json:"tags"`
+}
+
+type eventOrdersModel struct {
+	Orders    int `json:"orders"`
+	Cancelled int `json:"cancelled"`
+}
+
+func mustPrepareLifecycleStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	lockEventStatusStmt, err = db.PrepareContext(ctx, lockEventStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+	updateEventStmt, err = db.PrepareContext(ctx, updateEventTpl)
+	if err != nil {
+		panic(err)
+	}
+	publishEventStmt, err = db.PrepareContext(ctx, publishEventTpl)
+	if err != nil {
+		panic(err)
+	}
+	cancelEventStmt, err = db.PrepareContext(ctx, cancelEventTpl)
+	if err != nil {
+		panic(err)
+	}
+	clearWaitlistStmt, err = db.PrepareContext(ctx, clearWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+	deleteEventStmt, err = db.PrepareContext(ctx, deleteEventTpl)
+	if err != nil {
+		panic(err)
+	}
+	deleteWaitlistStmt, err = db.PrepareContext(ctx, deleteWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+	deleteTicketTypesStmt, err = db.PrepareContext(ctx, deleteTicketTypesTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// publicEvents drops the drafts, only their owners and admins see them.
+func publicEvents(r *http.Request, es []eventModel) []eventModel {
+	if isAdmin(r) {
+		return es
+	}
+	res := []eventModel{}
+	for _, e := range es {
+		if e.Status != eventStatusNames[eventDraft] || canManage(r, e.OwnerID) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// updateEventTx changes the event under the same lock occupy takes, so the
+// capacity can't drop below the slots taken meanwhile.
+func updateEventTx(id int, u *eventUpdateModel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = applyEventUpdate(tx, id, u); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func applyEventUpdate(tx *sql.Tx, id int, u *eventUpdateModel) error {
+	var status, totalSlots int
+	if err := tx.Stmt(lockEventStatusStmt).QueryRow(id).Scan(&status, &totalSlots); err != nil {
+		return err
+	}
+	if status == eventCancelled {
+		return errEventCancelled
+	}
+	e, err := getEventWith(tx.Stmt(getEventStmt), id)
+	if err != nil {
+		return err
+	}
+	if u.StartsAt != nil {
+		e.StartsAt = u.StartsAt
+	}
+	if u.EndsAt != nil {
+		e.EndsAt = u.EndsAt
+	}
+	if u.RegistrationDeadline != nil {
+		e.RegistrationDeadline = u.RegistrationDeadline
+	}
+	if err = validateSchedule(e); err != nil {
+		return fmt.Errorf("%w: %s", errWrongSchedule, err)
+	}
+	if u.TotalSlots != nil {
+		occupied, err := getOccupiedSlots(tx.Stmt(occupiedSlotsStmt), id)
+		if err != nil {
+			return err
+		}
+		if *u.TotalSlots < occupied {
+			return fmt.Errorf("%w: %d slots are taken", errBelowOccupied, occupied)
+		}
+	}
+	_, err = tx.Stmt(updateEventStmt).Exec(id, u.Name, u.Price, u.TotalSlots, u.StartsAt, u.EndsAt, u.RegistrationDeadline, u.Venue, u.Address, u.Description, u.Organizer, tagsParam(u.Tags))
+	return err
+}
+
+// cancelEventOrders asks orders to cancel and refund every active order of
+// the event. Orders does it in the background and answers with the count.
+func cancelEventOrders(ctx context.Context, spanCtx opentracing.SpanContext, id int) (*eventOrdersModel, error) {
+	res := &eventOrdersModel{}
+	_, err := ordersClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodPost,
+		Path:       eventOrdersPath + strconv.Itoa(id) + eventOrdersCancelled,
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, res)
+	return res, err
+}
+
+func countEventOrders(ctx context.Context, spanCtx opentracing.SpanContext, id int) (*eventOrdersModel, error) {
+	res := &eventOrdersModel{}
+	_, err := ordersClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       eventOrdersPath + strconv.Itoa(id),
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, res)
+	return res, err
+}
+
+// adminHeader lets events call the admin endpoints of orders.
+func adminHeader() http.Header {
+	return http.Header{"X-User-Id": {"0"}, "X-User-Role": {roleAdmin}}
+}
+
+// updateEvent changes the name, price, capacity, schedule or place of the
+// event.
+func updateEvent(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for updating event", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	u := eventUpdateModel{}
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse update of event [%d]: %s\n", id, err)
+		return
+	}
+	if (u.Price != nil && *u.Price < 0) || (u.TotalSlots != nil && *u.TotalSlots < 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Price and total slots can't be negative")
+		return
+	}
+	err := updateEventTx(id, &u)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errWrongSchedule):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	case errors.Is(err, errEventCancelled), errors.Is(err, errBelowOccupied):
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	case err != nil:
+		log.Printf("Failed to update event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	e, err := getEvent(id)
+	if err != nil {
+		log.Printf("Failed to get updated event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Event [%d] was updated\n", id)
+	data, _ := json.Marshal(e)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// publishEvent opens a draft for orders.
+func publishEvent(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for publishing event", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	res, err := publishEventStmt.Exec(id, eventPublished, eventDraft)
+	if err != nil {
+		log.Printf("Failed to publish event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Event [%d] is not a draft", id)
+		return
+	}
+	log.Printf("Event [%d] was published\n", id)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+// closeEvent marks the event cancelled and drops its waitlist, the orders
+// are left to cancelEventOrders.
+func closeEvent(ctx context.Context, spanCtx opentracing.SpanContext, id int) error {
+	if _, err := cancelEventStmt.Exec(id, eventCancelled); err != nil {
+		return err
+	}
+	rows, err := clearWaitlistStmt.Query(id, waitlistWaiting)
+	if err != nil {
+		log.Printf("Failed to clear waitlist of event [%d]: %s\n", id, err)
+		return nil
+	}
+	waiting := []int{}
+	for rows.Next() {
+		var uid int
+		if err = rows.Scan(&uid); err == nil {
+			waiting = append(waiting, uid)
+		}
+	}
+	rows.Close()
+	for _, uid := range waiting {
+		notify(ctx, spanCtx, uid, fmt.Sprintf("Event [%d] was cancelled, you were removed from its waitlist", id))
+	}
+	return nil
+}
+
+// cancelEvent closes the event for orders, drops its waitlist and has orders
+// cancel and refund the orders made for it. Repeating it for a cancelled
+// event asks orders once more, which picks up what failed before.
+func cancelEvent(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for cancelling event", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := getEvent(id); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := closeEvent(r.Context(), span.Context(), id); err != nil {
+		log.Printf("Failed to cancel event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res, err := cancelEventOrders(r.Context(), span.Context(), id)
+	if err != nil {
+		log.Printf("Failed to cancel orders of event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Event [%d] is cancelled, but its orders were not: %s", id, err)
+		return
+	}
+	log.Printf("Event [%d] was cancelled with [%d] orders\n", id, res.Cancelled)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "cancelled_orders":%d}`, res.Cancelled)
+}
+
+// deleteEventTx removes the event with its waitlist, seats and ticket types
+// under the lock occupy takes. A deleted occurrence of a series is left out
+// of it, so it is not generated again.
+func deleteEventTx(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status, totalSlots int
+	if err = tx.Stmt(lockEventStatusStmt).QueryRow(id).Scan(&status, &totalSlots); err != nil {
+		return err
+	}
+	occupied, err := getOccupiedSlots(tx.Stmt(occupiedSlotsStmt), id)
+	if err != nil {
+		return err
+	}
+	if occupied > 0 {
+		return errEventTaken
+	}
+	for _, q := range []*sql.Stmt{addExdateStmt, deleteWaitlistStmt, deleteSeatsStmt, deleteTicketTypesStmt, deleteEventStmt} {
+		if _, err = tx.Stmt(q).Exec(id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteEvent removes an event nobody ever ordered.
+func deleteEvent(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for deleting event", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := getEvent(id); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	res, err := countEventOrders(r.Context(), span.Context(), id)
+	if err != nil {
+		log.Printf("Failed to count orders of event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if res.Orders > 0 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Event [%d] has %d orders, cancel it instead", id, res.Orders)
+		return
+	}
+	err = deleteEventTx(id)
+	if errors.Is(err, errEventTaken) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Event [%d] has taken slots", id)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Event [%d] was deleted\n", id)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
@@ -2,41 +2,110 @@ package main
 
 import (
 	"app/tracing"
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"lib/client"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 )
 
 type eventModel struct {
-	ID         int    `json:"id,omitempty"`
-	Name       string `json:"event_name"`
-	Price      int    `json:"price"`
-	TotalSlots int    `json:"total_slots"`
+	ID    int    `json:"id,omitempty"`
+	Name  string `json:"event_name"`
+	Price int    `json:"price"`
+	// CurrentPrice is Price after the pricing rules that hold right now
+	CurrentPrice   int `json:"current_price"`
+	TotalSlots     int `json:"total_slots"`
+	HeldSlots      int `json:"held_slots"`
+	ConfirmedSlots int `json:"confirmed_slots"`
+	AvailableSlots int `json:"available_slots"`
+	// Status is draft, published or cancelled, only published events are
+	// open for orders
+	Status string `json:"status,omitempty"`
+
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+	// RegistrationDeadline closes the event for orders, when it is not set
+	// the event closes when it ends or, without an end, when it starts
+	RegistrationDeadline *time.Time `json:"registration_deadline,omitempty"`
+	// RegistrationOpen is computed, it is true for published events before
+	// they close
+	RegistrationOpen bool   `json:"registration_open"`
+	Venue            string `json:"venue,omitempty"`
+	Address          string `json:"address,omitempty"`
+	Description      string `json:"description,omitempty"`
+	// Organizer and Tags are shown to users and used by the search
+	Organizer string   `json:"organizer,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+
+	RefundPolicy refundPolicyModel `json:"refund_policy,omitempty"`
+	PricingRules pricingRulesModel `json:"pricing_rules,omitempty"`
+	TicketTypes  []ticketTypeModel `json:"ticket_types,omitempty"`
+	// TransfersDisabled forbids giving the event's tickets to other users
+	TransfersDisabled bool `json:"transfers_disabled,omitempty"`
+
+	// SeriesID is set for the occurrences of a series, OccurrenceAt is the
+	// start the series gave the occurrence before it was moved
+	SeriesID     int        `json:"series_id,omitempty"`
+	OccurrenceAt *time.Time `json:"occurrence_at,omitempty"`
+	// Occurrences counts the listed occurrences of the series folded into
+	// this one when the list collapses series
+	Occurrences int `json:"occurrences,omitempty"`
+	// UpdatedAt is when the name, schedule, place or status last changed
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// OwnerID is the user who created the event, the owner and admins may
+	// change it
+	OwnerID int `json:"owner_id,omitempty"`
+}
+
+// occupyItemModel asks for a number of slots of one event; Price is filled
+// in with the price of a slot once the slots are occupied, PricingRule with
+// the pricing rule that set it.
+type occupyItemModel struct {
+	EventID     int               `json:"event_id"`
+	Quantity    int               `json:"quantity"`
+	Price       int               `json:"price,omitempty"`
+	PricingRule *pricingRuleModel `json:"pricing_rule,omitempty"`
+	// TicketTypeID is filled in with the picked type when it is not set
+	TicketTypeID int `json:"ticket_type_id,omitempty"`
+	// SeatIDs picks the seats of a seated event, Seats are the taken ones
+	SeatIDs []int       `json:"seat_ids,omitempty"`
+	Seats   []seatModel `json:"seats,omitempty"`
 }
 
 type occupyRequestModel struct {
-	OrderID int `json:"order_id"`
-	EventID int `json:"event_id"`
+	OrderID int               `json:"order_id"`
+	EventID int               `json:"event_id"`
+	Items   []occupyItemModel `json:"items,omitempty"`
+	// Role of the user, some ticket types are only for some roles
+	Role string `json:"role,omitempty"`
 }
 
 type occupiedResponseModel struct {
-	OrderID int  `json:"order_id"`
-	UserID  int  `json:"user_id"`
-	Price   int  `json:"price"`
-	Status  bool `json:"status"`
+	OrderID   int               `json:"order_id"`
+	UserID    int               `json:"user_id"`
+	Price     int               `json:"price"`
+	Status    bool              `json:"status"`
+	Items     []occupyItemModel `json:"items,omitempty"`
+	HeldUntil *time.Time        `json:"held_until,omitempty"`
+}
+
+type expiredHoldModel struct {
+	OrderID int `json:"order_id"`
+	UserID  int `json:"user_id"`
 }
 
 type configModel struct {
@@ -47,6 +116,13 @@ type configModel struct {
 	dbPass string
 	host   string
 	port   string
+
+	holdTTL time.Duration
+
+	ordersURL     string
+	notifURL      string
+	clientTimeout time.Duration
+	clientRetries int
 }
 
 const (
@@ -57,26 +133,55 @@ const (
 	statusCancelled = -1
 )
 
+// A held slot is released by the expirer unless the order confirms it
+// after payment before the hold runs out.
+const (
+	slotHeld = iota + 1
+	slotConfirmed
+)
+
+const roleAdmin = "admin"
+
+const (
+	defaultHoldTTL      = 15 * time.Minute
+	holdExpirerInterval = 30 * time.Second
+)
+
 const (
-	createEventTpl        = `INSERT INTO events (event_name, price, total_slots) VALUES ($1, $2, $3) RETURNING id`
-	occupySlotTpl         = `INSERT INTO slots (event_id, order_id) VALUES ($1, $2)`
-	cancelSlotTpl         = `DELETE FROM slots WHERE order_id = $1`
-	occupiedSlotsTpl      = `SELECT COUNT(1) FROM slots WHERE event_id=$1`
-	getEventTpl           = `SELECT id, event_name, price, total_slots FROM events WHERE id=$1`
-	getEventsTpl          = `SELECT id, event_name, price, total_slots FROM events`
-	orderCallbackEndpoint = "http://orders.proj.svc.cluster.local:9000/orders/callback/events"
-	createdTpl            = `{"created_status": true, "event_id": %d, "event_name": %s, "price": %d, "total_slots": %d}`
+	createEventTpl    = `INSERT INTO events (event_name, price, total_slots, starts_at, refund_policy, transfers_disabled, status, ends_at, registration_deadline, venue, address, description, organizer, tags, series_id, occurrence_at, owner_id, pricing_rules) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NULLIF($15::integer, 0), $16, NULLIF($17::integer, 0), $18) RETURNING id`
+	occupySlotTpl     = `INSERT INTO slots (event_id, order_id, user_id, status, held_until, seq, ticket_type_id, seat_id, price, pricing_rule) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (order_id, event_id, ticket_type_id, seq) DO NOTHING`
+	cancelSlotTpl     = `DELETE FROM slots WHERE order_id = $1 RETURNING event_id, status`
+	confirmSlotsTpl   = `UPDATE slots SET status=$3, held_until=NULL WHERE order_id=$1 AND status=$2`
+	confirmedSlotsTpl = `SELECT COUNT(1) FROM slots WHERE order_id=$1 AND status=$2`
+	expireHoldsTpl    = `DELETE FROM slots WHERE status=$1 AND held_until < now() RETURNING order_id, user_id, event_id`
+	occupiedSlotsTpl  = `SELECT COUNT(1) FROM slots WHERE event_id=$1`
+	lockEventTpl      = `SELECT price, total_slots, status, COALESCE(registration_deadline, ends_at, starts_at), starts_at, pricing_rules FROM events WHERE id=$1 FOR UPDATE`
+	orderSlotsTpl     = `SELECT COUNT(1), MIN(held_until), MIN(price), MIN(pricing_rule::text) FROM slots WHERE event_id=$1 AND order_id=$2 AND ticket_type_id=$3`
+	getEventTpl       = `SELECT e.id, e.event_name, e.price, e.total_slots, COUNT(s.id) FILTER (WHERE s.status=$2), COUNT(s.id) FILTER (WHERE s.status=$3), e.starts_at, e.ends_at, e.registration_deadline, e.venue, e.address, e.description, e.organizer, e.tags, e.refund_policy, e.pricing_rules, e.transfers_disabled, e.status, COALESCE(e.series_id, 0), e.occurrence_at, e.updated_at, COALESCE(e.owner_id, 0) FROM events e LEFT JOIN slots s ON s.event_id=e.id WHERE e.id=$1 GROUP BY e.id`
+	getEventsTpl      = `SELECT e.id, e.event_name, e.price, e.total_slots, COUNT(s.id) FILTER (WHERE s.status=$1), COUNT(s.id) FILTER (WHERE s.status=$2), e.starts_at, e.ends_at, e.registration_deadline, e.venue, e.address, e.description, e.organizer, e.tags, e.refund_policy, e.pricing_rules, e.transfers_disabled, e.status, COALESCE(e.series_id, 0), e.occurrence_at, e.updated_at, COALESCE(e.owner_id, 0) FROM events e LEFT JOIN slots s ON s.event_id=e.id WHERE ($3::timestamptz IS NULL OR e.starts_at >= $3) AND ($4::timestamptz IS NULL OR e.starts_at < $4) AND ($5::timestamptz IS NULL OR COALESCE(e.ends_at, e.starts_at) < $5) GROUP BY e.id ORDER BY e.id`
+	orderCallbackPath = "/orders/callback/events"
+	orderExpiredPath  = "/orders/callback/expired"
+	createdTpl        = `{"created_status": true, "event_id": %d, "event_name": %s, "price": %d, "total_slots": %d}`
 )
 
 var (
-	createEventStmt   *sql.Stmt
-	occupySlotStmt    *sql.Stmt
-	cancelSlotStmt    *sql.Stmt
-	occupiedSlotsStmt *sql.Stmt
-	getEventStmt      *sql.Stmt
-	getEventsStmt     *sql.Stmt
-	tracer            opentracing.Tracer
-	closer            io.Closer
+	createEventStmt    *sql.Stmt
+	occupySlotStmt     *sql.Stmt
+	cancelSlotStmt     *sql.Stmt
+	occupiedSlotsStmt  *sql.Stmt
+	lockEventStmt      *sql.Stmt
+	orderSlotsStmt     *sql.Stmt
+	getEventStmt       *sql.Stmt
+	getEventsStmt      *sql.Stmt
+	confirmSlotsStmt   *sql.Stmt
+	confirmedSlotsStmt *sql.Stmt
+	expireHoldsStmt    *sql.Stmt
+	holdTTL            = defaultHoldTTL
+	ordersClient       *client.Client
+	notifClient        *client.Client
+	db                 *sql.DB
+	tracer             opentracing.Tracer
+	closer             io.Closer
 )
 
 func readConf() *configModel {
@@ -88,6 +193,13 @@ func readConf() *configModel {
 		dbPass: "",
 		host:   "0.0.0.0",
 		port:   "80",
+
+		holdTTL: defaultHoldTTL,
+
+		ordersURL:     "http://orders.proj.svc.cluster.local:9000",
+		notifURL:      "http://notif.proj.svc.cluster.local:9000",
+		clientTimeout: client.DefaultTimeout,
+		clientRetries: client.DefaultRetries,
 	}
 	dbHost := os.Getenv("DBHOST")
 	dbPort := os.Getenv("DBPORT")
@@ -96,6 +208,11 @@ func readConf() *configModel {
 	dbPass := os.Getenv("DBPASS")
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
+	holdTTL := os.Getenv("HOLD_TTL")
+	ordersURL := os.Getenv("ORDERS_URL")
+	notifURL := os.Getenv("NOTIF_URL")
+	clientTimeout := os.Getenv("CLIENT_TIMEOUT")
+	clientRetries := os.Getenv("CLIENT_RETRIES")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -118,6 +235,33 @@ func readConf() *configModel {
 	if port != "" {
 		cfg.port = port
 	}
+	if holdTTL != "" {
+		if ttl, err := time.ParseDuration(holdTTL); err == nil {
+			cfg.holdTTL = ttl
+		} else {
+			log.Printf("Failed to parse [HOLD_TTL], using default %s: %s\n", cfg.holdTTL, err)
+		}
+	}
+	if ordersURL != "" {
+		cfg.ordersURL = ordersURL
+	}
+	if notifURL != "" {
+		cfg.notifURL = notifURL
+	}
+	if clientTimeout != "" {
+		if timeout, err := time.ParseDuration(clientTimeout); err == nil {
+			cfg.clientTimeout = timeout
+		} else {
+			log.Printf("Failed to parse [CLIENT_TIMEOUT], using default %s: %s\n", cfg.clientTimeout, err)
+		}
+	}
+	if clientRetries != "" {
+		if retries, err := strconv.Atoi(clientRetries); err == nil {
+			cfg.clientRetries = retries
+		} else {
+			log.Printf("Failed to parse [CLIENT_RETRIES], using default %d: %s\n", cfg.clientRetries, err)
+		}
+	}
 	return cfg
 }
 
@@ -140,7 +284,8 @@ func main() {
 
 	cfg := readConf()
 
-	db, err := makeDBConn(cfg)
+	var err error
+	db, err = makeDBConn(cfg)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -160,13 +305,45 @@ func main() {
 
 	mustPrepareStmts(ctx, db)
 
+	holdTTL = cfg.holdTTL
+	ordersClient = client.New(tracer, client.Config{BaseURL: cfg.ordersURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
+	notifClient = client.New(tracer, client.Config{BaseURL: cfg.notifURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
+	go expireHolds(ctx)
+	go extendSeries(ctx)
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/events/create", reqlog(isAuthenticatedMiddleware(create))).Methods("POST")
 	r.HandleFunc("/events/get", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
 	r.HandleFunc("/events/get/{id}", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
+	r.HandleFunc("/events/mine", reqlog(isAuthenticatedMiddleware(getMyEvents))).Methods("GET")
+	r.HandleFunc("/events/ics/{id}", reqlog(isAuthenticatedMiddleware(getEventCalendar))).Methods("GET")
 	r.HandleFunc("/events/occupy", reqlog(isAuthenticatedMiddleware(occupy))).Methods("POST")
 	r.HandleFunc("/events/cancel", reqlog(isAuthenticatedMiddleware(cancelSlot))).Methods("POST")
+	r.HandleFunc("/events/confirm", reqlog(isAuthenticatedMiddleware(confirmSlot))).Methods("POST")
+	r.HandleFunc("/events/waitlist/join", reqlog(isAuthenticatedMiddleware(joinWaitlist))).Methods("POST")
+	r.HandleFunc("/events/waitlist/leave", reqlog(isAuthenticatedMiddleware(leaveWaitlist))).Methods("POST")
+	r.HandleFunc("/events/waitlist/{id}", reqlog(isAuthenticatedMiddleware(getWaitlist))).Methods("GET")
+	r.HandleFunc("/events/refund-policy/{id}", reqlog(isAuthenticatedMiddleware(setRefundPolicy))).Methods("POST")
+	r.HandleFunc("/events/pricing/{id}", reqlog(isAuthenticatedMiddleware(setPricingRules))).Methods("POST")
+	r.HandleFunc("/events/transfers/{id}", reqlog(isAuthenticatedMiddleware(setTransfers))).Methods("POST")
+	r.HandleFunc("/events/search", reqlog(isAuthenticatedMiddleware(search))).Methods("GET")
+	r.HandleFunc("/events/search/suggest", reqlog(isAuthenticatedMiddleware(suggest))).Methods("GET")
+	r.HandleFunc("/events/ticket-types/{id}", reqlog(isAuthenticatedMiddleware(listTicketTypes))).Methods("GET")
+	r.HandleFunc("/events/ticket-types/{id}", reqlog(isAuthenticatedMiddleware(createTicketType))).Methods("POST")
+	r.HandleFunc("/events/ticket-types/{id}/{type}", reqlog(isAuthenticatedMiddleware(updateTicketType))).Methods("POST")
+	r.HandleFunc("/events/ticket-types/{id}/{type}", reqlog(isAuthenticatedMiddleware(deleteTicketType))).Methods("DELETE")
+	r.HandleFunc("/events/seats/{id}", reqlog(isAuthenticatedMiddleware(getSeats))).Methods("GET")
+	r.HandleFunc("/events/seats/{id}", reqlog(isAuthenticatedMiddleware(setSeatLayout))).Methods("POST")
+	r.HandleFunc("/events/series", reqlog(isAuthenticatedMiddleware(createSeries))).Methods("POST")
+	r.HandleFunc("/events/series/{id}", reqlog(isAuthenticatedMiddleware(getSeries))).Methods("GET")
+	r.HandleFunc("/events/series/{id}", reqlog(isAuthenticatedMiddleware(updateSeries))).Methods("POST")
+	r.HandleFunc("/events/series/{id}/cancel", reqlog(isAuthenticatedMiddleware(cancelSeriesDates))).Methods("POST")
+	r.HandleFunc("/events/manage/{id}", reqlog(isAuthenticatedMiddleware(updateEvent))).Methods("POST")
+	r.HandleFunc("/events/manage/{id}", reqlog(isAuthenticatedMiddleware(deleteEvent))).Methods("DELETE")
+	r.HandleFunc("/events/manage/{id}/publish", reqlog(isAuthenticatedMiddleware(publishEvent))).Methods("POST")
+	r.HandleFunc("/events/manage/{id}/cancel", reqlog(isAuthenticatedMiddleware(cancelEvent))).Methods("POST")
+	r.HandleFunc("/events/admin/slots", reqlog(isAuthenticatedMiddleware(getOrderSlots))).Methods("GET")
 
 	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
 	if err := http.ListenAndServe(bindOn, r); err != nil {
@@ -197,6 +374,16 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 		panic(err)
 	}
 
+	lockEventStmt, err = db.PrepareContext(ctx, lockEventTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	orderSlotsStmt, err = db.PrepareContext(ctx, orderSlotsTpl)
+	if err != nil {
+		panic(err)
+	}
+
 	getEventStmt, err = db.PrepareContext(ctx, getEventTpl)
 	if err != nil {
 		panic(err)
@@ -205,14 +392,56 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	confirmSlotsStmt, err = db.PrepareContext(ctx, confirmSlotsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	confirmedSlotsStmt, err = db.PrepareContext(ctx, confirmedSlotsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	expireHoldsStmt, err = db.PrepareContext(ctx, expireHoldsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	mustPrepareWaitlistStmts(ctx, db)
+	mustPrepareAdminStmts(ctx, db)
+	mustPrepareRefundStmts(ctx, db)
+	mustPrepareTransferStmts(ctx, db)
+	mustPrepareLifecycleStmts(ctx, db)
+	mustPrepareSearchStmts(ctx, db)
+	mustPrepareTicketTypeStmts(ctx, db)
+	mustPrepareSeatStmts(ctx, db)
+	mustPrepareSeriesStmts(ctx, db)
+	mustPrepareOrganizerStmts(ctx, db)
+	mustPreparePricingStmts(ctx, db)
 }
 
-func createEvent(name string, price, totalSlots int) (int, error) {
-	row := createEventStmt.QueryRow(name, price, totalSlots)
-	eventID := new(int)
-	err := row.Scan(eventID)
+func createEvent(e *eventModel) (int, error) {
+	return createEventWith(createEventStmt, e)
+}
+
+func createEventWith(q *sql.Stmt, e *eventModel) (int, error) {
+	policy, err := e.RefundPolicy.value()
+	if err != nil {
+		return 0, err
+	}
+	rules, err := e.PricingRules.value()
 	if err != nil {
-		log.Printf("Failed to create event with name [%s]: %s", name, err)
+		return 0, err
+	}
+	status := eventPublished
+	if e.Status == eventStatusNames[eventDraft] {
+		status = eventDraft
+	}
+	row := q.QueryRow(e.Name, e.Price, e.TotalSlots, e.StartsAt, policy, e.TransfersDisabled, status, e.EndsAt, e.RegistrationDeadline, e.Venue, e.Address, e.Description, e.Organizer, pq.Array(normalizeTags(e.Tags)), e.SeriesID, e.OccurrenceAt, e.OwnerID, rules)
+	eventID := new(int)
+	if err = row.Scan(eventID); err != nil {
+		log.Printf("Failed to create event with name [%s]: %s", e.Name, err)
 		return 0, err
 	}
 	return *eventID, nil
@@ -229,9 +458,29 @@ func create(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e.OwnerID = uid
+	if err := e.RefundPolicy.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong refund policy: %s", err)
+		return
+	}
+	if err := e.PricingRules.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong pricing rules: %s", err)
+		return
+	}
+	if err := validateSchedule(&e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong schedule: %s", err)
+		return
+	}
 	var eventID int
-	var err error
-	if eventID, err = createEvent(e.Name, e.Price, e.TotalSlots); err != nil {
+	if eventID, err = createEvent(&e); err != nil {
 		log.Printf("Failed to create event with name [%s] price [%d] slots [%d]: %s\n", e.Name, e.Price, e.TotalSlots, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"created_status": false}`)
@@ -242,49 +491,71 @@ func create(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, createdTpl, eventID, e.Name, e.Price, e.TotalSlots)
 }
 
-func getTotalSlots(id int) int {
-	e, err := getEvent(id)
-	if err != nil {
-		log.Printf("Failed to get event id [%d]: %s\n", id, err)
-		return 0
-	}
-	return e.TotalSlots
-}
-
-func getOccupiedSlots(id int) int {
-	row := occupiedSlotsStmt.QueryRow(id)
+func getOccupiedSlots(q *sql.Stmt, id int) (int, error) {
 	occ := new(int)
-	if err := row.Scan(&occ); err != nil {
+	if err := q.QueryRow(id).Scan(occ); err != nil {
 		log.Printf("Failed to get occupied slots for event id [%d]:%s\n", id, err)
-		return 0
+		return 0, err
 	}
-	return *occ
+	return *occ, nil
 }
 
 func getEvent(id int) (*eventModel, error) {
-	row := getEventStmt.QueryRow(id)
-	e := &eventModel{ID: id}
-	err := row.Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots)
+	return getEventWith(getEventStmt, id)
+}
+
+func getEventWith(q *sql.Stmt, id int) (*eventModel, error) {
+	return scanEvent(q.QueryRow(id, slotHeld, slotConfirmed))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner) (*eventModel, error) {
+	e := &eventModel{}
+	startsAt, endsAt, deadline, occurrenceAt, updatedAt := sql.NullTime{}, sql.NullTime{}, sql.NullTime{}, sql.NullTime{}, sql.NullTime{}
+	policy, rules := []byte{}, []byte{}
+	var status int
+	err := row.Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots, &e.HeldSlots, &e.ConfirmedSlots, &startsAt, &endsAt, &deadline, &e.Venue, &e.Address, &e.Description, &e.Organizer, pq.Array(&e.Tags), &policy, &rules, &e.TransfersDisabled, &status, &e.SeriesID, &occurrenceAt, &updatedAt, &e.OwnerID)
 	if err != nil {
 		return nil, err
 	}
+	e.Status = eventStatusNames[status]
+	e.AvailableSlots = e.TotalSlots - e.HeldSlots - e.ConfirmedSlots
+	e.StartsAt = nullTime(startsAt)
+	e.EndsAt = nullTime(endsAt)
+	e.RegistrationDeadline = nullTime(deadline)
+	e.OccurrenceAt = nullTime(occurrenceAt)
+	e.UpdatedAt = nullTime(updatedAt)
+	e.RegistrationOpen = status == eventPublished && !isClosed(e.closesAt(), time.Now())
+	if len(policy) > 0 {
+		if err = json.Unmarshal(policy, &e.RefundPolicy); err != nil {
+			return nil, err
+		}
+	}
+	if len(rules) > 0 {
+		if err = json.Unmarshal(rules, &e.PricingRules); err != nil {
+			return nil, err
+		}
+	}
+	e.CurrentPrice = e.currentPrice(e.Price, "", time.Now())
 	return e, nil
 }
 
-func getEvents() ([]eventModel, error) {
-	rows, err := getEventsStmt.Query()
+func getEvents(f *eventFilterModel) ([]eventModel, error) {
+	rows, err := getEventsStmt.Query(slotHeld, slotConfirmed, f.From, f.To, f.EndedBefore)
 	if err != nil {
 		return nil, err
 	}
 	es := []eventModel{}
-	e := eventModel{}
 	for rows.Next() {
-		err := rows.Scan(&e.ID, &e.Name, &e.Price, &e.TotalSlots)
+		e, err := scanEvent(rows)
 		if err != nil {
 			log.Printf("Failed to get values: %s", err)
 			break
 		}
-		es = append(es, e)
+		es = append(es, *e)
 	}
 	return es, nil
 }
@@ -303,9 +574,17 @@ func get(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		e, err := getEvent(id)
+		if err == nil && e.Status == eventStatusNames[eventDraft] && !canManage(r, e.OwnerID) {
+			err = sql.ErrNoRows
+		}
 		if err != nil {
 			log.Printf("Could not find any event with id [%d]\n", id)
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err = withTicketTypes(e); err != nil {
+			log.Printf("Failed to get ticket types of event [%d]: %s\n", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		data, _ := json.Marshal(e)
@@ -313,18 +592,187 @@ func get(w http.ResponseWriter, r *http.Request) {
 		w.Write(data)
 		return
 	}
-	es, err := getEvents()
+	f, err := parseEventFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong filter: %s", err)
+		return
+	}
+	collapse := false
+	switch r.URL.Query().Get("series") {
+	case "", "expand":
+	case "collapse":
+		collapse = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Wrong filter: series must be expand or collapse")
+		return
+	}
+	es, err := getEvents(f)
 	if err != nil {
 		log.Printf("Failed to get event's list: %s", err)
 	}
+	es = publicEvents(r, es)
+	if collapse {
+		es = collapseSeries(es)
+	}
 	data, _ := json.Marshal(es)
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
-func occupySlot(eid, oid int) error {
-	_, err := occupySlotStmt.Exec(eid, oid)
-	return err
+var errNoSlots = errors.New("there are no available slots")
+
+// occupySlots holds the slots of all items in one transaction until heldUntil,
+// so either every item of the order gets its slots or none does. It returns
+// the total price and the hold, and fills in the price of each item.
+//
+// The price of a slot is set by the event's pricing rules when the slots are
+// taken and stored with them, a repeated occupy charges the stored price
+// even if another rule holds by then.
+//
+// The event rows are locked in the order of their ids, so concurrent orders
+// count the free slots one after another and can't deadlock. Slots already
+// taken by the order are counted as its own: a repeated occupy adds only the
+// missing ones and keeps their hold, the unique (order_id, event_id, seq)
+// index catches a repeat racing with the first one.
+func occupySlots(oid, uid int, role string, items []occupyItemModel, heldUntil time.Time) (int, time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, heldUntil, err
+	}
+	defer tx.Rollback()
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		if items[order[a]].EventID != items[order[b]].EventID {
+			return items[order[a]].EventID < items[order[b]].EventID
+		}
+		return items[order[a]].TicketTypeID < items[order[b]].TicketTypeID
+	})
+	now := time.Now()
+
+	total := 0
+	held := heldUntil
+	for _, i := range order {
+		it := &items[i]
+		if it.Quantity <= 0 {
+			return 0, heldUntil, fmt.Errorf("wrong quantity [%d] for event [%d]", it.Quantity, it.EventID)
+		}
+		var price, totalSlots, status int
+		closesAt, startsAt := sql.NullTime{}, sql.NullTime{}
+		rulesData := []byte{}
+		if err = tx.Stmt(lockEventStmt).QueryRow(it.EventID).Scan(&price, &totalSlots, &status, &closesAt, &startsAt, &rulesData); err != nil {
+			return 0, heldUntil, err
+		}
+		rules := pricingRulesModel{}
+		if len(rulesData) > 0 {
+			if err = json.Unmarshal(rulesData, &rules); err != nil {
+				return 0, heldUntil, err
+			}
+		}
+		occupied, err := getOccupiedSlots(tx.Stmt(occupiedSlotsStmt), it.EventID)
+		if err != nil {
+			return 0, heldUntil, err
+		}
+		seated, err := isSeated(tx, it.EventID)
+		if err != nil {
+			return 0, heldUntil, err
+		}
+		if len(it.SeatIDs) > 0 && (!seated || len(it.SeatIDs) != it.Quantity) {
+			return 0, heldUntil, fmt.Errorf("%w: [%d] seats picked for [%d] tickets of event [%d]", errSeatUnavailable, len(it.SeatIDs), it.Quantity, it.EventID)
+		}
+		if seated {
+			if err = seatsTicketType(tx, it); err != nil {
+				return 0, heldUntil, err
+			}
+		}
+		tt, err := pickTicketType(tx, oid, it, role, now)
+		if err != nil {
+			log.Printf("Failed to pick ticket type for event [%d]: %s\n", it.EventID, err)
+			return 0, heldUntil, err
+		}
+		var own int
+		ownHold := sql.NullTime{}
+		ownPrice, ownRule := sql.NullInt64{}, sql.NullString{}
+		if err = tx.Stmt(orderSlotsStmt).QueryRow(it.EventID, oid, it.TicketTypeID).Scan(&own, &ownHold, &ownPrice, &ownRule); err != nil {
+			return 0, heldUntil, err
+		}
+		if ownHold.Valid && ownHold.Time.Before(held) {
+			held = ownHold.Time
+		}
+		// a repeated occupy of slots taken before the event closed still
+		// succeeds
+		if it.Quantity > own && status != eventPublished {
+			log.Printf("Event [%d] with status [%s] is not open for orders\n", it.EventID, eventStatusNames[status])
+			return 0, heldUntil, errEventClosed
+		}
+		if it.Quantity > own && isClosed(nullTime(closesAt), now) {
+			log.Printf("Registration for event [%d] closed at [%s]\n", it.EventID, closesAt.Time)
+			return 0, heldUntil, errEventClosed
+		}
+		ticketType := ""
+		if tt != nil {
+			price, ticketType = tt.Price, tt.Name
+			if it.Quantity > own {
+				if err = tt.check(role, it.Quantity-own, it.Quantity, now); err != nil {
+					log.Printf("Ticket type [%d] of event [%d] can't be taken: %s\n", tt.ID, it.EventID, err)
+					return 0, heldUntil, err
+				}
+			}
+		}
+		if totalSlots-occupied < it.Quantity-own {
+			log.Printf("Event [%d] has [%d] free slots, but [%d] requested\n", it.EventID, totalSlots-occupied, it.Quantity-own)
+			return 0, heldUntil, errNoSlots
+		}
+		var rule *pricingRuleModel
+		if ownPrice.Valid {
+			price = int(ownPrice.Int64)
+			if ownRule.Valid {
+				rule = &pricingRuleModel{}
+				if err = json.Unmarshal([]byte(ownRule.String), rule); err != nil {
+					return 0, heldUntil, err
+				}
+			}
+		} else {
+			price, rule = rules.price(price, ticketType, nullTime(startsAt), totalSlots, occupied, now)
+		}
+		var ruleData interface{}
+		if rule != nil {
+			data, err := json.Marshal(rule)
+			if err != nil {
+				return 0, heldUntil, err
+			}
+			ruleData = string(data)
+		}
+		var seats []seatModel
+		if seated && it.Quantity > own {
+			if seats, err = pickSeats(tx, oid, it.Quantity-own, it); err != nil {
+				log.Printf("Failed to pick seats of event [%d]: %s\n", it.EventID, err)
+				return 0, heldUntil, err
+			}
+		}
+		for seq := own; seq < it.Quantity; seq++ {
+			var seatID *int
+			if seated {
+				seatID = &seats[seq-own].ID
+			}
+			if _, err = tx.Stmt(occupySlotStmt).Exec(it.EventID, oid, uid, slotHeld, heldUntil, seq, it.TicketTypeID, seatID, price, ruleData); err != nil {
+				return 0, heldUntil, err
+			}
+		}
+		if seated {
+			if it.Seats, err = querySeats(tx.Stmt(orderSeatsStmt), oid, it.EventID, it.TicketTypeID); err != nil {
+				return 0, heldUntil, err
+			}
+		}
+		it.Price, it.PricingRule = price, rule
+		total += price * it.Quantity
+	}
+	return total, held, tx.Commit()
 }
 
 func occupy(w http.ResponseWriter, r *http.Request) {
@@ -349,33 +797,41 @@ func occupy(w http.ResponseWriter, r *http.Request) {
 		UserID:  uid,
 		Status:  false,
 	}
-	e := &eventModel{}
-	if e, err = getEvent(o.EventID); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to get event [%d]: %s\n", o.EventID, err)
-		sendCallback(spanCtx, ro)
-		return
-	}
-	ro.Price = e.Price
-	total := getTotalSlots(o.EventID)
-	occupied := getOccupiedSlots(o.EventID)
-	if total > occupied {
-		if err = occupySlot(o.EventID, o.OrderID); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			sendCallback(spanCtx, ro)
-			log.Printf("Failed to occupy slot on events [%d] for order [%d]: %s\n", o.EventID, o.OrderID, err)
-			return
+	// the result is reported even when orders stops waiting, the slots may
+	// be held already
+	ctx := context.WithoutCancel(r.Context())
+	items := o.Items
+	if len(items) == 0 {
+		items = []occupyItemModel{{EventID: o.EventID, Quantity: 1}}
+	}
+	// orders cancels the order on a failure, a waitlist order gives way to
+	// the next waiting user
+	failed := func() {
+		sendCallback(ctx, spanCtx, ro)
+		if eid := lapseWaitlistOrder(ctx, spanCtx, o.OrderID, uid, items[0].EventID); eid != 0 {
+			go promoteWaitlists(ctx, spanCtx, map[int]int{eid: 1})
 		}
-	} else {
+	}
+	price, heldUntil, err := occupySlots(o.OrderID, uid, o.Role, items, time.Now().Add(holdTTL))
+	if errors.Is(err, errNoSlots) || errors.Is(err, errEventClosed) || errors.Is(err, errTicketTypeUnavailable) || errors.Is(err, errSeatUnavailable) {
 		w.WriteHeader(http.StatusOK)
-		log.Println("Slot was not occupied due to there is no available slots any more")
-		sendCallback(spanCtx, ro)
+		log.Printf("Slot was not occupied: %s\n", err)
+		failed()
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		failed()
+		log.Printf("Failed to occupy slots for order [%d]: %s\n", o.OrderID, err)
 		return
 	}
 	log.Println("Slot was occupied successfully, send callback to orders service")
 	w.WriteHeader(http.StatusOK)
+	ro.Price = price
+	ro.Items = items
+	ro.HeldUntil = &heldUntil
 	ro.Status = true
-	sendCallback(spanCtx, ro)
+	sendCallback(ctx, spanCtx, ro)
 }
 
 func cancelSlot(w http.ResponseWriter, r *http.Request) {
@@ -389,36 +845,137 @@ func cancelSlot(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
-	if _, err := cancelSlotStmt.Exec(o.OrderID); err != nil {
+	rows, err := cancelSlotStmt.Query(o.OrderID)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("Failed to cancel slot occupying:", err)
+		return
+	}
+	freed := map[int]int{}
+	held := false
+	for rows.Next() {
+		var eid, status int
+		if err = rows.Scan(&eid, &status); err != nil {
+			log.Printf("Failed to scan canceled slot: %s\n", err)
+			continue
+		}
+		freed[eid]++
+		held = held || status == slotHeld
+	}
+	rows.Close()
+	// promoted after the response, past the request's end
+	ctx := context.WithoutCancel(r.Context())
+	if held {
+		uid, _ := getUserID(r)
+		lapseWaitlistOrder(ctx, span.Context(), o.OrderID, uid, o.EventID)
 	}
+	go promoteWaitlists(ctx, span.Context(), freed)
 }
 
-func sendCallback(spanCtx opentracing.SpanContext, r *occupiedResponseModel) {
-	span := tracer.StartSpan("sending callback with occupied slot result", ext.RPCServerOption(spanCtx))
+// confirmSlot turns the held slots of a paid order into confirmed ones.
+// Confirming an already confirmed order is not an error.
+func confirmSlot(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for confirming slot", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
-	data, err := json.Marshal(r)
-	if err != nil {
-		log.Printf("Failed to parse data: %s\n", err)
+	o := occupyRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
-	reqBody := bytes.NewReader(data)
-	req, err := http.NewRequest("POST", orderCallbackEndpoint, reqBody)
-	if err != nil {
-		log.Printf("Failed callback request: %s\n", err)
+	if _, err := confirmSlotsStmt.Exec(o.OrderID, slotHeld, slotConfirmed); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Failed to confirm slot occupying:", err)
 		return
 	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(r.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	n := 0
+	if err := confirmedSlotsStmt.QueryRow(o.OrderID, slotConfirmed).Scan(&n); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Failed to check confirmed slots:", err)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("There are no held slots for order [%d], the hold may have expired\n", o.OrderID)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// expireHolds periodically releases held slots whose time ran out and asks
+// orders to cancel the affected orders.
+func expireHolds(ctx context.Context) {
+	ticker := time.NewTicker(holdExpirerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		rows, err := expireHoldsStmt.Query(slotHeld)
+		if err != nil {
+			log.Printf("Failed to release expired holds: %s\n", err)
+			continue
+		}
+		expired := map[int]int{}
+		eventOf := map[int]int{}
+		freed := map[int]int{}
+		for rows.Next() {
+			var oid, uid, eid int
+			if err = rows.Scan(&oid, &uid, &eid); err != nil {
+				log.Printf("Failed to scan expired hold: %s\n", err)
+				continue
+			}
+			expired[oid] = uid
+			eventOf[oid] = eid
+			freed[eid]++
+		}
+		rows.Close()
+		for oid, uid := range expired {
+			log.Printf("Hold for order [%d] has expired, slots were released\n", oid)
+			sendExpired(ctx, &expiredHoldModel{OrderID: oid, UserID: uid})
+			lapseWaitlistOrder(ctx, nil, oid, uid, eventOf[oid])
+		}
+		promoteWaitlists(ctx, nil, freed)
+	}
+}
+
+// sendExpired is retried, orders ignores notices for orders it already
+// cancelled or got paid.
+func sendExpired(ctx context.Context, m *expiredHoldModel) {
+	span := tracer.StartSpan("sending expired hold notice")
+	defer span.Finish()
+
+	_, err := ordersClient.Do(ctx, span.Context(), &client.Request{
+		Method:     http.MethodPost,
+		Path:       orderExpiredPath,
+		UserID:     m.UserID,
+		Body:       m,
+		Idempotent: true,
+	}, nil)
+	if err != nil {
+		log.Printf("Failed to call orders expired endpoint: %s\n", err)
+	}
+}
+
+// sendCallback is sent once: orders treats a repeated successful occupy as
+// a late one and would release the slots.
+func sendCallback(ctx context.Context, spanCtx opentracing.SpanContext, r *occupiedResponseModel) {
+	span := tracer.StartSpan("sending callback with occupied slot result", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	_, err := ordersClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   orderCallbackPath,
+		UserID: r.UserID,
+		Body:   r,
+	}, nil)
 	if err != nil {
 		log.Printf("Failed to call back orders endpoint: %s\n", err)
-		return
 	}
-	defer resp.Body.Close()
 }
 
 func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
@@ -443,3 +1000,7 @@ func reqlog(h http.HandlerFunc) http.HandlerFunc {
 func getUserID(r *http.Request) (int, error) {
 	return strconv.Atoi(r.Header.Get("X-User-Id"))
 }
+
+func isAdmin(r *http.Request) bool {
+	return r.Header.Get("X-User-Role") == roleAdmin
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"lib/client"
+	"lib/servicetest"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// setupTestDB prepares the service against the test database. The other
+// services are replaced with a stub that accepts every call.
+func setupTestDB(t *testing.T) {
+	servicetest.Setup(t, setupService)
+}
+
+func setupService(dsn string) error {
+	conn, err := servicetest.OpenDB(dsn, "../chart/templates/initdb.yaml")
+	if err != nil {
+		return err
+	}
+	db = conn
+	tracer = opentracing.NoopTracer{}
+	mustPrepareStmts(context.Background(), db)
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	}))
+	cfg := client.Config{BaseURL: stub.URL, Timeout: time.Second}
+	ordersClient = client.New(tracer, cfg)
+	notifClient = client.New(tracer, cfg)
+	return nil
+}
+
+// createTestEvent creates a published event with the slots and no owner.
+func createTestEvent(t *testing.T, slots int) int {
+	t.Helper()
+	var id int
+	err := db.QueryRow(`INSERT INTO events (event_name, price, total_slots) VALUES ($1, 1, $2) RETURNING id`, fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano()), slots).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// TestOccupySlotsConcurrent lets more orders than there are slots occupy the
+// event at once, every order several times. The event must end up full but
+// not oversold, and no order may hold more than the one slot it asked for.
+func TestOccupySlotsConcurrent(t *testing.T) {
+	setupTestDB(t)
+
+	const slots, orders, repeats, concurrency = 10, 50, 3, 20
+	eid := createTestEvent(t, slots)
+	// order ids of other tests' events don't collide with these
+	base := eid * 1000
+
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	errs := make(chan error, orders*repeats)
+	for i := 0; i < orders; i++ {
+		for r := 0; r < repeats; r++ {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(oid, uid int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				items := []occupyItemModel{{EventID: eid, Quantity: 1}}
+				_, _, err := occupySlots(oid, uid, "", items, time.Now().Add(holdTTL))
+				if err != nil && !errors.Is(err, errNoSlots) {
+					errs <- fmt.Errorf("occupy of order [%d]: %w", oid, err)
+				}
+			}(base+i, i+1)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	e, err := getEvent(eid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken := e.HeldSlots + e.ConfirmedSlots; taken != slots {
+		t.Errorf("%d of %d slots taken", taken, slots)
+	}
+	rows, err := db.Query(`SELECT order_id, COUNT(1) FROM slots WHERE event_id=$1 GROUP BY order_id HAVING COUNT(1) > 1`, eid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid, n int
+		if err = rows.Scan(&oid, &n); err != nil {
+			t.Fatal(err)
+		}
+		t.Errorf("order [%d] took %d slots instead of one", oid, n)
+	}
+}
+
+// TestOccupySlotsRepeated occupies the slots of an order again after it got
+// them: the repeat succeeds without taking more slots.
+func TestOccupySlotsRepeated(t *testing.T) {
+	setupTestDB(t)
+
+	eid := createTestEvent(t, 5)
+	oid := eid * 1000
+	items := []occupyItemModel{{EventID: eid, Quantity: 2}}
+	for i := 0; i < 3; i++ {
+		if _, _, err := occupySlots(oid, 1, "", items, time.Now().Add(holdTTL)); err != nil {
+			t.Fatalf("occupy %d: %s", i+1, err)
+		}
+	}
+	e, err := getEvent(eid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.HeldSlots != 2 {
+		t.Errorf("%d slots held, want 2", e.HeldSlots)
+	}
+}
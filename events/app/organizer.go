@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"lib/client"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	eventOwnerTpl  = `SELECT COALESCE(owner_id, 0) FROM events WHERE id=$1`
+	ownerEventsTpl = `SELECT e.id, e.event_name, e.price, e.total_slots, COUNT(s.id) FILTER (WHERE s.status=$1), COUNT(s.id) FILTER (WHERE s.status=$2), e.starts_at, e.ends_at, e.registration_deadline, e.venue, e.address, e.description, e.organizer, e.tags, e.refund_policy, e.pricing_rules, e.transfers_disabled, e.status, COALESCE(e.series_id, 0), e.occurrence_at, e.updated_at, COALESCE(e.owner_id, 0) FROM events e LEFT JOIN slots s ON s.event_id=e.id WHERE e.owner_id=$3 GROUP BY e.id ORDER BY e.starts_at NULLS LAST, e.id`
+	eventSalesPath = "/orders/admin/event-sales"
+)
+
+var (
+	eventOwnerStmt  *sql.Stmt
+	ownerEventsStmt *sql.Stmt
+)
+
+// eventSalesModel is what orders knows about the orders of an event.
+type eventSalesModel struct {
+	EventID   int `json:"event_id"`
+	Orders    int `json:"orders"`
+	Cancelled int `json:"cancelled"`
+	Revenue   int `json:"revenue"`
+}
+
+type dashboardEventModel struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"event_name"`
+	Status          string     `json:"status"`
+	StartsAt        *time.Time `json:"starts_at,omitempty"`
+	SeriesID        int        `json:"series_id,omitempty"`
+	TotalSlots      int        `json:"total_slots"`
+	Sold            int        `json:"sold"`
+	Held            int        `json:"held"`
+	Remaining       int        `json:"remaining"`
+	Revenue         int        `json:"revenue"`
+	PaidOrders      int        `json:"paid_orders"`
+	CancelledOrders int        `json:"cancelled_orders"`
+}
+
+type dashboardTotalsModel struct {
+	Sold            int `json:"sold"`
+	Held            int `json:"held"`
+	Revenue         int `json:"revenue"`
+	PaidOrders      int `json:"paid_orders"`
+	CancelledOrders int `json:"cancelled_orders"`
+}
+
+type dashboardModel struct {
+	Events []dashboardEventModel `json:"events"`
+	Totals dashboardTotalsModel  `json:"totals"`
+}
+
+func mustPrepareOrganizerStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	eventOwnerStmt, err = db.PrepareContext(ctx, eventOwnerTpl)
+	if err != nil {
+		panic(err)
+	}
+	ownerEventsStmt, err = db.PrepareContext(ctx, ownerEventsTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// canManage tells if the user may change what the owner owns, admins may
+// change anything. Events created before owners were recorded have none.
+func canManage(r *http.Request, ownerID int) bool {
+	if isAdmin(r) {
+		return true
+	}
+	uid, err := getUserID(r)
+	return err == nil && ownerID != 0 && uid == ownerID
+}
+
+func eventOwner(id int) (int, error) {
+	var owner int
+	err := eventOwnerStmt.QueryRow(id).Scan(&owner)
+	return owner, err
+}
+
+func seriesOwner(id int) (int, error) {
+	s, err := loadSeries(getSeriesStmt, id)
+	if err != nil {
+		return 0, err
+	}
+	return s.Event.OwnerID, nil
+}
+
+// checkOwner answers 404 for a missing event or series and for one the user
+// may not manage, so a draft of someone else does not leak either.
+func checkOwner(w http.ResponseWriter, r *http.Request, id int, owner func(int) (int, error)) bool {
+	ownerID, err := owner(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to get owner of [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !canManage(r, ownerID) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// eventID parses the id of the event the request changes, only its owner
+// and admins may.
+func eventID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, checkOwner(w, r, id, eventOwner)
+}
+
+// seriesID is eventID for a series, the owner of its template owns it.
+func seriesID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, checkOwner(w, r, id, seriesOwner)
+}
+
+func getOwnerEvents(uid int) ([]eventModel, error) {
+	rows, err := ownerEventsStmt.Query(slotHeld, slotConfirmed, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	es := []eventModel{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, *e)
+	}
+	return es, rows.Err()
+}
+
+// getEventSales asks orders for the paid and cancelled orders and the
+// revenue of the events.
+func getEventSales(ctx context.Context, spanCtx opentracing.SpanContext, ids []int) (map[int]eventSalesModel, error) {
+	res := map[int]eventSalesModel{}
+	if len(ids) == 0 {
+		return res, nil
+	}
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.Itoa(id)
+	}
+	sales := []eventSalesModel{}
+	_, err := ordersClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       eventSalesPath + "?ids=" + strings.Join(strs, ","),
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, &sales)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sales {
+		res[s.EventID] = s
+	}
+	return res, nil
+}
+
+func buildDashboard(es []eventModel, sales map[int]eventSalesModel) *dashboardModel {
+	d := &dashboardModel{Events: []dashboardEventModel{}}
+	for _, e := range es {
+		s := sales[e.ID]
+		d.Events = append(d.Events, dashboardEventModel{
+			ID:              e.ID,
+			Name:            e.Name,
+			Status:          e.Status,
+			StartsAt:        e.StartsAt,
+			SeriesID:        e.SeriesID,
+			TotalSlots:      e.TotalSlots,
+			Sold:            e.ConfirmedSlots,
+			Held:            e.HeldSlots,
+			Remaining:       e.AvailableSlots,
+			Revenue:         s.Revenue,
+			PaidOrders:      s.Orders,
+			CancelledOrders: s.Cancelled,
+		})
+		d.Totals.Sold += e.ConfirmedSlots
+		d.Totals.Held += e.HeldSlots
+		d.Totals.Revenue += s.Revenue
+		d.Totals.PaidOrders += s.Orders
+		d.Totals.CancelledOrders += s.Cancelled
+	}
+	return d
+}
+
+// getMyEvents handles GET /events/mine, the sales dashboard of the events
+// the user created. Slots come from events, orders and revenue from orders.
+// Admins may look at another organizer's events with owner_id.
+func getMyEvents(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for organizer's events", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("owner_id"); v != "" && isAdmin(r) {
+		if uid, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "owner_id must be a number")
+			return
+		}
+	}
+	es, err := getOwnerEvents(uid)
+	if err != nil {
+		log.Printf("Failed to get events of owner [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int, len(es))
+	for i, e := range es {
+		ids[i] = e.ID
+	}
+	sales, err := getEventSales(r.Context(), span.Context(), ids)
+	if err != nil {
+		log.Printf("Failed to get sales of events of owner [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	data, _ := json.Marshal(buildDashboard(es, sales))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	setPricingRulesTpl = `UPDATE events SET pricing_rules=$2 WHERE id=$1`
+	maxPricingPercent  = 1000
+)
+
+var (
+	setPricingRulesStmt *sql.Stmt
+)
+
+// pricingRuleModel changes the price by Percent while all of its conditions
+// hold: before a moment for early-bird prices, in the last hours before the
+// start for last-minute ones, once a share of the slots is taken for prices
+// rising as the event fills.
+type pricingRuleModel struct {
+	Name string `json:"name"`
+	// TicketType limits the rule to the ticket type with the name, the name
+	// stays the same in every occurrence of a series
+	TicketType       string     `json:"ticket_type,omitempty"`
+	Before           *time.Time `json:"before,omitempty"`
+	HoursBeforeStart int        `json:"hours_before_start,omitempty"`
+	FilledPercent    int        `json:"filled_percent,omitempty"`
+	// Percent is added to the price, a negative one is a discount
+	Percent int `json:"percent"`
+}
+
+// pricingRulesModel is checked in order, the first rule that holds sets the
+// price. The event's or the ticket type's own price is charged when none
+// does.
+type pricingRulesModel []pricingRuleModel
+
+func (p pricingRulesModel) validate() error {
+	seen := map[string]bool{}
+	for _, rule := range p {
+		if rule.Name == "" {
+			return errors.New("every rule needs a name")
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("more than one rule named [%s]", rule.Name)
+		}
+		seen[rule.Name] = true
+		if rule.Before == nil && rule.HoursBeforeStart == 0 && rule.FilledPercent == 0 {
+			return fmt.Errorf("rule [%s] has no condition, change the price instead", rule.Name)
+		}
+		if rule.HoursBeforeStart < 0 {
+			return fmt.Errorf("hours_before_start of rule [%s] can't be negative", rule.Name)
+		}
+		if rule.FilledPercent < 0 || rule.FilledPercent > 100 {
+			return fmt.Errorf("filled_percent of rule [%s] must be between 0 and 100", rule.Name)
+		}
+		if rule.Percent < -100 || rule.Percent > maxPricingPercent {
+			return fmt.Errorf("percent of rule [%s] must be between -100 and %d", rule.Name, maxPricingPercent)
+		}
+	}
+	return nil
+}
+
+// value returns the rules as they are stored, nil for no rules.
+func (p pricingRulesModel) value() (interface{}, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// holds tells if the rule applies to the ticket type of an event starting at
+// startsAt with taken of totalSlots slots taken.
+func (rule *pricingRuleModel) holds(ticketType string, startsAt *time.Time, totalSlots, taken int, now time.Time) bool {
+	switch {
+	case rule.TicketType != "" && rule.TicketType != ticketType:
+		return false
+	case rule.Before != nil && !now.Before(*rule.Before):
+		return false
+	case rule.HoursBeforeStart > 0 && (startsAt == nil || now.Before(startsAt.Add(-time.Duration(rule.HoursBeforeStart)*time.Hour))):
+		return false
+	case rule.FilledPercent > 0 && (totalSlots <= 0 || taken*100 < rule.FilledPercent*totalSlots):
+		return false
+	}
+	return true
+}
+
+// price returns the price of a slot of the ticket type with base price and
+// the rule that set it, nil when no rule holds. Slots without a ticket type
+// have an empty one.
+func (p pricingRulesModel) price(base int, ticketType string, startsAt *time.Time, totalSlots, taken int, now time.Time) (int, *pricingRuleModel) {
+	for i := range p {
+		if rule := &p[i]; rule.holds(ticketType, startsAt, totalSlots, taken, now) {
+			return base * (100 + rule.Percent) / 100, rule
+		}
+	}
+	return base, nil
+}
+
+// currentPrice is the price of the ticket type right now, the same occupy
+// would charge.
+func (e *eventModel) currentPrice(base int, ticketType string, now time.Time) int {
+	price, _ := e.PricingRules.price(base, ticketType, e.StartsAt, e.TotalSlots, e.HeldSlots+e.ConfirmedSlots, now)
+	return price
+}
+
+func mustPreparePricingStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	setPricingRulesStmt, err = db.PrepareContext(ctx, setPricingRulesTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// setPricingRules handles POST /events/pricing/{id}, it replaces the pricing
+// rules of the event. An empty list removes them. Orders already holding
+// slots keep the price they got.
+func setPricingRules(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for setting pricing rules", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	p := pricingRulesModel{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse pricing rules for event [%d]: %s\n", id, err)
+		return
+	}
+	if err := p.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong pricing rules: %s", err)
+		return
+	}
+	rules, err := p.value()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res, err := setPricingRulesStmt.Exec(id, rules)
+	if err != nil {
+		log.Printf("Failed to set pricing rules for event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
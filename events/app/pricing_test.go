@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPricingRulesValidate(t *testing.T) {
+	before := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		rules   pricingRulesModel
+		wantErr bool
+	}{
+		{name: "none", rules: pricingRulesModel{}},
+		{name: "valid", rules: pricingRulesModel{
+			{Name: "early", Before: &before, Percent: -100},
+			{Name: "last minute", HoursBeforeStart: 2, Percent: -50},
+			{Name: "filling", FilledPercent: 100, Percent: maxPricingPercent},
+		}},
+		{name: "no name", rules: pricingRulesModel{{FilledPercent: 50, Percent: 10}}, wantErr: true},
+		{name: "same name", rules: pricingRulesModel{{Name: "a", FilledPercent: 50}, {Name: "a", HoursBeforeStart: 1}}, wantErr: true},
+		{name: "no condition", rules: pricingRulesModel{{Name: "a", Percent: 10}}, wantErr: true},
+		{name: "negative hours", rules: pricingRulesModel{{Name: "a", HoursBeforeStart: -1}}, wantErr: true},
+		{name: "negative filled", rules: pricingRulesModel{{Name: "a", FilledPercent: -1}}, wantErr: true},
+		{name: "overfilled", rules: pricingRulesModel{{Name: "a", FilledPercent: 101}}, wantErr: true},
+		{name: "below free", rules: pricingRulesModel{{Name: "a", FilledPercent: 50, Percent: -101}}, wantErr: true},
+		{name: "too high", rules: pricingRulesModel{{Name: "a", FilledPercent: 50, Percent: maxPricingPercent + 1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.rules.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, wantErr %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPricingRulesPrice(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+	startsSoon, startsLater := now.Add(90*time.Minute), now.Add(3*time.Hour)
+	rules := pricingRulesModel{
+		{Name: "vip filling", TicketType: "vip", FilledPercent: 50, Percent: 100},
+		{Name: "early", Before: &later, Percent: -20},
+		{Name: "last minute", HoursBeforeStart: 2, Percent: -50},
+		{Name: "filling", FilledPercent: 80, Percent: 25},
+	}
+	expired := pricingRulesModel{{Name: "early", Before: &earlier, Percent: -20}}
+	exact := pricingRulesModel{{Name: "early", Before: &now, Percent: -20}}
+	tests := []struct {
+		name       string
+		rules      pricingRulesModel
+		ticketType string
+		startsAt   *time.Time
+		total      int
+		taken      int
+		want       int
+		wantRule   string
+	}{
+		{name: "no rules", rules: pricingRulesModel{}, total: 10, want: 100},
+		{name: "first rule that holds", rules: rules, startsAt: &startsSoon, total: 10, taken: 9, want: 80, wantRule: "early"},
+		{name: "rule of the ticket type", rules: rules, ticketType: "vip", total: 10, taken: 5, want: 200, wantRule: "vip filling"},
+		{name: "rule of another ticket type", rules: rules, ticketType: "standard", total: 10, taken: 5, want: 80, wantRule: "early"},
+		{name: "expired", rules: expired, total: 10, want: 100},
+		{name: "before is exclusive", rules: exact, total: 10, want: 100},
+		{name: "starts soon", rules: rules[2:], startsAt: &startsSoon, total: 10, want: 50, wantRule: "last minute"},
+		{name: "starts later", rules: rules[2:], startsAt: &startsLater, total: 10, want: 100},
+		{name: "no start", rules: rules[2:], total: 10, want: 100},
+		{name: "filled", rules: rules[3:], total: 10, taken: 8, want: 125, wantRule: "filling"},
+		{name: "not filled", rules: rules[3:], total: 10, taken: 7, want: 100},
+		{name: "no slots", rules: rules[3:], want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rule := tt.rules.price(100, tt.ticketType, tt.startsAt, tt.total, tt.taken, now)
+			name := ""
+			if rule != nil {
+				name = rule.Name
+			}
+			if got != tt.want || name != tt.wantRule {
+				t.Errorf("price() = %d, %q, want %d, %q", got, name, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
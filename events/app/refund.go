@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	setRefundPolicyTpl = `UPDATE events SET refund_policy=$2 WHERE id=$1`
+)
+
+var (
+	setRefundPolicyStmt *sql.Stmt
+)
+
+// refundRuleModel refunds percent of the price when the order is cancelled
+// at least hours_before hours before the event starts.
+type refundRuleModel struct {
+	HoursBefore int `json:"hours_before"`
+	Percent     int `json:"percent"`
+}
+
+// refundPolicyModel is a list of rules. Orders picks the rule with the
+// largest hours_before that still holds, no rule at all means no refund.
+// An event without a policy is refunded in full.
+type refundPolicyModel []refundRuleModel
+
+func (p refundPolicyModel) validate() error {
+	seen := map[int]bool{}
+	for _, rule := range p {
+		if rule.HoursBefore < 0 {
+			return errors.New("hours_before can't be negative")
+		}
+		if rule.Percent < 0 || rule.Percent > 100 {
+			return errors.New("percent must be between 0 and 100")
+		}
+		if seen[rule.HoursBefore] {
+			return fmt.Errorf("more than one rule for %d hours before", rule.HoursBefore)
+		}
+		seen[rule.HoursBefore] = true
+	}
+	return nil
+}
+
+// value returns the policy as it is stored, nil for an empty one.
+func (p refundPolicyModel) value() (interface{}, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func mustPrepareRefundStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	setRefundPolicyStmt, err = db.PrepareContext(ctx, setRefundPolicyTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// setRefundPolicy replaces the refund policy of the event. An empty list
+// removes it.
+func setRefundPolicy(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for setting refund policy", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	p := refundPolicyModel{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse refund policy for event [%d]: %s\n", id, err)
+		return
+	}
+	if err := p.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong refund policy: %s", err)
+		return
+	}
+	policy, err := p.value()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res, err := setRefundPolicyStmt.Exec(id, policy)
+	if err != nil {
+		log.Printf("Failed to set refund policy for event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRulePeriods stops the expansion of rules which never match, e.g. the
+// 31st of every second february.
+const maxRulePeriods = 100000
+
+var ruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// ruleWeekdayModel is a BYDAY entry, N picks the n-th weekday of the month,
+// counting from the end when negative, and every one of them when zero.
+type ruleWeekdayModel struct {
+	N   int
+	Day time.Weekday
+}
+
+// recurrenceRuleModel is the subset of RFC 5545 RRULE the series support:
+// DAILY, WEEKLY, MONTHLY and YEARLY with INTERVAL, COUNT, UNTIL, BYDAY
+// (ordinals only monthly) and BYMONTHDAY (only monthly).
+type recurrenceRuleModel struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []ruleWeekdayModel
+	ByMonthDay []int
+}
+
+// parseRRule parses the rule, a date UNTIL or one without a zone is taken in
+// loc and a date includes the whole day.
+func parseRRule(s string, loc *time.Location) (*recurrenceRuleModel, error) {
+	r := &recurrenceRuleModel{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return nil, errors.New("rrule is required")
+	}
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("wrong rule part [%s]", part)
+		}
+		name, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		var err error
+		switch name {
+		case "FREQ":
+			r.Freq = value
+		case "INTERVAL":
+			if r.Interval, err = strconv.Atoi(value); err != nil || r.Interval <= 0 {
+				return nil, errors.New("INTERVAL must be a positive number")
+			}
+		case "COUNT":
+			if r.Count, err = strconv.Atoi(value); err != nil || r.Count <= 0 {
+				return nil, errors.New("COUNT must be a positive number")
+			}
+		case "UNTIL":
+			if r.Until, err = parseRuleUntil(value, loc); err != nil {
+				return nil, err
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(value, ",") {
+				wd, err := parseRuleWeekday(d)
+				if err != nil {
+					return nil, err
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("wrong BYMONTHDAY [%s]", d)
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "WKST":
+			// weeks start on monday, other starts only move occurrences of
+			// weekly rules with an interval and are not supported
+			if value != "MO" {
+				return nil, errors.New("only WKST=MO is supported")
+			}
+		default:
+			return nil, fmt.Errorf("%s is not supported", name)
+		}
+	}
+	switch r.Freq {
+	case "DAILY", "WEEKLY":
+		if len(r.ByMonthDay) > 0 {
+			return nil, errors.New("BYMONTHDAY is supported only for monthly rules")
+		}
+		for _, wd := range r.ByDay {
+			if wd.N != 0 {
+				return nil, errors.New("numbered BYDAY is supported only for monthly rules")
+			}
+		}
+	case "MONTHLY":
+		if len(r.ByDay) > 0 && len(r.ByMonthDay) > 0 {
+			return nil, errors.New("BYDAY and BYMONTHDAY can't be combined")
+		}
+	case "YEARLY":
+		if len(r.ByDay) > 0 || len(r.ByMonthDay) > 0 {
+			return nil, errors.New("yearly rules repeat the first date, BYDAY and BYMONTHDAY are not supported")
+		}
+	case "":
+		return nil, errors.New("FREQ is required")
+	default:
+		return nil, fmt.Errorf("FREQ=%s is not supported", r.Freq)
+	}
+	if r.Count > 0 && r.Until != nil {
+		return nil, errors.New("COUNT and UNTIL can't be combined")
+	}
+	return r, nil
+}
+
+func parseRuleUntil(v string, loc *time.Location) (*time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", v); err == nil {
+		return &t, nil
+	}
+	if t, err := time.ParseInLocation("20060102T150405", v, loc); err == nil {
+		return &t, nil
+	}
+	t, err := time.ParseInLocation("20060102", v, loc)
+	if err != nil {
+		return nil, fmt.Errorf("wrong UNTIL [%s]", v)
+	}
+	t = t.AddDate(0, 0, 1).Add(-time.Second)
+	return &t, nil
+}
+
+func parseRuleWeekday(v string) (ruleWeekdayModel, error) {
+	wd := ruleWeekdayModel{}
+	if len(v) < 2 {
+		return wd, fmt.Errorf("wrong BYDAY [%s]", v)
+	}
+	day, ok := ruleWeekdays[v[len(v)-2:]]
+	if !ok {
+		return wd, fmt.Errorf("wrong BYDAY [%s]", v)
+	}
+	wd.Day = day
+	if n := v[:len(v)-2]; n != "" {
+		var err error
+		if wd.N, err = strconv.Atoi(n); err != nil || wd.N == 0 || wd.N < -5 || wd.N > 5 {
+			return wd, fmt.Errorf("wrong BYDAY [%s]", v)
+		}
+	}
+	return wd, nil
+}
+
+// occurrences expands the rule from dtstart, which is the first occurrence
+// whether it matches the rule or not, up to end. The times of day stay the
+// same in dtstart's location.
+func (r *recurrenceRuleModel) occurrences(dtstart, end time.Time) []time.Time {
+	res := []time.Time{}
+	if !dtstart.Before(end) {
+		return res
+	}
+	res = append(res, dtstart)
+	count := 1
+	for k := 0; k < maxRulePeriods; k++ {
+		for _, t := range r.period(dtstart, k) {
+			if !t.After(dtstart) {
+				continue
+			}
+			if (r.Count > 0 && count >= r.Count) || (r.Until != nil && t.After(*r.Until)) || !t.Before(end) {
+				return res
+			}
+			res = append(res, t)
+			count++
+		}
+	}
+	return res
+}
+
+// period returns the candidates of the k-th day, week, month or year of the
+// rule in order.
+func (r *recurrenceRuleModel) period(dtstart time.Time, k int) []time.Time {
+	y, m, d := dtstart.Date()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+	}
+	res := []time.Time{}
+	switch r.Freq {
+	case "DAILY":
+		t := at(y, m, d+k*r.Interval)
+		if len(r.ByDay) == 0 || r.hasWeekday(t.Weekday()) {
+			res = append(res, t)
+		}
+	case "WEEKLY":
+		monday := d - (int(dtstart.Weekday())+6)%7 + 7*k*r.Interval
+		if len(r.ByDay) == 0 {
+			return append(res, at(y, m, d+7*k*r.Interval))
+		}
+		for i := 0; i < 7; i++ {
+			if t := at(y, m, monday+i); r.hasWeekday(t.Weekday()) {
+				res = append(res, t)
+			}
+		}
+	case "MONTHLY":
+		first := at(y, m+time.Month(k*r.Interval), 1)
+		days := time.Date(first.Year(), first.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		picked := map[int]bool{}
+		switch {
+		case len(r.ByMonthDay) > 0:
+			for _, n := range r.ByMonthDay {
+				if n < 0 {
+					n = days + n + 1
+				}
+				if n >= 1 && n <= days {
+					picked[n] = true
+				}
+			}
+		case len(r.ByDay) > 0:
+			for _, wd := range r.ByDay {
+				for _, n := range monthWeekdays(first, days, wd) {
+					picked[n] = true
+				}
+			}
+		case d <= days:
+			picked[d] = true
+		}
+		for n := range picked {
+			res = append(res, at(first.Year(), first.Month(), n))
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Before(res[j]) })
+	case "YEARLY":
+		if t := at(y+k*r.Interval, m, d); t.Day() == d {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func (r *recurrenceRuleModel) hasWeekday(day time.Weekday) bool {
+	for _, wd := range r.ByDay {
+		if wd.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+// monthWeekdays returns the days of the month which are the BYDAY entry.
+func monthWeekdays(first time.Time, days int, wd ruleWeekdayModel) []int {
+	all := []int{}
+	for n := 1 + (int(wd.Day)-int(first.Weekday())+7)%7; n <= days; n += 7 {
+		all = append(all, n)
+	}
+	switch {
+	case wd.N == 0:
+		return all
+	case wd.N > 0 && wd.N <= len(all):
+		return all[wd.N-1 : wd.N]
+	case wd.N < 0 && -wd.N <= len(all):
+		return all[len(all)+wd.N : len(all)+wd.N+1]
+	}
+	return nil
+}
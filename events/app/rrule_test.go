@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	until := time.Date(2024, 3, 1, 23, 59, 59, 0, time.UTC)
+	untilUTC := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    *recurrenceRuleModel
+		wantErr bool
+	}{
+		{in: "FREQ=DAILY", want: &recurrenceRuleModel{Freq: "DAILY", Interval: 1}},
+		{in: "RRULE:freq=weekly;interval=2;count=5", want: &recurrenceRuleModel{Freq: "WEEKLY", Interval: 2, Count: 5}},
+		{in: "FREQ=WEEKLY;BYDAY=MO,FR;WKST=MO", want: &recurrenceRuleModel{Freq: "WEEKLY", Interval: 1, ByDay: []ruleWeekdayModel{{Day: time.Monday}, {Day: time.Friday}}}},
+		{in: "FREQ=MONTHLY;BYDAY=2TU,-1FR", want: &recurrenceRuleModel{Freq: "MONTHLY", Interval: 1, ByDay: []ruleWeekdayModel{{N: 2, Day: time.Tuesday}, {N: -1, Day: time.Friday}}}},
+		{in: "FREQ=MONTHLY;BYMONTHDAY=1,-1", want: &recurrenceRuleModel{Freq: "MONTHLY", Interval: 1, ByMonthDay: []int{1, -1}}},
+		{in: "FREQ=DAILY;UNTIL=20240301", want: &recurrenceRuleModel{Freq: "DAILY", Interval: 1, Until: &until}},
+		{in: "FREQ=DAILY;UNTIL=20240301T120000Z", want: &recurrenceRuleModel{Freq: "DAILY", Interval: 1, Until: &untilUTC}},
+		{in: "FREQ=YEARLY", want: &recurrenceRuleModel{Freq: "YEARLY", Interval: 1}},
+		{in: "", wantErr: true},
+		{in: "INTERVAL=2", wantErr: true},
+		{in: "FREQ=HOURLY", wantErr: true},
+		{in: "FREQ=DAILY;COUNT", wantErr: true},
+		{in: "FREQ=DAILY;INTERVAL=0", wantErr: true},
+		{in: "FREQ=DAILY;COUNT=-1", wantErr: true},
+		{in: "FREQ=DAILY;UNTIL=tomorrow", wantErr: true},
+		{in: "FREQ=DAILY;COUNT=2;UNTIL=20240301", wantErr: true},
+		{in: "FREQ=WEEKLY;BYDAY=XX", wantErr: true},
+		{in: "FREQ=WEEKLY;BYDAY=1MO", wantErr: true},
+		{in: "FREQ=MONTHLY;BYDAY=6MO", wantErr: true},
+		{in: "FREQ=MONTHLY;BYMONTHDAY=32", wantErr: true},
+		{in: "FREQ=MONTHLY;BYMONTHDAY=0", wantErr: true},
+		{in: "FREQ=WEEKLY;BYMONTHDAY=1", wantErr: true},
+		{in: "FREQ=MONTHLY;BYDAY=MO;BYMONTHDAY=1", wantErr: true},
+		{in: "FREQ=YEARLY;BYDAY=MO", wantErr: true},
+		{in: "FREQ=WEEKLY;WKST=SU", wantErr: true},
+		{in: "FREQ=DAILY;BYHOUR=10", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRRule(tt.in, time.UTC)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRRule(%q) error = %v, wantErr %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRRule(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	// a monday
+	jan1 := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	far := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		rule    string
+		dtstart time.Time
+		end     time.Time
+		want    []string
+	}{
+		{name: "daily", rule: "FREQ=DAILY;COUNT=3", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-02", "2024-01-03"}},
+		{name: "interval", rule: "FREQ=DAILY;INTERVAL=2;COUNT=3", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-03", "2024-01-05"}},
+		{name: "daily weekdays", rule: "FREQ=DAILY;BYDAY=SA,SU;COUNT=3", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-06", "2024-01-07"}},
+		{name: "weekly", rule: "FREQ=WEEKLY;INTERVAL=2;COUNT=3", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-15", "2024-01-29"}},
+		{name: "weekly days", rule: "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=4", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-03", "2024-01-08", "2024-01-10"}},
+		{name: "dtstart off the rule", rule: "FREQ=WEEKLY;BYDAY=FR;COUNT=2", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-05"}},
+		{name: "monthly skips short months", rule: "FREQ=MONTHLY;COUNT=3", dtstart: time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC), end: far, want: []string{"2024-01-31", "2024-03-31", "2024-05-31"}},
+		{name: "last day of month", rule: "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3", dtstart: time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC), end: far, want: []string{"2024-01-15", "2024-01-31", "2024-02-29"}},
+		{name: "last friday", rule: "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-26", "2024-02-23"}},
+		{name: "second tuesday", rule: "FREQ=MONTHLY;INTERVAL=2;BYDAY=2TU;COUNT=3", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-09", "2024-03-12"}},
+		{name: "leap day", rule: "FREQ=YEARLY;COUNT=2", dtstart: time.Date(2024, 2, 29, 10, 30, 0, 0, time.UTC), end: far, want: []string{"2024-02-29", "2028-02-29"}},
+		{name: "until date", rule: "FREQ=DAILY;UNTIL=20240103", dtstart: jan1, end: far, want: []string{"2024-01-01", "2024-01-02", "2024-01-03"}},
+		{name: "until end", rule: "FREQ=DAILY", dtstart: jan1, end: time.Date(2024, 1, 3, 10, 30, 0, 0, time.UTC), want: []string{"2024-01-01", "2024-01-02"}},
+		{name: "dtstart after end", rule: "FREQ=DAILY", dtstart: jan1, end: jan1, want: []string{}},
+		{name: "never matches", rule: "FREQ=MONTHLY;INTERVAL=12;BYMONTHDAY=30", dtstart: time.Date(2023, 2, 1, 10, 30, 0, 0, time.UTC), end: far, want: []string{"2023-02-01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRRule(tt.rule, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, o := range r.occurrences(tt.dtstart, tt.end) {
+				if o.Hour() != 10 || o.Minute() != 30 {
+					t.Errorf("occurrence %s lost the time of day", o)
+				}
+				got = append(got, o.Format("2006-01-02"))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("occurrences() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// eventFilterModel narrows the events' list, nil bounds are not applied.
+// Events without a start never match a bound.
+type eventFilterModel struct {
+	From        *time.Time
+	To          *time.Time
+	EndedBefore *time.Time
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// closesAt is the moment the event stops taking orders.
+func (e *eventModel) closesAt() *time.Time {
+	switch {
+	case e.RegistrationDeadline != nil:
+		return e.RegistrationDeadline
+	case e.EndsAt != nil:
+		return e.EndsAt
+	default:
+		return e.StartsAt
+	}
+}
+
+func isClosed(closesAt *time.Time, now time.Time) bool {
+	return closesAt != nil && !now.Before(*closesAt)
+}
+
+// validateSchedule checks that the event ends after it starts and that the
+// registration closes before the event ends.
+func validateSchedule(e *eventModel) error {
+	if e.EndsAt != nil && e.StartsAt == nil {
+		return errors.New("ends_at is set without starts_at")
+	}
+	if e.EndsAt != nil && e.EndsAt.Before(*e.StartsAt) {
+		return errors.New("event ends before it starts")
+	}
+	end := e.EndsAt
+	if end == nil {
+		end = e.StartsAt
+	}
+	if e.RegistrationDeadline != nil && end != nil && e.RegistrationDeadline.After(*end) {
+		return errors.New("registration closes after the event ends")
+	}
+	return nil
+}
+
+func parseFilterTime(name, v string) (*time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(dateLayout, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be RFC 3339 time or a date like %s", name, dateLayout)
+	}
+	return &t, nil
+}
+
+// parseEventFilter reads when=upcoming|past and the from/to range of the
+// events' start from the query. A date in to includes the whole day.
+func parseEventFilter(q url.Values, now time.Time) (*eventFilterModel, error) {
+	f := &eventFilterModel{}
+	switch q.Get("when") {
+	case "":
+	case "upcoming":
+		f.From = &now
+	case "past":
+		f.EndedBefore = &now
+	default:
+		return nil, fmt.Errorf("unknown when [%s], expected upcoming or past", q.Get("when"))
+	}
+	if v := q.Get("from"); v != "" {
+		from, err := parseFilterTime("from", v)
+		if err != nil {
+			return nil, err
+		}
+		if f.From == nil || from.After(*f.From) {
+			f.From = from
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		to, err := parseFilterTime("to", v)
+		if err != nil {
+			return nil, err
+		}
+		if len(v) == len(dateLayout) {
+			*to = to.AddDate(0, 0, 1)
+		}
+		f.To = to
+	}
+	return f, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// searchDocument must stay the same as the expression of the events_search_idx
+// index in initdb, otherwise the index is not used. The name weighs more than
+// the description. The simple configuration doesn't stem, so russian and
+// english names are matched the same way.
+const searchDocument = `(setweight(to_tsvector('simple', COALESCE(event_name, '')), 'A') || setweight(to_tsvector('simple', description), 'B'))`
+
+const (
+	searchEventsTpl  = `SELECT * FROM (SELECT e.id, e.event_name, e.price, e.total_slots, COUNT(s.id) FILTER (WHERE s.status=$1) AS held, COUNT(s.id) FILTER (WHERE s.status=$2) AS confirmed, e.starts_at, e.ends_at, e.registration_deadline, e.venue, e.address, e.description, e.organizer, e.tags, e.refund_policy, e.pricing_rules, e.transfers_disabled, e.status, COALESCE(e.series_id, 0), e.occurrence_at, e.updated_at, COALESCE(e.owner_id, 0), ts_rank(` + searchDocument + `, websearch_to_tsquery('simple', $3)) AS rank FROM events e LEFT JOIN slots s ON s.event_id=e.id WHERE e.status=$4 AND ($3 = '' OR ` + searchDocument + ` @@ websearch_to_tsquery('simple', $3)) AND ($5::integer IS NULL OR e.price >= $5) AND ($6::integer IS NULL OR e.price <= $6) AND ($7::timestamptz IS NULL OR e.starts_at >= $7) AND ($8::timestamptz IS NULL OR e.starts_at < $8) AND ($9::timestamptz IS NULL OR COALESCE(e.ends_at, e.starts_at) < $9) AND e.tags @> $10 AND ($11 = '' OR e.organizer = $11) GROUP BY e.id) found WHERE NOT $12 OR total_slots - held - confirmed > 0 ORDER BY rank DESC, starts_at NULLS LAST, id`
+	suggestEventsTpl = `SELECT id, event_name FROM events WHERE status=$1 AND ` + searchDocument + ` @@ to_tsquery('simple', $2) ORDER BY ts_rank(` + searchDocument + `, to_tsquery('simple', $2)) DESC, id LIMIT $3`
+
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 100
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 20
+)
+
+var (
+	searchEventsStmt  *sql.Stmt
+	suggestEventsStmt *sql.Stmt
+)
+
+type searchFilterModel struct {
+	Query     string
+	PriceMin  *int
+	PriceMax  *int
+	Available bool
+	Tags      []string
+	Organizer string
+	Limit     int
+	Offset    int
+	*eventFilterModel
+}
+
+type searchResultModel struct {
+	eventModel
+	Rank float64 `json:"rank"`
+}
+
+// searchFacetsModel counts the found events by tag, organizer and
+// availability, so the filters can show how many events each of them leaves.
+type searchFacetsModel struct {
+	Tags       map[string]int `json:"tags"`
+	Organizers map[string]int `json:"organizers"`
+	Available  int            `json:"available"`
+	SoldOut    int            `json:"sold_out"`
+}
+
+type searchResponseModel struct {
+	Total   int                 `json:"total"`
+	Results []searchResultModel `json:"results"`
+	Facets  searchFacetsModel   `json:"facets"`
+}
+
+type suggestionModel struct {
+	ID   int    `json:"id"`
+	Name string `json:"event_name"`
+}
+
+// rankedRow scans the rank which follows the event's columns.
+type rankedRow struct {
+	row  rowScanner
+	rank *float64
+}
+
+func (r rankedRow) Scan(dest ...interface{}) error {
+	return r.row.Scan(append(dest, r.rank)...)
+}
+
+func mustPrepareSearchStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	searchEventsStmt, err = db.PrepareContext(ctx, searchEventsTpl)
+	if err != nil {
+		panic(err)
+	}
+	suggestEventsStmt, err = db.PrepareContext(ctx, suggestEventsTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// normalizeTags lowercases the tags and drops empty ones and repeats.
+func normalizeTags(tags []string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		res = append(res, t)
+	}
+	return res
+}
+
+// tagsParam keeps the tags of the event when the update has none.
+func tagsParam(tags []string) driver.Valuer {
+	if tags == nil {
+		return nil
+	}
+	return pq.Array(normalizeTags(tags))
+}
+
+func parseIntParam(q url.Values, name string) (*int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+	return &n, nil
+}
+
+func parseLimit(q url.Values, def, max int) (int, int, error) {
+	limit, err := parseIntParam(q, "limit")
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := parseIntParam(q, "offset")
+	if err != nil {
+		return 0, 0, err
+	}
+	l, o := def, 0
+	if limit != nil && *limit > 0 {
+		l = *limit
+	}
+	if l > max {
+		l = max
+	}
+	if offset != nil && *offset > 0 {
+		o = *offset
+	}
+	return l, o, nil
+}
+
+// parseSearchFilter reads the query of /events/search. Tags may be repeated
+// or separated by commas, the event must have all of them.
+func parseSearchFilter(q url.Values, now time.Time) (*searchFilterModel, error) {
+	f := &searchFilterModel{Query: strings.TrimSpace(q.Get("q")), Organizer: q.Get("organizer")}
+	var err error
+	if f.eventFilterModel, err = parseEventFilter(q, now); err != nil {
+		return nil, err
+	}
+	if f.PriceMin, err = parseIntParam(q, "price_min"); err != nil {
+		return nil, err
+	}
+	if f.PriceMax, err = parseIntParam(q, "price_max"); err != nil {
+		return nil, err
+	}
+	if v := q.Get("available"); v != "" {
+		if f.Available, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("available must be true or false")
+		}
+	}
+	tags := []string{}
+	for _, v := range q["tag"] {
+		tags = append(tags, strings.Split(v, ",")...)
+	}
+	f.Tags = normalizeTags(tags)
+	if f.Limit, f.Offset, err = parseLimit(q, defaultSearchLimit, maxSearchLimit); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// searchEvents finds the published events matching the filter. The facets
+// are counted over every found event, the results are the requested page.
+func searchEvents(f *searchFilterModel) (*searchResponseModel, error) {
+	rows, err := searchEventsStmt.Query(slotHeld, slotConfirmed, f.Query, eventPublished, f.PriceMin, f.PriceMax,
+		f.From, f.To, f.EndedBefore, pq.Array(f.Tags), f.Organizer, f.Available)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := &searchResponseModel{
+		Results: []searchResultModel{},
+		Facets:  searchFacetsModel{Tags: map[string]int{}, Organizers: map[string]int{}},
+	}
+	for rows.Next() {
+		var rank float64
+		e, err := scanEvent(rankedRow{row: rows, rank: &rank})
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range e.Tags {
+			res.Facets.Tags[t]++
+		}
+		if e.Organizer != "" {
+			res.Facets.Organizers[e.Organizer]++
+		}
+		if e.AvailableSlots > 0 {
+			res.Facets.Available++
+		} else {
+			res.Facets.SoldOut++
+		}
+		if res.Total >= f.Offset && len(res.Results) < f.Limit {
+			res.Results = append(res.Results, searchResultModel{eventModel: *e, Rank: rank})
+		}
+		res.Total++
+	}
+	return res, rows.Err()
+}
+
+// prefixQuery turns what the user typed into a tsquery matching the event
+// names: every word must be there and the last one may be unfinished.
+func prefixQuery(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	terms := make([]string, len(words))
+	for i, w := range words {
+		terms[i] = w + ":A"
+	}
+	terms[len(terms)-1] = words[len(words)-1] + ":*A"
+	return strings.Join(terms, " & ")
+}
+
+// search handles GET /events/search.
+func search(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for events search", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	f, err := parseSearchFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong filter: %s", err)
+		return
+	}
+	res, err := searchEvents(f)
+	if err != nil {
+		log.Printf("Failed to search events by [%s]: %s\n", f.Query, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(res)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// suggest handles GET /events/search/suggest, the names of the published
+// events starting with what was typed.
+func suggest(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for events suggestions", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	q := r.URL.Query()
+	limit, _, err := parseLimit(q, defaultSuggestLimit, maxSuggestLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	res := []suggestionModel{}
+	if query := prefixQuery(q.Get("q")); query != "" {
+		rows, err := suggestEventsStmt.Query(eventPublished, query, limit)
+		if err != nil {
+			log.Printf("Failed to suggest events for [%s]: %s\n", q.Get("q"), err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			s := suggestionModel{}
+			if err = rows.Scan(&s.ID, &s.Name); err != nil {
+				log.Printf("Failed to get values: %s", err)
+				break
+			}
+			res = append(res, s)
+		}
+	}
+	data, _ := json.Marshal(res)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	seatCols             = `st.id, st.section, st.row_name, st.number, st.ticket_type_id, COALESCE(s.status, 0), COALESCE(s.order_id, 0)`
+	seatsTpl             = `SELECT ` + seatCols + ` FROM seats st LEFT JOIN slots s ON s.seat_id=st.id WHERE st.event_id=$1 ORDER BY st.section, st.row_name, st.number`
+	pickedSeatsTpl       = `SELECT ` + seatCols + ` FROM seats st LEFT JOIN slots s ON s.seat_id=st.id WHERE st.event_id=$1 AND st.id = ANY($2) ORDER BY st.section, st.row_name, st.number`
+	freeSeatsTpl         = `SELECT ` + seatCols + ` FROM seats st LEFT JOIN slots s ON s.seat_id=st.id WHERE st.event_id=$1 AND s.id IS NULL AND (st.ticket_type_id=0 OR st.ticket_type_id=$2) ORDER BY st.section, st.row_name, st.number LIMIT $3`
+	orderSeatsTpl        = `SELECT ` + seatCols + ` FROM slots s JOIN seats st ON st.id=s.seat_id WHERE s.order_id=$1 AND s.event_id=$2 AND s.ticket_type_id=$3 ORDER BY s.seq`
+	countSeatsTpl        = `SELECT COUNT(1) FROM seats WHERE event_id=$1`
+	deleteSeatsTpl       = `DELETE FROM seats WHERE event_id=$1`
+	createSeatTpl        = `INSERT INTO seats (event_id, section, row_name, number, ticket_type_id) VALUES ($1, $2, $3, $4, $5)`
+	setSeatedCapacityTpl = `UPDATE events SET total_slots=$2 WHERE id=$1`
+	maxLayoutSeats       = 10000
+)
+
+var (
+	seatsStmt             *sql.Stmt
+	pickedSeatsStmt       *sql.Stmt
+	freeSeatsStmt         *sql.Stmt
+	orderSeatsStmt        *sql.Stmt
+	countSeatsStmt        *sql.Stmt
+	deleteSeatsStmt       *sql.Stmt
+	createSeatStmt        *sql.Stmt
+	setSeatedCapacityStmt *sql.Stmt
+)
+
+var (
+	errSeatUnavailable = errors.New("seat is not available")
+	errLayoutInUse     = errors.New("event already has taken slots")
+)
+
+var seatStatusNames = map[int]string{
+	0:             "available",
+	slotHeld:      "held",
+	slotConfirmed: "sold",
+}
+
+// seatModel is a named seat of a theater-style event. A seat with a ticket
+// type can only be taken with that type, one without it with any type.
+type seatModel struct {
+	ID           int    `json:"id"`
+	Section      string `json:"section"`
+	Row          string `json:"row"`
+	Number       int    `json:"number"`
+	TicketTypeID int    `json:"ticket_type_id,omitempty"`
+	Status       string `json:"status,omitempty"`
+
+	orderID int
+}
+
+// seatRowModel describes a row of the layout: seats From..To of the row.
+type seatRowModel struct {
+	Section      string `json:"section"`
+	Row          string `json:"row"`
+	From         int    `json:"from"`
+	To           int    `json:"to"`
+	TicketTypeID int    `json:"ticket_type_id,omitempty"`
+}
+
+type seatLayoutModel struct {
+	Rows []seatRowModel `json:"rows"`
+}
+
+func mustPrepareSeatStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	seatsStmt, err = db.PrepareContext(ctx, seatsTpl)
+	if err != nil {
+		panic(err)
+	}
+	pickedSeatsStmt, err = db.PrepareContext(ctx, pickedSeatsTpl)
+	if err != nil {
+		panic(err)
+	}
+	freeSeatsStmt, err = db.PrepareContext(ctx, freeSeatsTpl)
+	if err != nil {
+		panic(err)
+	}
+	orderSeatsStmt, err = db.PrepareContext(ctx, orderSeatsTpl)
+	if err != nil {
+		panic(err)
+	}
+	countSeatsStmt, err = db.PrepareContext(ctx, countSeatsTpl)
+	if err != nil {
+		panic(err)
+	}
+	deleteSeatsStmt, err = db.PrepareContext(ctx, deleteSeatsTpl)
+	if err != nil {
+		panic(err)
+	}
+	createSeatStmt, err = db.PrepareContext(ctx, createSeatTpl)
+	if err != nil {
+		panic(err)
+	}
+	setSeatedCapacityStmt, err = db.PrepareContext(ctx, setSeatedCapacityTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (l *seatLayoutModel) validate() (int, error) {
+	n := 0
+	seen := map[[2]string]bool{}
+	for _, r := range l.Rows {
+		if r.Row == "" || r.From <= 0 || r.To < r.From || r.TicketTypeID < 0 {
+			return 0, fmt.Errorf("wrong row [%s] of section [%s]", r.Row, r.Section)
+		}
+		key := [2]string{r.Section, r.Row}
+		if seen[key] {
+			return 0, fmt.Errorf("row [%s] of section [%s] is listed twice", r.Row, r.Section)
+		}
+		seen[key] = true
+		n += r.To - r.From + 1
+	}
+	if n > maxLayoutSeats {
+		return 0, fmt.Errorf("layout has %d seats, at most %d are allowed", n, maxLayoutSeats)
+	}
+	return n, nil
+}
+
+func querySeats(q *sql.Stmt, args ...interface{}) ([]seatModel, error) {
+	rows, err := q.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []seatModel{}
+	for rows.Next() {
+		s := seatModel{}
+		var status int
+		if err = rows.Scan(&s.ID, &s.Section, &s.Row, &s.Number, &s.TicketTypeID, &status, &s.orderID); err != nil {
+			return nil, err
+		}
+		s.Status = seatStatusNames[status]
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func isSeated(tx *sql.Tx, eid int) (bool, error) {
+	var n int
+	err := tx.Stmt(countSeatsStmt).QueryRow(eid).Scan(&n)
+	return n > 0, err
+}
+
+// seatsTicketType is the ticket type of the picked seats when the item has
+// none, so the seats decide which type is sold.
+func seatsTicketType(tx *sql.Tx, it *occupyItemModel) error {
+	if len(it.SeatIDs) == 0 || it.TicketTypeID != generalAdmissionTypeID {
+		return nil
+	}
+	seats, err := querySeats(tx.Stmt(pickedSeatsStmt), it.EventID, pq.Array(it.SeatIDs))
+	if err != nil {
+		return err
+	}
+	for _, s := range seats {
+		if s.TicketTypeID != generalAdmissionTypeID {
+			it.TicketTypeID = s.TicketTypeID
+			return nil
+		}
+	}
+	return nil
+}
+
+// pickSeats returns need seats for the item within the occupy transaction:
+// the picked ones, which must be free, or the first free ones in the order of
+// sections, rows and numbers.
+func pickSeats(tx *sql.Tx, oid, need int, it *occupyItemModel) ([]seatModel, error) {
+	if len(it.SeatIDs) == 0 {
+		seats, err := querySeats(tx.Stmt(freeSeatsStmt), it.EventID, it.TicketTypeID, need)
+		if err != nil {
+			return nil, err
+		}
+		if len(seats) < need {
+			return nil, errNoSlots
+		}
+		return seats, nil
+	}
+	seats, err := querySeats(tx.Stmt(pickedSeatsStmt), it.EventID, pq.Array(it.SeatIDs))
+	if err != nil {
+		return nil, err
+	}
+	if len(seats) != len(it.SeatIDs) {
+		return nil, fmt.Errorf("%w: some seats are not in event [%d]", errSeatUnavailable, it.EventID)
+	}
+	res := []seatModel{}
+	for _, s := range seats {
+		switch {
+		case s.orderID == oid:
+			// taken by a previous occupy of the order
+		case s.orderID != 0:
+			return nil, fmt.Errorf("%w: seat %s/%s/%d is taken", errSeatUnavailable, s.Section, s.Row, s.Number)
+		case s.TicketTypeID != generalAdmissionTypeID && s.TicketTypeID != it.TicketTypeID:
+			return nil, fmt.Errorf("%w: seat %s/%s/%d is for another ticket type", errSeatUnavailable, s.Section, s.Row, s.Number)
+		default:
+			res = append(res, s)
+		}
+	}
+	if len(res) < need {
+		return nil, fmt.Errorf("%w: not as many seats as tickets", errSeatUnavailable)
+	}
+	return res[:need], nil
+}
+
+// getSeats handles GET /events/seats/{id}, the seat map with the status of
+// every seat.
+func getSeats(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for seat map", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	eid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e, err := getEvent(eid)
+	if err != nil || (e.Status == eventStatusNames[eventDraft] && !canManage(r, e.OwnerID)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	seats, err := querySeats(seatsStmt, eid)
+	if err != nil {
+		log.Printf("Failed to get seats of event [%d]: %s\n", eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(seats)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// setSeatLayoutTx replaces the seats of the event while nothing is taken and
+// makes the number of seats its capacity.
+func setSeatLayoutTx(eid, n int, l *seatLayoutModel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status, totalSlots int
+	if err = tx.Stmt(lockEventStatusStmt).QueryRow(eid).Scan(&status, &totalSlots); err != nil {
+		return err
+	}
+	occupied, err := getOccupiedSlots(tx.Stmt(occupiedSlotsStmt), eid)
+	if err != nil {
+		return err
+	}
+	if occupied > 0 {
+		return errLayoutInUse
+	}
+	if _, err = tx.Stmt(deleteSeatsStmt).Exec(eid); err != nil {
+		return err
+	}
+	for _, row := range l.Rows {
+		for num := row.From; num <= row.To; num++ {
+			if _, err = tx.Stmt(createSeatStmt).Exec(eid, row.Section, row.Row, num, row.TicketTypeID); err != nil {
+				return err
+			}
+		}
+	}
+	if n > 0 {
+		if _, err = tx.Stmt(setSeatedCapacityStmt).Exec(eid, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// setSeatLayout handles POST /events/seats/{id}. An empty layout turns the
+// event back to unnamed slots.
+func setSeatLayout(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for setting seat layout", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	eid, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	l := seatLayoutModel{}
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse seat layout of event [%d]: %s\n", eid, err)
+		return
+	}
+	n, err := l.validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong seat layout: %s", err)
+		return
+	}
+	err = setSeatLayoutTx(eid, n, &l)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errLayoutInUse):
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	case err != nil:
+		log.Printf("Failed to set seat layout of event [%d]: %s\n", eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Event [%d] got a layout of [%d] seats\n", eid, n)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "seats":%d}`, n)
+}
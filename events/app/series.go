@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	createSeriesTpl        = `INSERT INTO event_series (rrule, timezone, template, exdates) VALUES ($1, $2, $3, $4) RETURNING id`
+	getSeriesTpl           = `SELECT rrule, timezone, template, exdates FROM event_series WHERE id=$1`
+	lockSeriesTpl          = getSeriesTpl + ` FOR UPDATE`
+	seriesIDsTpl           = `SELECT id FROM event_series ORDER BY id`
+	setSeriesTemplateTpl   = `UPDATE event_series SET template=$2 WHERE id=$1`
+	setExdatesTpl          = `UPDATE event_series SET exdates=$2 WHERE id=$1`
+	addExdateTpl           = `UPDATE event_series s SET exdates = s.exdates || jsonb_build_array(e.occurrence_at) FROM events e WHERE e.id=$1 AND s.id=e.series_id`
+	seriesEventsTpl        = `SELECT e.id, e.event_name, e.price, e.total_slots, COUNT(s.id) FILTER (WHERE s.status=$1), COUNT(s.id) FILTER (WHERE s.status=$2), e.starts_at, e.ends_at, e.registration_deadline, e.venue, e.address, e.description, e.organizer, e.tags, e.refund_policy, e.pricing_rules, e.transfers_disabled, e.status, COALESCE(e.series_id, 0), e.occurrence_at, e.updated_at, COALESCE(e.owner_id, 0) FROM events e LEFT JOIN slots s ON s.event_id=e.id WHERE e.series_id=$3 GROUP BY e.id ORDER BY e.occurrence_at`
+	occurrenceTimesTpl     = `SELECT occurrence_at FROM events WHERE series_id=$1`
+	occurrenceAtTpl        = `SELECT id FROM events WHERE series_id=$1 AND occurrence_at=$2`
+	occurrenceOfTpl        = `SELECT occurrence_at FROM events WHERE id=$1 AND series_id=$2`
+	futureOccurrencesTpl   = `SELECT id FROM events WHERE series_id=$1 AND occurrence_at >= $2 AND status<>$3 ORDER BY occurrence_at`
+	seriesHorizon          = 180 * 24 * time.Hour
+	seriesExtenderInterval = time.Hour
+)
+
+var (
+	createSeriesStmt      *sql.Stmt
+	getSeriesStmt         *sql.Stmt
+	lockSeriesStmt        *sql.Stmt
+	seriesIDsStmt         *sql.Stmt
+	setSeriesTemplateStmt *sql.Stmt
+	setExdatesStmt        *sql.Stmt
+	addExdateStmt         *sql.Stmt
+	seriesEventsStmt      *sql.Stmt
+	occurrenceTimesStmt   *sql.Stmt
+	occurrenceAtStmt      *sql.Stmt
+	occurrenceOfStmt      *sql.Stmt
+	futureOccurrencesStmt *sql.Stmt
+)
+
+var (
+	errNoOccurrence   = errors.New("series has no occurrence")
+	errWrongDate      = errors.New("wrong date")
+	errSeriesSchedule = errors.New("the schedule of a series can't be changed, move single occurrences instead")
+)
+
+// seriesModel generates events from an RFC 5545 RRULE. Event is the template
+// of the occurrences: its starts_at is the first occurrence, the end and the
+// registration deadline keep their distance from the start of every
+// occurrence and so do the sales windows of the ticket types. Occurrences
+// are generated seriesHorizon ahead as separate events, which are booked,
+// edited and cancelled like any other.
+type seriesModel struct {
+	ID    int    `json:"id,omitempty"`
+	RRule string `json:"rrule"`
+	// Timezone the rule is expanded in, so occurrences keep their local time
+	// over DST changes. Without it the offset of starts_at is kept.
+	Timezone string `json:"timezone,omitempty"`
+	// Exdates are the starts of the occurrences left out of the series
+	Exdates     []time.Time  `json:"exdates,omitempty"`
+	Event       eventModel   `json:"event"`
+	Occurrences []eventModel `json:"occurrences,omitempty"`
+
+	rule *recurrenceRuleModel
+	loc  *time.Location
+}
+
+type seriesCancelModel struct {
+	// Dates are dates of the series' timezone or exact starts in RFC 3339
+	Dates []string `json:"dates"`
+}
+
+func mustPrepareSeriesStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	createSeriesStmt, err = db.PrepareContext(ctx, createSeriesTpl)
+	if err != nil {
+		panic(err)
+	}
+	getSeriesStmt, err = db.PrepareContext(ctx, getSeriesTpl)
+	if err != nil {
+		panic(err)
+	}
+	lockSeriesStmt, err = db.PrepareContext(ctx, lockSeriesTpl)
+	if err != nil {
+		panic(err)
+	}
+	seriesIDsStmt, err = db.PrepareContext(ctx, seriesIDsTpl)
+	if err != nil {
+		panic(err)
+	}
+	setSeriesTemplateStmt, err = db.PrepareContext(ctx, setSeriesTemplateTpl)
+	if err != nil {
+		panic(err)
+	}
+	setExdatesStmt, err = db.PrepareContext(ctx, setExdatesTpl)
+	if err != nil {
+		panic(err)
+	}
+	addExdateStmt, err = db.PrepareContext(ctx, addExdateTpl)
+	if err != nil {
+		panic(err)
+	}
+	seriesEventsStmt, err = db.PrepareContext(ctx, seriesEventsTpl)
+	if err != nil {
+		panic(err)
+	}
+	occurrenceTimesStmt, err = db.PrepareContext(ctx, occurrenceTimesTpl)
+	if err != nil {
+		panic(err)
+	}
+	occurrenceAtStmt, err = db.PrepareContext(ctx, occurrenceAtTpl)
+	if err != nil {
+		panic(err)
+	}
+	occurrenceOfStmt, err = db.PrepareContext(ctx, occurrenceOfTpl)
+	if err != nil {
+		panic(err)
+	}
+	futureOccurrencesStmt, err = db.PrepareContext(ctx, futureOccurrencesTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// prepare parses the rule and the timezone of the series.
+func (s *seriesModel) prepare() error {
+	s.loc = s.Event.StartsAt.Location()
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("unknown timezone [%s]", s.Timezone)
+		}
+		s.loc = loc
+	}
+	rule, err := parseRRule(s.RRule, s.loc)
+	if err != nil {
+		return err
+	}
+	s.rule = rule
+	return nil
+}
+
+func (s *seriesModel) validate() error {
+	e := &s.Event
+	switch {
+	case e.Name == "":
+		return errors.New("event_name is required")
+	case e.StartsAt == nil:
+		return errors.New("starts_at of the first occurrence is required")
+	case e.Price < 0 || e.TotalSlots < 0:
+		return errors.New("price and total slots can't be negative")
+	}
+	start := e.StartsAt.Truncate(time.Second)
+	e.StartsAt = &start
+	if err := e.RefundPolicy.validate(); err != nil {
+		return fmt.Errorf("wrong refund policy: %s", err)
+	}
+	if err := e.PricingRules.validate(); err != nil {
+		return fmt.Errorf("wrong pricing rules: %s", err)
+	}
+	if err := validateSchedule(e); err != nil {
+		return err
+	}
+	for i := range e.TicketTypes {
+		if err := e.TicketTypes[i].validate(); err != nil {
+			return fmt.Errorf("wrong ticket type [%s]: %s", e.TicketTypes[i].Name, err)
+		}
+	}
+	return s.prepare()
+}
+
+func (s *seriesModel) dtstart() time.Time {
+	return s.Event.StartsAt.In(s.loc)
+}
+
+func (s *seriesModel) isExdate(t time.Time) bool {
+	for _, x := range s.Exdates {
+		if x.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func shiftTime(t *time.Time, d time.Duration) *time.Time {
+	if t == nil {
+		return nil
+	}
+	v := t.Add(d)
+	return &v
+}
+
+// occurrence makes the event of the series starting at t.
+func (s *seriesModel) occurrence(t time.Time) *eventModel {
+	e := s.Event
+	shift := t.Sub(*s.Event.StartsAt)
+	e.StartsAt, e.OccurrenceAt = &t, &t
+	e.EndsAt = shiftTime(s.Event.EndsAt, shift)
+	e.RegistrationDeadline = shiftTime(s.Event.RegistrationDeadline, shift)
+	e.PricingRules = make(pricingRulesModel, len(s.Event.PricingRules))
+	for i, rule := range s.Event.PricingRules {
+		rule.Before = shiftTime(rule.Before, shift)
+		e.PricingRules[i] = rule
+	}
+	e.TicketTypes = make([]ticketTypeModel, len(s.Event.TicketTypes))
+	for i, tt := range s.Event.TicketTypes {
+		tt.SalesStart = shiftTime(tt.SalesStart, shift)
+		tt.SalesEnd = shiftTime(tt.SalesEnd, shift)
+		e.TicketTypes[i] = tt
+	}
+	e.SeriesID = s.ID
+	return &e
+}
+
+// occurrencesOn returns the starts the rule gives on the date, or the exact
+// start when v is a time, exdates included.
+func (s *seriesModel) occurrencesOn(v string) ([]time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		for _, o := range s.rule.occurrences(s.dtstart(), t.Add(time.Second)) {
+			if o.Equal(t) {
+				return []time.Time{o}, nil
+			}
+		}
+		return nil, fmt.Errorf("%w at [%s]", errNoOccurrence, v)
+	}
+	day, err := time.ParseInLocation(dateLayout, v, s.loc)
+	if err != nil {
+		return nil, fmt.Errorf("%w [%s]: must be RFC 3339 time or a date like %s", errWrongDate, v, dateLayout)
+	}
+	res := []time.Time{}
+	for _, o := range s.rule.occurrences(s.dtstart(), day.AddDate(0, 0, 1)) {
+		if !o.Before(day) {
+			res = append(res, o)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%w on [%s]", errNoOccurrence, v)
+	}
+	return res, nil
+}
+
+// applyTo copies the changed fields to the template of a series.
+func (u *eventUpdateModel) applyTo(e *eventModel) {
+	if u.Name != nil {
+		e.Name = *u.Name
+	}
+	if u.Price != nil {
+		e.Price = *u.Price
+	}
+	if u.TotalSlots != nil {
+		e.TotalSlots = *u.TotalSlots
+	}
+	if u.Venue != nil {
+		e.Venue = *u.Venue
+	}
+	if u.Address != nil {
+		e.Address = *u.Address
+	}
+	if u.Description != nil {
+		e.Description = *u.Description
+	}
+	if u.Organizer != nil {
+		e.Organizer = *u.Organizer
+	}
+	if u.Tags != nil {
+		e.Tags = normalizeTags(u.Tags)
+	}
+}
+
+func loadSeries(q *sql.Stmt, id int) (*seriesModel, error) {
+	s := &seriesModel{ID: id}
+	template, exdates := []byte{}, []byte{}
+	if err := q.QueryRow(id).Scan(&s.RRule, &s.Timezone, &template, &exdates); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(template, &s.Event); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(exdates, &s.Exdates); err != nil {
+		return nil, err
+	}
+	return s, s.prepare()
+}
+
+func getSeriesEvents(id int) ([]eventModel, error) {
+	rows, err := seriesEventsStmt.Query(slotHeld, slotConfirmed, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	es := []eventModel{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, *e)
+	}
+	return es, rows.Err()
+}
+
+// generateOccurrences creates the missing occurrences which start between
+// now and the horizon. The series must be locked.
+func generateOccurrences(tx *sql.Tx, s *seriesModel, now time.Time) (int, error) {
+	rows, err := tx.Stmt(occurrenceTimesStmt).Query(s.ID)
+	if err != nil {
+		return 0, err
+	}
+	existing := map[int64]bool{}
+	for rows.Next() {
+		var at time.Time
+		if err = rows.Scan(&at); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		existing[at.Unix()] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, t := range s.rule.occurrences(s.dtstart(), now.Add(seriesHorizon)) {
+		if t.Before(now) || existing[t.Unix()] || s.isExdate(t) {
+			continue
+		}
+		e := s.occurrence(t)
+		eid, err := createEventWith(tx.Stmt(createEventStmt), e)
+		if err != nil {
+			return 0, err
+		}
+		for _, tt := range e.TicketTypes {
+			if _, err = tx.Stmt(createTicketTypeStmt).Exec(eid, tt.Name, tt.Price, tt.Quota, tt.SalesStart, tt.SalesEnd, pq.Array(tt.Roles), tt.MaxPerOrder); err != nil {
+				return 0, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+func createSeriesTx(s *seriesModel, now time.Time) error {
+	template, err := json.Marshal(s.Event)
+	if err != nil {
+		return err
+	}
+	exdates, err := json.Marshal(s.Exdates)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = tx.Stmt(createSeriesStmt).QueryRow(s.RRule, s.Timezone, template, exdates).Scan(&s.ID); err != nil {
+		return err
+	}
+	if _, err = generateOccurrences(tx, s, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func extendSeriesTx(id int, now time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	s, err := loadSeries(tx.Stmt(lockSeriesStmt), id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := generateOccurrences(tx, s, now)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// extendSeries periodically generates the occurrences coming into the
+// horizon.
+func extendSeries(ctx context.Context) {
+	ticker := time.NewTicker(seriesExtenderInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		rows, err := seriesIDsStmt.Query()
+		if err != nil {
+			log.Printf("Failed to get series: %s\n", err)
+			continue
+		}
+		ids := []int{}
+		for rows.Next() {
+			var id int
+			if err = rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		for _, id := range ids {
+			n, err := extendSeriesTx(id, time.Now())
+			if err != nil {
+				log.Printf("Failed to extend series [%d]: %s\n", id, err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Series [%d] got [%d] new occurrences\n", id, n)
+			}
+		}
+	}
+}
+
+// updateSeriesTx changes the template and every occurrence from the given
+// start on, which haven't been cancelled, in one transaction.
+func updateSeriesTx(id, fromID int, u *eventUpdateModel, now time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	s, err := loadSeries(tx.Stmt(lockSeriesStmt), id)
+	if err != nil {
+		return 0, err
+	}
+	from := now
+	if fromID != 0 {
+		if err = tx.Stmt(occurrenceOfStmt).QueryRow(fromID, id).Scan(&from); err != nil {
+			return 0, err
+		}
+	}
+	u.applyTo(&s.Event)
+	template, err := json.Marshal(s.Event)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.Stmt(setSeriesTemplateStmt).Exec(id, template); err != nil {
+		return 0, err
+	}
+	rows, err := tx.Stmt(futureOccurrencesStmt).Query(id, from, eventCancelled)
+	if err != nil {
+		return 0, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var eid int
+		if err = rows.Scan(&eid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, eid)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, eid := range ids {
+		if err = applyEventUpdate(tx, eid, u); err != nil {
+			return 0, fmt.Errorf("occurrence [%d]: %w", eid, err)
+		}
+	}
+	return len(ids), tx.Commit()
+}
+
+// cancelSeriesDatesTx adds the occurrences on the dates to the exdates and
+// returns the generated ones, which are to be cancelled.
+func cancelSeriesDatesTx(id int, dates []string) ([]int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	s, err := loadSeries(tx.Stmt(lockSeriesStmt), id)
+	if err != nil {
+		return nil, 0, err
+	}
+	starts := []time.Time{}
+	for _, d := range dates {
+		ts, err := s.occurrencesOn(d)
+		if err != nil {
+			return nil, 0, err
+		}
+		starts = append(starts, ts...)
+	}
+	ids := []int{}
+	for _, t := range starts {
+		if !s.isExdate(t) {
+			s.Exdates = append(s.Exdates, t)
+		}
+		var eid int
+		err = tx.Stmt(occurrenceAtStmt).QueryRow(id, t).Scan(&eid)
+		switch {
+		case err == nil:
+			ids = append(ids, eid)
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, 0, err
+		}
+	}
+	exdates, err := json.Marshal(s.Exdates)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err = tx.Stmt(setExdatesStmt).Exec(id, exdates); err != nil {
+		return nil, 0, err
+	}
+	return ids, len(starts), tx.Commit()
+}
+
+// collapseSeries folds the listed occurrences of every series into the
+// earliest one.
+func collapseSeries(es []eventModel) []eventModel {
+	res := []eventModel{}
+	first := map[int]int{}
+	for _, e := range es {
+		if e.SeriesID == 0 {
+			res = append(res, e)
+			continue
+		}
+		i, ok := first[e.SeriesID]
+		if !ok {
+			first[e.SeriesID] = len(res)
+			e.Occurrences = 1
+			res = append(res, e)
+			continue
+		}
+		n := res[i].Occurrences + 1
+		if e.StartsAt != nil && res[i].StartsAt != nil && e.StartsAt.Before(*res[i].StartsAt) {
+			res[i] = e
+		}
+		res[i].Occurrences = n
+	}
+	return res
+}
+
+func writeSeries(w http.ResponseWriter, r *http.Request, s *seriesModel) {
+	es, err := getSeriesEvents(s.ID)
+	if err != nil {
+		log.Printf("Failed to get occurrences of series [%d]: %s\n", s.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	es = publicEvents(r, es)
+	s.Occurrences = es
+	data, _ := json.Marshal(s)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// createSeries handles POST /events/series.
+func createSeries(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for creating event series", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s := seriesModel{}
+	if err = json.NewDecoder(r.Body).Decode(&s); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse event series: %s\n", err)
+		return
+	}
+	s.Event.OwnerID = uid
+	if err := s.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong series: %s", err)
+		return
+	}
+	if err := createSeriesTx(&s, time.Now()); err != nil {
+		log.Printf("Failed to create series [%s] of event [%s]: %s\n", s.RRule, s.Event.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created series [%d] [%s] of event [%s]\n", s.ID, s.RRule, s.Event.Name)
+	writeSeries(w, r, &s)
+}
+
+// getSeries handles GET /events/series/{id}, the series with its generated
+// occurrences.
+func getSeries(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for event series", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s, err := loadSeries(getSeriesStmt, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get series [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeSeries(w, r, s)
+}
+
+// updateSeries handles POST /events/series/{id}. The change applies to the
+// occurrence given by from and every one after it, or to the ones still to
+// come without it; a single occurrence is changed through /events/manage.
+func updateSeries(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for updating event series", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := seriesID(w, r)
+	if !ok {
+		return
+	}
+	fromID := 0
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		if fromID, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "from must be an event id")
+			return
+		}
+	}
+	u := eventUpdateModel{}
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse update of series [%d]: %s\n", id, err)
+		return
+	}
+	if u.StartsAt != nil || u.EndsAt != nil || u.RegistrationDeadline != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, errSeriesSchedule)
+		return
+	}
+	if (u.Price != nil && *u.Price < 0) || (u.TotalSlots != nil && *u.TotalSlots < 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Price and total slots can't be negative")
+		return
+	}
+	n, err := updateSeriesTx(id, fromID, &u, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errBelowOccupied):
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	case err != nil:
+		log.Printf("Failed to update series [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Series [%d] was updated with [%d] occurrences\n", id, n)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "updated_occurrences":%d}`, n)
+}
+
+// cancelSeriesDates handles POST /events/series/{id}/cancel. The dates are
+// left out of the series, the occurrences already generated on them are
+// cancelled with their orders like a cancelled event.
+func cancelSeriesDates(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for cancelling dates of event series", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := seriesID(w, r)
+	if !ok {
+		return
+	}
+	c := seriesCancelModel{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || len(c.Dates) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "dates are required")
+		return
+	}
+	ids, n, err := cancelSeriesDatesTx(id, c.Dates)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errNoOccurrence), errors.Is(err, errWrongDate):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	case err != nil:
+		log.Printf("Failed to cancel dates of series [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	cancelled := 0
+	for _, eid := range ids {
+		if err = closeEvent(r.Context(), span.Context(), eid); err != nil {
+			log.Printf("Failed to cancel event [%d]: %s\n", eid, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res, err := cancelEventOrders(r.Context(), span.Context(), eid)
+		if err != nil {
+			log.Printf("Failed to cancel orders of event [%d]: %s\n", eid, err)
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "Event [%d] is cancelled, but its orders were not: %s", eid, err)
+			return
+		}
+		cancelled += res.Cancelled
+	}
+	log.Printf("Series [%d] got [%d] dates cancelled with [%d] orders\n", id, n, cancelled)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "cancelled_dates":%d, "cancelled_orders":%d}`, n, cancelled)
+}
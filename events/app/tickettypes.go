@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	ticketTypeCols         = `t.id, t.event_id, t.name, t.price, t.quota, t.sales_start, t.sales_end, t.roles, t.max_per_order, COUNT(s.id)`
+	getTicketTypesTpl      = `SELECT ` + ticketTypeCols + ` FROM ticket_types t LEFT JOIN slots s ON s.ticket_type_id=t.id WHERE t.event_id=$1 GROUP BY t.id ORDER BY t.price, t.id`
+	getTicketTypeTpl       = `SELECT ` + ticketTypeCols + ` FROM ticket_types t LEFT JOIN slots s ON s.ticket_type_id=t.id WHERE t.event_id=$1 AND t.id=$2 GROUP BY t.id`
+	createTicketTypeTpl    = `INSERT INTO ticket_types (event_id, name, price, quota, sales_start, sales_end, roles, max_per_order) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	updateTicketTypeTpl    = `UPDATE ticket_types SET name=$3, price=$4, quota=$5, sales_start=$6, sales_end=$7, roles=$8, max_per_order=$9 WHERE event_id=$1 AND id=$2`
+	deleteTicketTypeTpl    = `DELETE FROM ticket_types WHERE event_id=$1 AND id=$2 AND NOT EXISTS (SELECT 1 FROM slots WHERE ticket_type_id=$2)`
+	orderTicketTypeTpl     = `SELECT ticket_type_id FROM slots WHERE order_id=$1 AND event_id=$2 LIMIT 1`
+	generalAdmissionTypeID = 0
+)
+
+var (
+	getTicketTypesStmt   *sql.Stmt
+	getTicketTypeStmt    *sql.Stmt
+	createTicketTypeStmt *sql.Stmt
+	updateTicketTypeStmt *sql.Stmt
+	deleteTicketTypeStmt *sql.Stmt
+	orderTicketTypeStmt  *sql.Stmt
+)
+
+var errTicketTypeUnavailable = errors.New("ticket type is not available")
+
+// ticketTypeModel is a kind of ticket of an event with its own price and
+// quota, e.g. early-bird, VIP or student. The quota is taken from the event's
+// total slots, so the quotas may add up to more than the event has.
+type ticketTypeModel struct {
+	ID      int    `json:"id,omitempty"`
+	EventID int    `json:"event_id,omitempty"`
+	Name    string `json:"name"`
+	Price   int    `json:"price"`
+	Quota   int    `json:"quota"`
+	// CurrentPrice is Price after the event's pricing rules that hold right
+	// now
+	CurrentPrice int `json:"current_price"`
+	// the type is sold only between SalesStart and SalesEnd, when they are set
+	SalesStart *time.Time `json:"sales_start,omitempty"`
+	SalesEnd   *time.Time `json:"sales_end,omitempty"`
+	// Roles limits the type to users with one of the roles, any user may buy
+	// it when it is empty
+	Roles       []string `json:"roles,omitempty"`
+	MaxPerOrder int      `json:"max_per_order,omitempty"`
+
+	Taken     int  `json:"taken"`
+	Available int  `json:"available"`
+	OnSale    bool `json:"on_sale"`
+}
+
+func mustPrepareTicketTypeStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	getTicketTypesStmt, err = db.PrepareContext(ctx, getTicketTypesTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTicketTypeStmt, err = db.PrepareContext(ctx, getTicketTypeTpl)
+	if err != nil {
+		panic(err)
+	}
+	createTicketTypeStmt, err = db.PrepareContext(ctx, createTicketTypeTpl)
+	if err != nil {
+		panic(err)
+	}
+	updateTicketTypeStmt, err = db.PrepareContext(ctx, updateTicketTypeTpl)
+	if err != nil {
+		panic(err)
+	}
+	deleteTicketTypeStmt, err = db.PrepareContext(ctx, deleteTicketTypeTpl)
+	if err != nil {
+		panic(err)
+	}
+	orderTicketTypeStmt, err = db.PrepareContext(ctx, orderTicketTypeTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (t *ticketTypeModel) validate() error {
+	switch {
+	case t.Name == "":
+		return errors.New("name is required")
+	case t.Price < 0 || t.Quota < 0 || t.MaxPerOrder < 0:
+		return errors.New("price, quota and max_per_order can't be negative")
+	case t.SalesStart != nil && t.SalesEnd != nil && !t.SalesEnd.After(*t.SalesStart):
+		return errors.New("sales end before they start")
+	}
+	t.Roles = normalizeTags(t.Roles)
+	return nil
+}
+
+func (t *ticketTypeModel) onSale(now time.Time) bool {
+	return (t.SalesStart == nil || !now.Before(*t.SalesStart)) && (t.SalesEnd == nil || now.Before(*t.SalesEnd))
+}
+
+func (t *ticketTypeModel) eligible(role string) bool {
+	if len(t.Roles) == 0 {
+		return true
+	}
+	for _, r := range t.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// check tells why need more tickets of the type can't be sold to a user with
+// the role for an order of quantity tickets, nil when they can.
+func (t *ticketTypeModel) check(role string, need, quantity int, now time.Time) error {
+	switch {
+	case !t.onSale(now):
+		return fmt.Errorf("%w: [%s] is not on sale", errTicketTypeUnavailable, t.Name)
+	case !t.eligible(role):
+		return fmt.Errorf("%w: [%s] is not for role [%s]", errTicketTypeUnavailable, t.Name, role)
+	case t.MaxPerOrder > 0 && quantity > t.MaxPerOrder:
+		return fmt.Errorf("%w: [%s] is limited to %d per order", errTicketTypeUnavailable, t.Name, t.MaxPerOrder)
+	case t.Quota-t.Taken < need:
+		return errNoSlots
+	}
+	return nil
+}
+
+func scanTicketType(row rowScanner) (*ticketTypeModel, error) {
+	t := &ticketTypeModel{}
+	start, end := sql.NullTime{}, sql.NullTime{}
+	err := row.Scan(&t.ID, &t.EventID, &t.Name, &t.Price, &t.Quota, &start, &end, pq.Array(&t.Roles), &t.MaxPerOrder, &t.Taken)
+	if err != nil {
+		return nil, err
+	}
+	t.SalesStart = nullTime(start)
+	t.SalesEnd = nullTime(end)
+	t.Available = t.Quota - t.Taken
+	if t.Available < 0 {
+		t.Available = 0
+	}
+	t.OnSale = t.onSale(time.Now())
+	return t, nil
+}
+
+func getTicketTypes(q *sql.Stmt, eid int) ([]ticketTypeModel, error) {
+	rows, err := q.Query(eid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ticketTypeModel{}
+	for rows.Next() {
+		t, err := scanTicketType(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *t)
+	}
+	return res, rows.Err()
+}
+
+// withTicketTypes adds the ticket types to the event, no type may have more
+// available tickets than the event has slots.
+func withTicketTypes(e *eventModel) error {
+	types, err := getTicketTypes(getTicketTypesStmt, e.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range types {
+		if types[i].Available > e.AvailableSlots {
+			types[i].Available = e.AvailableSlots
+		}
+		types[i].CurrentPrice = e.currentPrice(types[i].Price, types[i].Name, now)
+	}
+	e.TicketTypes = types
+	return nil
+}
+
+// pickTicketType finds the ticket type of the item within the occupy
+// transaction and sets it on the item. It returns nil for events without
+// ticket types. An item without a type gets the type the order already holds
+// or the cheapest one the user may buy now.
+func pickTicketType(tx *sql.Tx, oid int, it *occupyItemModel, role string, now time.Time) (*ticketTypeModel, error) {
+	types, err := getTicketTypes(tx.Stmt(getTicketTypesStmt), it.EventID)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		if it.TicketTypeID != generalAdmissionTypeID {
+			return nil, fmt.Errorf("%w: event [%d] has no ticket types", errTicketTypeUnavailable, it.EventID)
+		}
+		return nil, nil
+	}
+	if it.TicketTypeID == generalAdmissionTypeID {
+		err = tx.Stmt(orderTicketTypeStmt).QueryRow(oid, it.EventID).Scan(&it.TicketTypeID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	if it.TicketTypeID != generalAdmissionTypeID {
+		for i := range types {
+			if types[i].ID == it.TicketTypeID {
+				return &types[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%w: no ticket type [%d] for event [%d]", errTicketTypeUnavailable, it.TicketTypeID, it.EventID)
+	}
+	// types are sorted by price
+	for i := range types {
+		if types[i].check(role, it.Quantity, it.Quantity, now) == nil {
+			it.TicketTypeID = types[i].ID
+			return &types[i], nil
+		}
+	}
+	return nil, errNoSlots
+}
+
+func ticketTypeIDs(w http.ResponseWriter, r *http.Request, withType bool) (int, int, bool) {
+	vars := mux.Vars(r)
+	eid, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if !withType {
+		return eid, 0, true
+	}
+	tid, err := strconv.Atoi(vars["type"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return eid, tid, true
+}
+
+// listTicketTypes handles GET /events/ticket-types/{id}.
+func listTicketTypes(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for ticket types", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	eid, _, ok := ticketTypeIDs(w, r, false)
+	if !ok {
+		return
+	}
+	e, err := getEvent(eid)
+	if err != nil || (e.Status == eventStatusNames[eventDraft] && !canManage(r, e.OwnerID)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err = withTicketTypes(e); err != nil {
+		log.Printf("Failed to get ticket types of event [%d]: %s\n", eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(e.TicketTypes)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func decodeTicketType(w http.ResponseWriter, r *http.Request, eid int) (*ticketTypeModel, bool) {
+	t := ticketTypeModel{}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse ticket type of event [%d]: %s\n", eid, err)
+		return nil, false
+	}
+	if err := t.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong ticket type: %s", err)
+		return nil, false
+	}
+	return &t, true
+}
+
+// createTicketType handles POST /events/ticket-types/{id}.
+func createTicketType(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for creating ticket type", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	eid, _, ok := ticketTypeIDs(w, r, false)
+	if !ok {
+		return
+	}
+	if !checkOwner(w, r, eid, eventOwner) {
+		return
+	}
+	t, ok := decodeTicketType(w, r, eid)
+	if !ok {
+		return
+	}
+	if _, err := getEvent(eid); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err := createTicketTypeStmt.QueryRow(eid, t.Name, t.Price, t.Quota, t.SalesStart, t.SalesEnd, pq.Array(t.Roles), t.MaxPerOrder).Scan(&t.ID)
+	if err != nil {
+		log.Printf("Failed to create ticket type [%s] of event [%d]: %s\n", t.Name, eid, err)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Ticket type [%s] already exists", t.Name)
+		return
+	}
+	log.Printf("Created ticket type [%d] [%s] of event [%d]\n", t.ID, t.Name, eid)
+	t.EventID = eid
+	t.Available = t.Quota
+	t.OnSale = t.onSale(time.Now())
+	data, _ := json.Marshal(t)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// updateTicketTypeTx replaces the ticket type under the event's lock, so
+// the quota can't drop below the tickets taken meanwhile.
+func updateTicketTypeTx(eid, tid int, t *ticketTypeModel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status, totalSlots int
+	if err = tx.Stmt(lockEventStatusStmt).QueryRow(eid).Scan(&status, &totalSlots); err != nil {
+		return err
+	}
+	cur, err := scanTicketType(tx.Stmt(getTicketTypeStmt).QueryRow(eid, tid))
+	if err != nil {
+		return err
+	}
+	if t.Quota < cur.Taken {
+		return fmt.Errorf("%w: %d tickets are taken", errBelowOccupied, cur.Taken)
+	}
+	if _, err = tx.Stmt(updateTicketTypeStmt).Exec(eid, tid, t.Name, t.Price, t.Quota, t.SalesStart, t.SalesEnd, pq.Array(t.Roles), t.MaxPerOrder); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateTicketType handles POST /events/ticket-types/{id}/{type}. The new
+// price applies to the orders made after the change.
+func updateTicketType(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for updating ticket type", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	eid, tid, ok := ticketTypeIDs(w, r, true)
+	if !ok {
+		return
+	}
+	if !checkOwner(w, r, eid, eventOwner) {
+		return
+	}
+	t, ok := decodeTicketType(w, r, eid)
+	if !ok {
+		return
+	}
+	err := updateTicketTypeTx(eid, tid, t)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errBelowOccupied):
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	case err != nil:
+		log.Printf("Failed to update ticket type [%d] of event [%d]: %s\n", tid, eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Ticket type [%d] of event [%d] was updated\n", tid, eid)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+// deleteTicketTypeTx removes the type under the event's lock, so no occupy
+// takes it meanwhile.
+func deleteTicketTypeTx(eid, tid int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var status, totalSlots int
+	err = tx.Stmt(lockEventStatusStmt).QueryRow(eid).Scan(&status, &totalSlots)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Stmt(deleteTicketTypeStmt).Exec(eid, tid)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+// deleteTicketType handles DELETE /events/ticket-types/{id}/{type}, only a
+// type nobody has taken can be removed.
+func deleteTicketType(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for deleting ticket type", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	eid, tid, ok := ticketTypeIDs(w, r, true)
+	if !ok {
+		return
+	}
+	if !checkOwner(w, r, eid, eventOwner) {
+		return
+	}
+	deleted, err := deleteTicketTypeTx(eid, tid)
+	if err != nil {
+		log.Printf("Failed to delete ticket type [%d] of event [%d]: %s\n", tid, eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Ticket type [%d] doesn't exist or is taken", tid)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	setTransfersTpl = `UPDATE events SET transfers_disabled=$2 WHERE id=$1`
+)
+
+var (
+	setTransfersStmt *sql.Stmt
+)
+
+type transfersRequestModel struct {
+	Disabled bool `json:"disabled"`
+}
+
+func mustPrepareTransferStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	setTransfersStmt, err = db.PrepareContext(ctx, setTransfersTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// setTransfers allows or forbids transferring the event's tickets. Orders
+// checks it before a transfer is offered and once more when it is accepted.
+func setTransfers(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for event's transfers", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	t := transfersRequestModel{}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse transfers request for event [%d]: %s\n", id, err)
+		return
+	}
+	res, err := setTransfersStmt.Exec(id, t.Disabled)
+	if err != nil {
+		log.Printf("Failed to set transfers for event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"lib/client"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// A waiting entry becomes promoted once a freed slot was handed to its user,
+// and lapsed when the order it got was cancelled before being paid.
+const (
+	waitlistWaiting = iota + 1
+	waitlistPromoted
+	waitlistLapsed
+)
+
+const (
+	// the conflict target has to repeat the predicate of the partial unique
+	// index, so the waiting status is spelled out here
+	joinWaitlistTpl      = `INSERT INTO waitlist (event_id, user_id, status) VALUES ($1, $2, 1) ON CONFLICT (event_id, user_id) WHERE status = 1 DO NOTHING RETURNING id`
+	leaveWaitlistTpl     = `DELETE FROM waitlist WHERE event_id=$1 AND user_id=$2 AND status=$3`
+	waitlistPositionTpl  = `SELECT COUNT(1) FROM waitlist WHERE event_id=$1 AND status=$2 AND id <= $3`
+	getWaitlistTpl       = `SELECT id, user_id, status, COALESCE(order_id, 0), created_at, promoted_at FROM waitlist WHERE event_id=$1 ORDER BY id`
+	promoteWaitlistTpl   = `UPDATE waitlist SET status=$3, promoted_at=now() WHERE id IN (SELECT id FROM waitlist WHERE event_id=$1 AND status=$2 ORDER BY id LIMIT $4 FOR UPDATE SKIP LOCKED) RETURNING id, user_id`
+	bindWaitlistOrderTpl = `UPDATE waitlist SET order_id=$2 WHERE id=$1`
+	demoteWaitlistTpl    = `UPDATE waitlist SET status=$2, promoted_at=NULL WHERE id=$1`
+	orderWaitlistPath    = "/orders/callback/waitlist"
+	notifyPath           = "/notif/create"
+	joinedTpl            = `{"success":true, "event_id":%d, "position":%d}`
+	// the order id is bound only after orders answered the promotion, an
+	// order failing before that is found by its user and event
+	lapseWaitlistTpl = `UPDATE waitlist SET status=$3 WHERE status=$2 AND (order_id=$1 OR (order_id IS NULL AND user_id=$4 AND event_id=$5)) RETURNING event_id, user_id`
+)
+
+var (
+	joinWaitlistStmt      *sql.Stmt
+	leaveWaitlistStmt     *sql.Stmt
+	waitlistPositionStmt  *sql.Stmt
+	getWaitlistStmt       *sql.Stmt
+	promoteWaitlistStmt   *sql.Stmt
+	bindWaitlistOrderStmt *sql.Stmt
+	demoteWaitlistStmt    *sql.Stmt
+	lapseWaitlistStmt     *sql.Stmt
+)
+
+type waitlistRequestModel struct {
+	EventID int `json:"event_id"`
+}
+
+type waitlistEntryModel struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Status     int        `json:"status"`
+	OrderID    int        `json:"order_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty"`
+}
+
+type waitlistPromotionModel struct {
+	EventID int `json:"event_id"`
+	UserID  int `json:"user_id"`
+}
+
+type notifyRequestModel struct {
+	OrderID int    `json:"order_id"`
+	Message string `json:"message"`
+}
+
+type promotedOrderModel struct {
+	Success bool `json:"success"`
+	OrderID int  `json:"order_id"`
+}
+
+func mustPrepareWaitlistStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	joinWaitlistStmt, err = db.PrepareContext(ctx, joinWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	leaveWaitlistStmt, err = db.PrepareContext(ctx, leaveWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	waitlistPositionStmt, err = db.PrepareContext(ctx, waitlistPositionTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getWaitlistStmt, err = db.PrepareContext(ctx, getWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	promoteWaitlistStmt, err = db.PrepareContext(ctx, promoteWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	bindWaitlistOrderStmt, err = db.PrepareContext(ctx, bindWaitlistOrderTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	demoteWaitlistStmt, err = db.PrepareContext(ctx, demoteWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	lapseWaitlistStmt, err = db.PrepareContext(ctx, lapseWaitlistTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// joinWaitlist puts the user at the end of the event's waitlist. It is only
+// possible while the event is sold out, otherwise the slot can just be ordered.
+func joinWaitlist(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for joining waitlist", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		log.Printf("Failed to get User ID: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	m := waitlistRequestModel{}
+	if err = json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		return
+	}
+	e, err := getEvent(m.EventID)
+	if err != nil {
+		log.Printf("Could not find any event with id [%d]\n", m.EventID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !e.RegistrationOpen {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Event [%d] is not open for orders", e.ID)
+		return
+	}
+	if e.AvailableSlots > 0 {
+		log.Printf("Event [%d] still has [%d] available slots, waitlist is not needed\n", e.ID, e.AvailableSlots)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Event [%d] still has available slots", e.ID)
+		return
+	}
+	var id int
+	err = joinWaitlistStmt.QueryRow(e.ID, uid).Scan(&id)
+	if err == sql.ErrNoRows {
+		log.Printf("User [%d] is already waiting for event [%d]\n", uid, e.ID)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Already in waitlist of event [%d]", e.ID)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to add user [%d] to waitlist of event [%d]: %s\n", uid, e.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pos := 0
+	if err = waitlistPositionStmt.QueryRow(e.ID, waitlistWaiting, id).Scan(&pos); err != nil {
+		log.Printf("Failed to get waitlist position of user [%d] for event [%d]: %s\n", uid, e.ID, err)
+	}
+	log.Printf("User [%d] joined waitlist of event [%d] at position [%d]\n", uid, e.ID, pos)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, joinedTpl, e.ID, pos)
+	notify(r.Context(), spanCtx, uid, fmt.Sprintf("You joined the waitlist of event [%d] at position %d", e.ID, pos))
+}
+
+func leaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for leaving waitlist", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		log.Printf("Failed to get User ID: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	m := waitlistRequestModel{}
+	if err = json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		return
+	}
+	res, err := leaveWaitlistStmt.Exec(m.EventID, uid, waitlistWaiting)
+	if err != nil {
+		log.Printf("Failed to remove user [%d] from waitlist of event [%d]: %s\n", uid, m.EventID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+func getWaitlist(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for event's waitlist", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	id, ok := eventID(w, r)
+	if !ok {
+		return
+	}
+	rows, err := getWaitlistStmt.Query(id)
+	if err != nil {
+		log.Printf("Failed to get waitlist of event [%d]: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	entries := []waitlistEntryModel{}
+	for rows.Next() {
+		en := waitlistEntryModel{}
+		if err = rows.Scan(&en.ID, &en.UserID, &en.Status, &en.OrderID, &en.CreatedAt, &en.PromotedAt); err != nil {
+			log.Printf("Failed to scan waitlist entry of event [%d]: %s\n", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, en)
+	}
+	data, _ := json.MarshalIndent(entries, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// promoteWaitlist hands the slots freed for an event to the first waiting
+// users, at most as many as the event has available now. Every promoted user
+// gets a new order from orders, which then goes through payment on its own.
+func promoteWaitlist(ctx context.Context, spanCtx opentracing.SpanContext, eventID, freed int) {
+	span := tracer.StartSpan("promoting users from waitlist", opentracing.ChildOf(spanCtx))
+	defer span.Finish()
+
+	e, err := getEvent(eventID)
+	if err != nil {
+		log.Printf("Failed to get event [%d] for waitlist promotion: %s\n", eventID, err)
+		return
+	}
+	if !e.RegistrationOpen {
+		return
+	}
+	n := freed
+	if e.AvailableSlots < n {
+		n = e.AvailableSlots
+	}
+	if n <= 0 {
+		return
+	}
+	rows, err := promoteWaitlistStmt.Query(eventID, waitlistWaiting, waitlistPromoted, n)
+	if err != nil {
+		log.Printf("Failed to promote waitlist of event [%d]: %s\n", eventID, err)
+		return
+	}
+	promoted := map[int]int{}
+	for rows.Next() {
+		var id, uid int
+		if err = rows.Scan(&id, &uid); err != nil {
+			log.Printf("Failed to scan promoted waitlist entry: %s\n", err)
+			continue
+		}
+		promoted[id] = uid
+	}
+	rows.Close()
+	for id, uid := range promoted {
+		oid, err := sendPromotion(ctx, span.Context(), &waitlistPromotionModel{EventID: eventID, UserID: uid})
+		if err != nil {
+			log.Printf("Failed to create order for waitlisted user [%d] of event [%d]: %s\n", uid, eventID, err)
+			if _, err = demoteWaitlistStmt.Exec(id, waitlistWaiting); err != nil {
+				log.Printf("Failed to return user [%d] to waitlist of event [%d]: %s\n", uid, eventID, err)
+			}
+			continue
+		}
+		log.Printf("User [%d] was promoted from waitlist of event [%d] with order [%d]\n", uid, eventID, oid)
+		if _, err = bindWaitlistOrderStmt.Exec(id, oid); err != nil {
+			log.Printf("Failed to bind order [%d] to waitlist entry [%d]: %s\n", oid, id, err)
+		}
+	}
+}
+
+// promoteWaitlists runs the promotion for every event that got slots back.
+// It is detached from the request that freed them, since the promoted orders
+// call back into this service, so it has its own span following the
+// request's one.
+func promoteWaitlists(ctx context.Context, spanCtx opentracing.SpanContext, freed map[int]int) {
+	span := tracer.StartSpan("promoting waitlists", opentracing.FollowsFrom(spanCtx))
+	defer span.Finish()
+
+	for eventID, n := range freed {
+		promoteWaitlist(ctx, span.Context(), eventID, n)
+	}
+}
+
+// lapseWaitlistOrder ends the promotion whose order was cancelled before it
+// got paid and returns the event, zero when the order did not come from the
+// waitlist. The slot goes to the next waiting user: putting this one back in
+// front would promote them again right away and fail the same way, they may
+// join the waitlist again instead.
+func lapseWaitlistOrder(ctx context.Context, spanCtx opentracing.SpanContext, oid, uid, eventID int) int {
+	var eid int
+	err := lapseWaitlistStmt.QueryRow(oid, waitlistPromoted, waitlistLapsed, uid, eventID).Scan(&eid, &uid)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		log.Printf("Failed to lapse waitlist entry of order [%d]: %s\n", oid, err)
+		return 0
+	}
+	log.Printf("Order [%d] of user [%d] promoted from waitlist of event [%d] was cancelled\n", oid, uid, eid)
+	notify(ctx, spanCtx, uid, fmt.Sprintf("Order [%d] you got from the waitlist of event [%d] was cancelled, join the waitlist again to wait for another slot", oid, eid))
+	return eid
+}
+
+// sendPromotion is sent once, a repeat would create one more order.
+func sendPromotion(ctx context.Context, spanCtx opentracing.SpanContext, m *waitlistPromotionModel) (int, error) {
+	span := tracer.StartSpan("sending waitlist promotion", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	po := promotedOrderModel{}
+	_, err := ordersClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   orderWaitlistPath,
+		UserID: m.UserID,
+		Body:   m,
+	}, &po)
+	if err != nil {
+		return 0, err
+	}
+	return po.OrderID, nil
+}
+
+// notify sends a notification that is not bound to any order, so the
+// order id is left zero.
+func notify(ctx context.Context, spanCtx opentracing.SpanContext, uid int, message string) {
+	span := tracer.StartSpan("sending request for notify", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	_, err := notifClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   notifyPath,
+		UserID: uid,
+		Body:   notifyRequestModel{Message: message},
+	}, nil)
+	if err != nil {
+		log.Printf("Failed to send [%s] request for new notfy: %s", notifyPath, err)
+	}
+}
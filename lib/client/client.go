@@ -0,0 +1,249 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// The services call each other in a chain (an occupy waits for its callback
+// which waits for the payment), so the default timeout is a generous one.
+const (
+	DefaultTimeout          = 10 * time.Second
+	DefaultRetries          = 2
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+
+	retryBaseDelay = 100 * time.Millisecond
+)
+
+// ErrCircuitOpen is returned without calling the service while it keeps failing.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// StatusError is returned when the service answered with a non 2xx status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "got response status: " + e.Status
+}
+
+// Config describes one service. Zero timeout and breaker settings are
+// replaced with the defaults.
+type Config struct {
+	BaseURL          string
+	Timeout          time.Duration
+	Retries          int
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Request is a single call. Body is sent as JSON when it is not nil. Only
+// Idempotent requests are retried, any other one is sent exactly once.
+type Request struct {
+	Method     string
+	Path       string
+	UserID     int
+	Header     http.Header
+	Body       interface{}
+	Idempotent bool
+}
+
+// Response holds what is left of the answer once its body was decoded.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// Client calls one service with a timeout per attempt, retries with jitter
+// and a circuit breaker. Trace context is propagated in the headers.
+type Client struct {
+	cfg     Config
+	tracer  opentracing.Tracer
+	http    *http.Client
+	breaker *breaker
+}
+
+func New(tracer opentracing.Tracer, cfg Config) *Client {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = DefaultBreakerCooldown
+	}
+	return &Client{
+		cfg:     cfg,
+		tracer:  tracer,
+		http:    &http.Client{},
+		breaker: &breaker{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+	}
+}
+
+// Do sends the request and decodes a successful JSON answer into out unless
+// out is nil. A non 2xx answer is returned as *StatusError along with the
+// response, so callers can still look at its status and headers.
+func (c *Client) Do(ctx context.Context, spanCtx opentracing.SpanContext, r *Request, out interface{}) (*Response, error) {
+	opts := []opentracing.StartSpanOption{}
+	if spanCtx != nil {
+		opts = append(opts, opentracing.ChildOf(spanCtx))
+	}
+	span := c.tracer.StartSpan(r.Method+" "+r.Path, opts...)
+	defer span.Finish()
+	ext.SpanKindRPCClient.Set(span)
+	ext.HTTPMethod.Set(span, r.Method)
+	ext.HTTPUrl.Set(span, c.cfg.BaseURL+r.Path)
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = json.Marshal(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	attempts := 1
+	if r.Idempotent {
+		attempts += c.cfg.Retries
+	}
+	var resp *Response
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return resp, ctx.Err()
+			case <-time.After(backoff(i)):
+			}
+		}
+		if !c.breaker.allow() {
+			err = ErrCircuitOpen
+			break
+		}
+		resp, err = c.attempt(ctx, span, r, body, out)
+		c.breaker.done(!retryable(err))
+		if !retryable(err) {
+			break
+		}
+	}
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	if resp != nil {
+		ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+	}
+	return resp, err
+}
+
+func (c *Client) attempt(ctx context.Context, span opentracing.Span, r *Request, body []byte, out interface{}) (*Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, c.cfg.BaseURL+r.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.UserID != 0 {
+		req.Header.Set("X-User-Id", strconv.Itoa(r.UserID))
+	}
+	c.tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	hresp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	resp := &Response{StatusCode: hresp.StatusCode, Header: hresp.Header}
+	if hresp.StatusCode < 200 || hresp.StatusCode > 299 {
+		io.Copy(io.Discard, hresp.Body)
+		return resp, &StatusError{StatusCode: hresp.StatusCode, Status: hresp.Status}
+	}
+	if out != nil {
+		if err = json.NewDecoder(hresp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// retryable reports whether the failure is the service's fault: it could not
+// be reached, timed out or answered with a 5xx status.
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// backoff doubles the delay with every retry and picks a random point below
+// it, so callers that failed together don't retry together.
+func backoff(retry int) time.Duration {
+	max := retryBaseDelay << uint(retry)
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// breaker opens after threshold failures in a row and lets a single trial
+// call through once the cooldown has passed.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) done(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,8 @@
+module lib
+
+go 1.21
+
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/opentracing/opentracing-go v1.2.0
+)
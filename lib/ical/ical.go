@@ -0,0 +1,146 @@
+// Package ical writes events as an RFC 5545 iCalendar, for a single event
+// download and for the calendar feeds calendar apps subscribe to.
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	prodID    = "-//arch.homework//events//EN"
+	uidDomain = "arch.homework"
+	// maxLineLen is in octets, longer lines are folded
+	maxLineLen = 75
+	timeLayout = "20060102T150405Z"
+
+	ContentType = "text/calendar; charset=utf-8"
+)
+
+// Event is a VEVENT. The UID is made from the event id, so the event
+// downloaded alone and the same event in a feed are one entry in a calendar
+// app, and a moved or cancelled event replaces the entry instead of adding
+// one.
+type Event struct {
+	ID          int
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         *time.Time
+	Cancelled   bool
+	// Modified is when the event was last changed, calendar apps use it to
+	// tell a newer version of the event
+	Modified *time.Time
+}
+
+type Calendar struct {
+	Name string
+	// Refresh asks calendar apps subscribed to the feed to fetch it again
+	// this often, zero leaves it to them
+	Refresh time.Duration
+	Events  []Event
+}
+
+func UID(id int) string {
+	return fmt.Sprintf("event-%d@%s", id, uidDomain)
+}
+
+// Write writes the calendar, now stamps the events which don't know when
+// they were changed.
+func (c *Calendar) Write(w io.Writer, now time.Time) error {
+	b := &builder{}
+	b.line("BEGIN", "VCALENDAR")
+	b.line("VERSION", "2.0")
+	b.line("PRODID", prodID)
+	b.line("CALSCALE", "GREGORIAN")
+	if c.Name != "" {
+		b.line("X-WR-CALNAME", escape(c.Name))
+	}
+	if c.Refresh > 0 {
+		refresh := fmt.Sprintf("PT%dM", int(c.Refresh.Minutes()))
+		b.line("REFRESH-INTERVAL;VALUE=DURATION", refresh)
+		b.line("X-PUBLISHED-TTL", refresh)
+	}
+	for _, e := range c.Events {
+		stamp := now
+		if e.Modified != nil {
+			stamp = *e.Modified
+		}
+		b.line("BEGIN", "VEVENT")
+		b.line("UID", UID(e.ID))
+		b.line("DTSTAMP", formatTime(stamp))
+		b.line("DTSTART", formatTime(e.Start))
+		if e.End != nil {
+			b.line("DTEND", formatTime(*e.End))
+		}
+		b.line("SUMMARY", escape(e.Summary))
+		if e.Description != "" {
+			b.line("DESCRIPTION", escape(e.Description))
+		}
+		if e.Location != "" {
+			b.line("LOCATION", escape(e.Location))
+		}
+		if e.Cancelled {
+			b.line("STATUS", "CANCELLED")
+		} else {
+			b.line("STATUS", "CONFIRMED")
+		}
+		if e.Modified != nil {
+			b.line("LAST-MODIFIED", formatTime(*e.Modified))
+		}
+		b.line("END", "VEVENT")
+	}
+	b.line("END", "VCALENDAR")
+	_, err := w.Write(b.buf.Bytes())
+	return err
+}
+
+// Location joins the venue and the address, leaving out the empty one.
+func Location(venue, address string) string {
+	switch {
+	case venue == "":
+		return address
+	case address == "":
+		return venue
+	}
+	return venue + ", " + address
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+type builder struct {
+	buf bytes.Buffer
+}
+
+// line writes a content line ended with CRLF, folding it into several lines
+// which continue with a space. Folds don't split UTF-8 characters.
+func (b *builder) line(name, value string) {
+	s := name + ":" + value
+	limit := maxLineLen
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.buf.WriteString(s[:cut])
+		b.buf.WriteString("\r\n ")
+		s = s[cut:]
+		// the leading space of a continuation counts to its length
+		limit = maxLineLen - 1
+	}
+	b.buf.WriteString(s)
+	b.buf.WriteString("\r\n")
+}
@@ -0,0 +1,122 @@
+// Package servicetest is what the tests of the services share: a database
+// with the chart's schema and the requests the gateway would send.
+package servicetest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// DSNEnv names the database the tests that need one run against. The
+// chart's schema is loaded into it, dropping the service's tables, so it
+// must be a throwaway database. Without it those tests are skipped.
+const DSNEnv = "TEST_DSN"
+
+// Users of the tests, Admin makes requests with AdminRole.
+const (
+	Owner     = 1
+	Stranger  = 2
+	Admin     = 99
+	AdminRole = "admin"
+)
+
+// Caller makes a request and expects the status.
+type Caller struct {
+	Name string
+	UID  int
+	Role string
+	Want int
+}
+
+// AccessCallers try every resource of Owner: a stranger must not learn that
+// it exists, the owner and an admin get it.
+var AccessCallers = []Caller{
+	{Name: "stranger", UID: Stranger, Want: http.StatusNotFound},
+	{Name: "owner", UID: Owner, Want: http.StatusOK},
+	{Name: "admin", UID: Admin, Role: AdminRole, Want: http.StatusOK},
+}
+
+var (
+	setupOnce sync.Once
+	setupErr  error
+)
+
+// Setup runs setup against the test database once for all the tests of the
+// service and skips the test when there is no database.
+func Setup(t testing.TB, setup func(dsn string) error) {
+	t.Helper()
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", DSNEnv)
+	}
+	setupOnce.Do(func() { setupErr = setup(dsn) })
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+}
+
+// OpenDB connects to the database and loads the chart's schema from the
+// initdb job at path. The service registers the postgres driver.
+func OpenDB(dsn, path string) (*sql.DB, error) {
+	schema, err := ChartSchema(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load schema: %w", err)
+	}
+	return db, nil
+}
+
+// ChartSchema returns the SQL the chart's initdb job feeds to psql.
+func ChartSchema(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	in := false
+	for _, l := range strings.Split(string(data), "\n") {
+		switch t := strings.TrimSpace(l); {
+		case strings.HasSuffix(t, "<<'EOF'"):
+			in = true
+		case t == "EOF":
+			in = false
+		case in:
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return "", errors.New("no schema in " + path)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// NewRequest makes a request of the user with the role, vars are the route
+// variables mux would fill in.
+func NewRequest(method, target, body string, uid int, role string, vars map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("X-User-Id", strconv.Itoa(uid))
+	if role != "" {
+		r.Header.Set("X-User-Role", role)
+	}
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	return r
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -37,13 +38,17 @@ type configModel struct {
 const (
 	createNotifTpl = `INSERT INTO notif (user_id, order_id, message) VALUES ($1, $2, $3) returning id`
 	getNotifsTpl   = `SELECT order_id, message FROM notif WHERE user_id=$1`
-	getNotifTpl    = `SELECT message FROM notif WHERE user_id=$1 AND order_id=$2`
+	getNotifTpl    = `SELECT message FROM notif WHERE user_id=$1 AND order_id=$2 ORDER BY id DESC LIMIT 1`
+	getAnyNotifTpl = `SELECT message FROM notif WHERE order_id=$1 ORDER BY id DESC LIMIT 1`
 )
 
+const roleAdmin = "admin"
+
 var (
 	createNotifStmt *sql.Stmt
 	getNotifsStmt   *sql.Stmt
 	getNotifStmt    *sql.Stmt
+	getAnyNotifStmt *sql.Stmt
 	tracer          opentracing.Tracer
 	closer          io.Closer
 )
@@ -158,6 +163,11 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	getAnyNotifStmt, err = db.PrepareContext(ctx, getAnyNotifTpl)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func createNotif(uid int, n *notifModel) error {
@@ -169,13 +179,18 @@ func createNotif(uid int, n *notifModel) error {
 	return nil
 }
 
-func getNotif(uid, oid int) (*notifModel, error) {
+// getNotif returns the latest notification of the user about the order.
+// Several users may be notified about one order, a transfer notifies both
+// sides, so the lookup is scoped to the user; admins see the latest of all.
+func getNotif(r *http.Request, uid, oid int) (*notifModel, error) {
 	msg := new(string)
 	row := getNotifStmt.QueryRow(uid, oid)
-	if err := row.Err(); err != nil {
+	if isAdmin(r) {
+		row = getAnyNotifStmt.QueryRow(oid)
+	}
+	if err := row.Scan(msg); err != nil {
 		return nil, err
 	}
-	row.Scan(msg)
 	return &notifModel{OrderID: oid, Message: *msg}, nil
 }
 
@@ -251,10 +266,15 @@ func get(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var n *notifModel
-		n, err = getNotif(uid, oid)
+		n, err = getNotif(r, uid, oid)
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Could not find notification with order_id [%d] for user [%d]\n", oid, uid)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			log.Printf("Could not find event with order_id [%d]\n", oid)
-			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Failed to get notification with order_id [%d] for user [%d]: %s\n", oid, uid, err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		data, _ := json.MarshalIndent(n, "", "\t")
@@ -286,3 +306,7 @@ func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
 		h.ServeHTTP(w, r)
 	}
 }
+
+func isAdmin(r *http.Request) bool {
+	return r.Header.Get("X-User-Role") == roleAdmin
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"lib/servicetest"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// lastOrderID keeps the orders of the tests apart.
+var lastOrderID int64
+
+func setupTestDB(t *testing.T) {
+	servicetest.Setup(t, setupService)
+}
+
+func setupService(dsn string) error {
+	db, err := servicetest.OpenDB(dsn, "../chart/templates/initdb.yaml")
+	if err != nil {
+		return err
+	}
+	tracer = opentracing.NoopTracer{}
+	mustPrepareStmts(context.Background(), db)
+	return nil
+}
+
+// createTestNotif notifies the user about a new order and returns its id.
+func createTestNotif(t *testing.T, uid int) int {
+	t.Helper()
+	oid := int(atomic.AddInt64(&lastOrderID, 1))
+	if err := createNotif(uid, &notifModel{OrderID: oid, Message: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	return oid
+}
+
+func TestNotifAccess(t *testing.T) {
+	setupTestDB(t)
+
+	for _, c := range servicetest.AccessCallers {
+		t.Run(c.Name, func(t *testing.T) {
+			oid := strconv.Itoa(createTestNotif(t, servicetest.Owner))
+			w := httptest.NewRecorder()
+			get(w, servicetest.NewRequest(http.MethodGet, "/notif/get/"+oid, "", c.UID, c.Role, map[string]string{"id": oid}))
+			if w.Code != c.Want {
+				t.Errorf("status = %d, want %d", w.Code, c.Want)
+			}
+		})
+	}
+}
+
+func TestNotifListAccess(t *testing.T) {
+	setupTestDB(t)
+
+	oid := createTestNotif(t, servicetest.Owner)
+	for _, uid := range []int{servicetest.Owner, servicetest.Stranger} {
+		w := httptest.NewRecorder()
+		get(w, servicetest.NewRequest(http.MethodGet, "/notif/get", "", uid, "", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("user %d: status = %d", uid, w.Code)
+		}
+		var notifs []notifModel
+		if err := json.Unmarshal(w.Body.Bytes(), &notifs); err != nil {
+			t.Fatal(err)
+		}
+		listed := false
+		for _, n := range notifs {
+			listed = listed || n.OrderID == oid
+		}
+		if listed != (uid == servicetest.Owner) {
+			t.Errorf("user %d: notification listed = %t", uid, listed)
+		}
+	}
+}
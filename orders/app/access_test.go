@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"lib/servicetest"
+)
+
+func TestOrderAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		// path has the order id in place of %d
+		path   string
+		body   string
+		status int
+	}{
+		{name: "get", handler: get, method: http.MethodGet, path: "/orders/get/%d", status: statusNeedToPay},
+		{name: "history", handler: getHistory, method: http.MethodGet, path: "/orders/get/%d/history", status: statusNeedToPay},
+		{name: "ticket", handler: getTicket, method: http.MethodGet, path: "/orders/ticket/%d", status: StatusPaid},
+		{name: "cancel", handler: requestCancel, method: http.MethodPost, path: "/orders/cancel/%d", status: statusNeedToPay},
+		{name: "transfer", handler: offerTransfer, method: http.MethodPost, path: "/orders/%d/transfer", body: `{"login":"recipient"}`, status: StatusPaid},
+	}
+	for _, tt := range tests {
+		for _, c := range servicetest.AccessCallers {
+			t.Run(tt.name+"/"+c.Name, func(t *testing.T) {
+				oid := createTestOrder(t, servicetest.Owner, tt.status)
+				r := servicetest.NewRequest(tt.method, fmt.Sprintf(tt.path, oid), tt.body, c.UID, c.Role, map[string]string{"id": strconv.Itoa(oid)})
+				w := httptest.NewRecorder()
+				tt.handler(w, r)
+				if w.Code != c.Want {
+					t.Errorf("status = %d, want %d: %s", w.Code, c.Want, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestOrderListAccess(t *testing.T) {
+	setupTestDB(t)
+
+	oid := createTestOrder(t, servicetest.Owner, statusNeedToPay)
+	for _, c := range servicetest.AccessCallers {
+		t.Run(c.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			get(w, servicetest.NewRequest(http.MethodGet, "/orders/get?limit=100", "", c.UID, c.Role, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			page := ordersPageModel{}
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			listed := false
+			for _, o := range page.Orders {
+				listed = listed || o.ID == oid
+				if c.Role != roleAdmin && o.UserID != c.UID {
+					t.Errorf("order [%d] of user [%d] is listed", o.ID, o.UserID)
+				}
+			}
+			if want := c.Want == http.StatusOK; listed != want {
+				t.Errorf("order listed = %t, want %t", listed, want)
+			}
+		})
+	}
+}
+
+// TestTransferAccess resolves transfers as their parties and as a stranger.
+// Transfers are personal, an admin is a stranger to them as well.
+func TestTransferAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name   string
+		uid    int
+		role   string
+		action string
+		want   int
+	}{
+		{name: "stranger accepts", uid: servicetest.Stranger, action: "accept", want: http.StatusNotFound},
+		{name: "stranger declines", uid: servicetest.Stranger, action: "decline", want: http.StatusNotFound},
+		{name: "admin declines", uid: servicetest.Admin, role: roleAdmin, action: "decline", want: http.StatusNotFound},
+		{name: "sender accepts", uid: servicetest.Owner, action: "accept", want: http.StatusForbidden},
+		{name: "sender cancels", uid: servicetest.Owner, action: "decline", want: http.StatusOK},
+		{name: "recipient declines", uid: testRecipient, action: "decline", want: http.StatusOK},
+		{name: "recipient accepts", uid: testRecipient, action: "accept", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oid := createTestOrder(t, servicetest.Owner, StatusPaid)
+			var tid int
+			if err := createTransferStmt.QueryRow(oid, servicetest.Owner, testRecipient).Scan(&tid); err != nil {
+				t.Fatal(err)
+			}
+			vars := map[string]string{"id": strconv.Itoa(tid), "action": tt.action}
+			r := servicetest.NewRequest(http.MethodPost, fmt.Sprintf("/orders/transfers/%d/%s", tid, tt.action), "", tt.uid, tt.role, vars)
+			w := httptest.NewRecorder()
+			resolveTransfer(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"lib/client"
+	"lib/ical"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	getCalendarTokenTpl    = `SELECT token FROM calendar_feeds WHERE user_id=$1`
+	createCalendarTokenTpl = `INSERT INTO calendar_feeds (user_id, token) VALUES ($1, $2) ON CONFLICT (user_id) DO NOTHING`
+	resetCalendarTokenTpl  = `INSERT INTO calendar_feeds (user_id, token) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET token=EXCLUDED.token, created_at=now()`
+	calendarUserTpl        = `SELECT user_id FROM calendar_feeds WHERE token=$1`
+	calendarEventsTpl      = `SELECT i.event_id, bool_or(o.status IN ($2, $3)) FROM orders o JOIN order_items i ON i.order_id=o.id WHERE o.user_id=$1 AND o.status IN ($2, $3, $4) GROUP BY i.event_id ORDER BY i.event_id`
+	calendarFeedPath       = "/orders/calendar/feed/"
+	calendarName           = "My events"
+	calendarRefresh        = time.Hour
+)
+
+var (
+	getCalendarTokenStmt    *sql.Stmt
+	createCalendarTokenStmt *sql.Stmt
+	resetCalendarTokenStmt  *sql.Stmt
+	calendarUserStmt        *sql.Stmt
+	calendarEventsStmt      *sql.Stmt
+)
+
+type calendarFeedModel struct {
+	URL string `json:"url"`
+}
+
+func mustPrepareCalendarStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	getCalendarTokenStmt, err = db.PrepareContext(ctx, getCalendarTokenTpl)
+	if err != nil {
+		panic(err)
+	}
+	createCalendarTokenStmt, err = db.PrepareContext(ctx, createCalendarTokenTpl)
+	if err != nil {
+		panic(err)
+	}
+	resetCalendarTokenStmt, err = db.PrepareContext(ctx, resetCalendarTokenTpl)
+	if err != nil {
+		panic(err)
+	}
+	calendarUserStmt, err = db.PrepareContext(ctx, calendarUserTpl)
+	if err != nil {
+		panic(err)
+	}
+	calendarEventsStmt, err = db.PrepareContext(ctx, calendarEventsTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newCalendarToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// calendarToken returns the feed token of the user, making one the first
+// time.
+func calendarToken(uid int) (string, error) {
+	var token string
+	err := getCalendarTokenStmt.QueryRow(uid).Scan(&token)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return token, err
+	}
+	if token, err = newCalendarToken(); err != nil {
+		return "", err
+	}
+	if _, err = createCalendarTokenStmt.Exec(uid, token); err != nil {
+		return "", err
+	}
+	// a concurrent request may have made the token first
+	err = getCalendarTokenStmt.QueryRow(uid).Scan(&token)
+	return token, err
+}
+
+// calendarFeedURL is the address calendar apps fetch the feed from, they
+// can't log in, so it is not behind the auth.
+func calendarFeedURL(r *http.Request, token string) string {
+	scheme := "http"
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s%s%s.ics", scheme, r.Host, calendarFeedPath, token)
+}
+
+func (e *eventInfoModel) calendarEvent() ical.Event {
+	return ical.Event{
+		ID:          e.ID,
+		Summary:     e.Name,
+		Description: e.Description,
+		Location:    ical.Location(e.Venue, e.Address),
+		Start:       *e.StartsAt,
+		End:         e.EndsAt,
+		Cancelled:   e.Status == eventCancelled,
+		Modified:    e.UpdatedAt,
+	}
+}
+
+// calendarEvents returns the events the user holds paid orders for and the
+// cancelled events the user had orders for, so calendar apps show them as
+// cancelled. Events without a start are left out.
+func calendarEvents(ctx context.Context, spanCtx opentracing.SpanContext, uid int) ([]ical.Event, error) {
+	rows, err := calendarEventsStmt.Query(uid, StatusPaid, statusCompleted, statusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	paid := map[int]bool{}
+	ids := []int{}
+	for rows.Next() {
+		var eid int
+		var p bool
+		if err = rows.Scan(&eid, &p); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, eid)
+		paid[eid] = p
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	res := []ical.Event{}
+	for _, eid := range ids {
+		e, err := getEventInfo(ctx, spanCtx, uid, eid)
+		var se *client.StatusError
+		if errors.As(err, &se) && se.StatusCode < 500 {
+			continue
+		}
+		if err != nil {
+			// a partial feed would make calendar apps drop the missing
+			// events, failing keeps the copy they have
+			return nil, err
+		}
+		if e.StartsAt == nil || (!paid[eid] && e.Status != eventCancelled) {
+			continue
+		}
+		res = append(res, e.calendarEvent())
+	}
+	return res, nil
+}
+
+// getCalendar handles GET /orders/calendar, the private feed URL of the
+// user.
+func getCalendar(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for calendar feed url", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := calendarToken(uid)
+	if err != nil {
+		log.Printf("Failed to get calendar token of user [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(calendarFeedModel{URL: calendarFeedURL(r, token)})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// resetCalendar handles POST /orders/calendar/reset, the old feed URL stops
+// working.
+func resetCalendar(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for resetting calendar feed url", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := newCalendarToken()
+	if err == nil {
+		_, err = resetCalendarTokenStmt.Exec(uid, token)
+	}
+	if err != nil {
+		log.Printf("Failed to reset calendar token of user [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Calendar feed of user [%d] was reset\n", uid)
+	data, _ := json.Marshal(calendarFeedModel{URL: calendarFeedURL(r, token)})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getCalendarFeed handles GET /orders/calendar/feed/{token}.ics. The token
+// is the only check, the feed is built from the current orders and events
+// on every fetch, so moved and cancelled events reach the calendar apps
+// with their next refresh.
+func getCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for calendar feed", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	var uid int
+	err := calendarUserStmt.QueryRow(mux.Vars(r)["token"]).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to find calendar feed: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	events, err := calendarEvents(r.Context(), span.Context(), uid)
+	if err != nil {
+		log.Printf("Failed to get calendar events of user [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	c := ical.Calendar{Name: calendarName, Refresh: calendarRefresh, Events: events}
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if err = c.Write(w, time.Now()); err != nil {
+		log.Printf("Failed to write calendar feed of user [%d]: %s\n", uid, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	addCartItemTpl    = `INSERT INTO cart_items (user_id, event_id, quantity, ticket_type_id) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, event_id, ticket_type_id) DO UPDATE SET quantity=cart_items.quantity+EXCLUDED.quantity`
+	removeCartItemTpl = `DELETE FROM cart_items WHERE user_id=$1 AND event_id=$2 AND ticket_type_id=$3`
+	getCartItemsTpl   = `SELECT event_id, quantity, ticket_type_id FROM cart_items WHERE user_id=$1 ORDER BY event_id, ticket_type_id FOR UPDATE`
+	clearCartTpl      = `DELETE FROM cart_items WHERE user_id=$1`
+)
+
+var (
+	addCartItemStmt    *sql.Stmt
+	removeCartItemStmt *sql.Stmt
+	getCartItemsStmt   *sql.Stmt
+	clearCartStmt      *sql.Stmt
+)
+
+func mustPrepareCartStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	addCartItemStmt, err = db.PrepareContext(ctx, addCartItemTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	removeCartItemStmt, err = db.PrepareContext(ctx, removeCartItemTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getCartItemsStmt, err = db.PrepareContext(ctx, getCartItemsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	clearCartStmt, err = db.PrepareContext(ctx, clearCartTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func getCartItems(q *sql.Stmt, uid int) ([]orderItemModel, error) {
+	rows, err := q.Query(uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []orderItemModel{}
+	for rows.Next() {
+		it := orderItemModel{}
+		if err = rows.Scan(&it.EventID, &it.Quantity, &it.TicketTypeID); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// checkoutCart turns the user's cart into a new order and empties the cart.
+func checkoutCart(ctx context.Context, spanCtx opentracing.SpanContext, uid int, role string) (int, error) {
+	span := tracer.StartSpan("creating order from cart", opentracing.ChildOf(spanCtx))
+	defer span.Finish()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	items, err := getCartItems(tx.Stmt(getCartItemsStmt), uid)
+	if err != nil {
+		return 0, err
+	}
+	o := orderModel{Items: items, Role: role}
+	if err = normalizeItems(&o); err != nil {
+		return 0, err
+	}
+	oid, err := orderTx(tx, uid, &o)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.Stmt(clearCartStmt).Exec(uid); err != nil {
+		return 0, err
+	}
+	return oid, tx.Commit()
+}
+
+func getCart(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("getting user's cart", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to get user id: %s\n", err)
+		return
+	}
+	items, err := getCartItems(getCartItemsStmt, uid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to get cart of user [%d]: %s\n", uid, err)
+		return
+	}
+	data, _ := json.MarshalIndent(items, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func addToCart(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("adding item to user's cart", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to get user id: %s\n", err)
+		return
+	}
+	it := orderItemModel{}
+	if err = json.NewDecoder(r.Body).Decode(&it); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		return
+	}
+	if it.Quantity == 0 {
+		it.Quantity = 1
+	}
+	if it.EventID == 0 || it.Quantity < 0 || it.TicketTypeID < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Got wrong cart item for event [%d] with quantity [%d]\n", it.EventID, it.Quantity)
+		return
+	}
+	if len(it.SeatIDs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Seats can't be kept in the cart, they are assigned on checkout or picked in the order")
+		return
+	}
+	if _, err = addCartItemStmt.Exec(uid, it.EventID, it.Quantity, it.TicketTypeID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to add event [%d] to cart of user [%d]: %s\n", it.EventID, uid, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+func removeFromCart(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("removing item from user's cart", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to get user id: %s\n", err)
+		return
+	}
+	it := orderItemModel{}
+	if err = json.NewDecoder(r.Body).Decode(&it); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id [%d]: %s\n", uid, err)
+		return
+	}
+	res, err := removeCartItemStmt.Exec(uid, it.EventID, it.TicketTypeID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to remove event [%d] from cart of user [%d]: %s\n", it.EventID, uid, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+func checkout(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("checking out user's cart", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to get user id: %s\n", err)
+		return
+	}
+	oid, err := checkoutCart(r.Context(), spanCtx, uid, r.Header.Get("X-User-Role"))
+	if err != nil {
+		log.Printf("Failed to checkout cart of user [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Printf("Successfully ordered cart for user [%d]\n", uid)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "order_id":%d}`, oid)
+	if err = actionOrderStatus(r.Context(), spanCtx, oid); err != nil {
+		log.Printf("Failed to perform action based on order's status: %s\n", err)
+	}
+}
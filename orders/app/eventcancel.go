@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	eventOrdersTpl      = `SELECT DISTINCT order_id FROM order_items WHERE event_id=$1 ORDER BY order_id`
+	countEventOrdersTpl = `SELECT COUNT(DISTINCT order_id) FROM order_items WHERE event_id=$1`
+	// the order's price is net of the promo discount and a cancelled order
+	// keeps only what was not refunded, both are split between the items in
+	// proportion to their gross price
+	eventSalesTpl = `SELECT i.event_id, COUNT(DISTINCT o.id) FILTER (WHERE o.status IN ($2, $3)), COUNT(DISTINCT o.id) FILTER (WHERE o.status=$4), COALESCE(SUM(ROUND(i.price * i.quantity * (CASE WHEN o.status=$4 THEN o.kept ELSE o.price END)::numeric / NULLIF(o.price + o.discount, 0))) FILTER (WHERE o.status IN ($2, $3, $4)), 0)::integer FROM order_items i JOIN orders o ON o.id=i.order_id WHERE i.event_id = ANY($1) GROUP BY i.event_id ORDER BY i.event_id`
+)
+
+var (
+	eventOrdersStmt      *sql.Stmt
+	countEventOrdersStmt *sql.Stmt
+	eventSalesStmt       *sql.Stmt
+)
+
+type eventOrdersModel struct {
+	Orders    int `json:"orders"`
+	Cancelled int `json:"cancelled"`
+}
+
+// eventSalesModel counts the paid and the cancelled orders of the event,
+// the revenue is what was charged for its items and not refunded.
+type eventSalesModel struct {
+	EventID   int `json:"event_id"`
+	Orders    int `json:"orders"`
+	Cancelled int `json:"cancelled"`
+	Revenue   int `json:"revenue"`
+}
+
+func mustPrepareEventCancelStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	eventOrdersStmt, err = db.PrepareContext(ctx, eventOrdersTpl)
+	if err != nil {
+		panic(err)
+	}
+	countEventOrdersStmt, err = db.PrepareContext(ctx, countEventOrdersTpl)
+	if err != nil {
+		panic(err)
+	}
+	eventSalesStmt, err = db.PrepareContext(ctx, eventSalesTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// activeEventOrders returns the orders of the event that can still be
+// cancelled.
+func activeEventOrders(eid int) ([]*orderModel, error) {
+	rows, err := eventOrdersStmt.Query(eid)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	res := []*orderModel{}
+	for _, id := range ids {
+		o, err := getOrder(id)
+		if err != nil {
+			return nil, err
+		}
+		if canTransition(o.Status, statusCancelled) {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+// cancelEventOrder cancels an order of a cancelled event. Paid orders are
+// refunded in full whatever the refund policy says, orders with several
+// events are cancelled as a whole.
+func cancelEventOrder(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel, eid int) error {
+	if err := cancelOrder(spanCtx, o.ID, o.Status, actorEvents, "event was cancelled"); err != nil {
+		return err
+	}
+	if err := cancelSlot(ctx, spanCtx, o); err != nil {
+		log.Printf("Failed to cancel slot [%d]: %s\n", o.ID, err)
+	}
+	refund := 0
+	if o.Status == StatusPaid {
+		refund = o.Price
+		if err := refundOrder(ctx, spanCtx, &orderModel{ID: o.ID, UserID: o.payer(), Price: refund}); err != nil {
+			// the reconciliation returns the money later
+			log.Printf("Failed to refund order [%d]: %s\n", o.ID, err)
+		}
+	}
+	notify(ctx, spanCtx, o.UserID, o.ID, fmt.Sprintf("Event [%d] was cancelled, order was cancelled with refund %d", eid, refund))
+	return nil
+}
+
+func cancelEventOrders(ctx context.Context, spanCtx opentracing.SpanContext, eid int, orders []*orderModel) {
+	span := tracer.StartSpan("cancelling orders of event", opentracing.ChildOf(spanCtx))
+	defer span.Finish()
+
+	for _, o := range orders {
+		if err := cancelEventOrder(ctx, span.Context(), o, eid); err != nil {
+			// an order moved on meanwhile, repeating the cancel of the event
+			// picks it up again
+			log.Printf("Failed to cancel order [%d] of event [%d]: %s\n", o.ID, eid, err)
+		}
+	}
+	log.Printf("Orders of event [%d] were cancelled\n", eid)
+}
+
+// getEventOrders handles GET /orders/admin/events/{id}, events asks it
+// before deleting an event.
+func getEventOrders(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for orders of event", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	eid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	res := eventOrdersModel{}
+	if err = countEventOrdersStmt.QueryRow(eid).Scan(&res.Orders); err != nil {
+		log.Printf("Failed to count orders of event [%d]: %s\n", eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(res)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// cancelEvent handles POST /orders/admin/events/{id}/cancel. The orders are
+// cancelled and refunded in the background, the answer carries how many.
+func cancelEvent(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for cancelling orders of event", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	eid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	orders, err := activeEventOrders(eid)
+	if err != nil {
+		log.Printf("Failed to get orders of event [%d]: %s\n", eid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// the orders are cancelled after the response, past the request's end
+	go cancelEventOrders(context.WithoutCancel(r.Context()), span.Context(), eid, orders)
+
+	data, _ := json.Marshal(eventOrdersModel{Orders: len(orders), Cancelled: len(orders)})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func getEventSalesOf(ids []int64) ([]eventSalesModel, error) {
+	rows, err := eventSalesStmt.Query(pq.Int64Array(ids), StatusPaid, statusCompleted, statusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []eventSalesModel{}
+	for rows.Next() {
+		s := eventSalesModel{}
+		if err = rows.Scan(&s.EventID, &s.Orders, &s.Cancelled, &s.Revenue); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// getEventSales handles GET /orders/admin/event-sales?ids=1,2, events asks
+// it for the organizer's dashboard. Events without orders are left out.
+func getEventSales(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for sales of events", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ids := []int64{}
+	for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "ids must be event ids separated by commas")
+			return
+		}
+		ids = append(ids, id)
+	}
+	res, err := getEventSalesOf(ids)
+	if err != nil {
+		log.Printf("Failed to get sales of events %v: %s\n", ids, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(res)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// Actors recorded in the order's history: the service (or the user) whose
+// action caused the status transition.
+const (
+	actorUser    = "user"
+	actorOrders  = "orders"
+	actorEvents  = "events"
+	actorAccount = "account"
+	actorAdmin   = "admin"
+	actorStaff   = "staff"
+)
+
+type statusChangeModel struct {
+	FromStatus     *int      `json:"from_status"`
+	FromStatusName string    `json:"from_status_name,omitempty"`
+	ToStatus       int       `json:"to_status"`
+	ToStatusName   string    `json:"to_status_name"`
+	Actor          string    `json:"actor"`
+	Reason         string    `json:"reason"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+const (
+	addHistoryTpl = `INSERT INTO order_status_history (order_id, from_status, to_status, actor, reason) VALUES ($1, NULL, $2, $3, $4)`
+	getHistoryTpl = `SELECT from_status, to_status, actor, reason, created_at FROM order_status_history WHERE order_id=$1 ORDER BY id`
+)
+
+var (
+	addHistoryStmt *sql.Stmt
+	getHistoryStmt *sql.Stmt
+)
+
+func mustPrepareHistoryStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	addHistoryStmt, err = db.PrepareContext(ctx, addHistoryTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getHistoryStmt, err = db.PrepareContext(ctx, getHistoryTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func getOrderHistory(oid int) ([]statusChangeModel, error) {
+	rows, err := getHistoryStmt.Query(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []statusChangeModel{}
+	for rows.Next() {
+		h := statusChangeModel{}
+		from := sql.NullInt64{}
+		if err = rows.Scan(&from, &h.ToStatus, &h.Actor, &h.Reason, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		if from.Valid {
+			f := int(from.Int64)
+			h.FromStatus = &f
+			h.FromStatusName = statusName(f)
+		}
+		h.ToStatusName = statusName(h.ToStatus)
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("getting order's status history", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	oid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("Failed to parse request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o, err := getOrder(oid)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d]\n", oid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	history, err := getOrderHistory(oid)
+	if err != nil {
+		log.Printf("Failed to get history of order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.MarshalIndent(history, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
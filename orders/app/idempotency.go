@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// a key is (re)reserved only when it is new or its previous use has expired
+	reserveIdempotencyKeyTpl = `INSERT INTO idempotency_keys (user_id, key, fingerprint) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, key) DO UPDATE SET fingerprint=EXCLUDED.fingerprint, order_id=NULL, created_at=now()
+		WHERE idempotency_keys.created_at < $4
+		RETURNING key`
+	getIdempotencyKeyTpl     = `SELECT fingerprint, COALESCE(order_id, 0) FROM idempotency_keys WHERE user_id=$1 AND key=$2`
+	bindIdempotencyKeyTpl    = `UPDATE idempotency_keys SET order_id=$3 WHERE user_id=$1 AND key=$2`
+	releaseIdempotencyKeyTpl = `DELETE FROM idempotency_keys WHERE user_id=$1 AND key=$2 AND order_id IS NULL`
+	expireIdempotencyKeysTpl = `DELETE FROM idempotency_keys WHERE created_at < $1`
+	replayedTpl              = `{"success":true, "order_id":%d, "status":%d}`
+	idempotencyKeyHeader     = "Idempotency-Key"
+	defaultIdempotencyTTL    = 24 * time.Hour
+)
+
+var (
+	reserveIdempotencyKeyStmt *sql.Stmt
+	getIdempotencyKeyStmt     *sql.Stmt
+	bindIdempotencyKeyStmt    *sql.Stmt
+	releaseIdempotencyKeyStmt *sql.Stmt
+	expireIdempotencyKeysStmt *sql.Stmt
+	idempotencyTTL            = defaultIdempotencyTTL
+)
+
+func mustPrepareIdempotencyStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	reserveIdempotencyKeyStmt, err = db.PrepareContext(ctx, reserveIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getIdempotencyKeyStmt, err = db.PrepareContext(ctx, getIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	bindIdempotencyKeyStmt, err = db.PrepareContext(ctx, bindIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	releaseIdempotencyKeyStmt, err = db.PrepareContext(ctx, releaseIdempotencyKeyTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	expireIdempotencyKeysStmt, err = db.PrepareContext(ctx, expireIdempotencyKeysTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func fingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// reserveIdempotencyKey returns false when the key is already held by an
+// earlier, not yet expired request of the same user.
+func reserveIdempotencyKey(uid int, key, fp string) (bool, error) {
+	var k string
+	err := reserveIdempotencyKeyStmt.QueryRow(uid, key, fp, time.Now().Add(-idempotencyTTL)).Scan(&k)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func getIdempotencyKey(uid int, key string) (string, int, error) {
+	var fp string
+	var oid int
+	err := getIdempotencyKeyStmt.QueryRow(uid, key).Scan(&fp, &oid)
+	return fp, oid, err
+}
+
+// bindIdempotencyKeyTx points the key at the order created in tx, so a key
+// is never left in progress for an order that exists.
+func bindIdempotencyKeyTx(tx *sql.Tx, uid int, key string, oid int) error {
+	_, err := tx.Stmt(bindIdempotencyKeyStmt).Exec(uid, key, oid)
+	return err
+}
+
+func releaseIdempotencyKey(uid int, key string) error {
+	_, err := releaseIdempotencyKeyStmt.Exec(uid, key)
+	return err
+}
+
+// replayOrder answers a repeated create request with the order created by
+// the first request that used the same key.
+func replayOrder(w http.ResponseWriter, uid int, key, fp string) {
+	storedFp, oid, err := getIdempotencyKey(uid, key)
+	if err != nil {
+		log.Printf("Failed to get idempotency key [%s] for user [%d]: %s\n", key, uid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if storedFp != fp {
+		log.Printf("Idempotency key [%s] of user [%d] was reused with another request body\n", key, uid)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Idempotency key [%s] was already used with another request", key)
+		return
+	}
+	if oid == 0 {
+		log.Printf("Request with idempotency key [%s] of user [%d] is still in progress\n", key, uid)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	o, err := getOrder(oid)
+	if err != nil {
+		log.Printf("Failed to get order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Replayed order [%d] for idempotency key [%s] of user [%d]\n", oid, key, uid)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, replayedTpl, o.ID, o.Status)
+}
+
+func expireIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := expireIdempotencyKeysStmt.Exec(time.Now().Add(-idempotencyTTL)); err != nil {
+				log.Printf("Failed to expire idempotency keys: %s\n", err)
+			}
+		}
+	}
+}
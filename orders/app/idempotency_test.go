@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"lib/servicetest"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestOrderBindsIdempotencyKey(t *testing.T) {
+	setupTestDB(t)
+
+	key := t.Name()
+	if ok, err := reserveIdempotencyKey(servicetest.Owner, key, "fp"); err != nil || !ok {
+		t.Fatalf("reserveIdempotencyKey() = %t, %v", ok, err)
+	}
+	o := orderModel{EventID: 1, Items: []orderItemModel{{EventID: 1, Quantity: 1}}}
+	oid, err := order(opentracing.NoopTracer{}.StartSpan("test").Context(), servicetest.Owner, &o, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bound, err := getIdempotencyKey(servicetest.Owner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound != oid {
+		t.Errorf("key is bound to order [%d], want [%d]", bound, oid)
+	}
+}
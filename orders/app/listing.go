@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	listOrdersTpl     = `SELECT id, user_id, event_id, price, status, created_at, updated_at FROM orders`
+	listOrderItemsTpl = `SELECT order_id, event_id, quantity, price, ticket_type_id, seat_ids, seats, pricing_rule FROM order_items WHERE order_id = ANY($1) ORDER BY id`
+	defaultOrdersPage = 20
+	maxOrdersPage     = 100
+	sortByDate        = "date"
+	sortByPrice       = "price"
+)
+
+var (
+	listOrderItemsStmt *sql.Stmt
+)
+
+type ordersPageModel struct {
+	Orders     []orderModel `json:"orders"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// orderCursor points right after the last order of a page. It remembers the
+// sorting it was issued for, so it can't be replayed against another one.
+type orderCursor struct {
+	SortBy string `json:"s"`
+	Desc   bool   `json:"d"`
+	Value  string `json:"v"`
+	ID     int    `json:"id"`
+}
+
+type orderFilter struct {
+	userID  int // 0 lists orders of all users, admins only
+	status  *int
+	eventID int
+	from    *time.Time
+	to      *time.Time
+	sortBy  string
+	desc    bool
+	limit   int // 0 lists every order
+	after   *orderCursor
+	// paged is set by limit or cursor, only a paged listing is limited and
+	// answered with a page
+	paged bool
+}
+
+func mustPrepareListingStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	listOrderItemsStmt, err = db.PrepareContext(ctx, listOrderItemsTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// parseOrderFilter reads the listing query: status, event_id, from and to
+// (RFC 3339 creation time range), sort (date or price), order (asc or desc),
+// limit and cursor. Admins get all users' orders unless user_id is given.
+// Without limit and cursor every order is listed.
+func parseOrderFilter(r *http.Request) (*orderFilter, error) {
+	uid, err := getUserID(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	f := &orderFilter{userID: uid, sortBy: sortByDate, desc: true}
+	if f.paged = q.Get("limit") != "" || q.Get("cursor") != ""; f.paged {
+		f.limit = defaultOrdersPage
+	}
+	if isAdmin(r) {
+		f.userID = 0
+		if v := q.Get("user_id"); v != "" {
+			if f.userID, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("wrong user_id: %w", err)
+			}
+		}
+	}
+	if v := q.Get("status"); v != "" {
+		status, err := parseStatus(v)
+		if err != nil {
+			return nil, err
+		}
+		f.status = &status
+	}
+	if v := q.Get("event_id"); v != "" {
+		if f.eventID, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("wrong event_id: %w", err)
+		}
+	}
+	if v := q.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("wrong from: %w", err)
+		}
+		f.from = &from
+	}
+	if v := q.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("wrong to: %w", err)
+		}
+		f.to = &to
+	}
+	switch v := q.Get("sort"); v {
+	case "", sortByDate:
+	case sortByPrice:
+		f.sortBy = sortByPrice
+	default:
+		return nil, fmt.Errorf("wrong sort [%s]", v)
+	}
+	switch v := q.Get("order"); v {
+	case "", "desc":
+	case "asc":
+		f.desc = false
+	default:
+		return nil, fmt.Errorf("wrong order [%s]", v)
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit <= 0 {
+			return nil, fmt.Errorf("wrong limit [%s]", v)
+		}
+		if f.limit > maxOrdersPage {
+			f.limit = maxOrdersPage
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		if f.after, err = decodeOrderCursor(v); err != nil {
+			return nil, err
+		}
+		if f.after.SortBy != f.sortBy || f.after.Desc != f.desc {
+			return nil, errors.New("cursor was issued for another sorting")
+		}
+	}
+	return f, nil
+}
+
+func decodeOrderCursor(s string) (*orderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("wrong cursor: %w", err)
+	}
+	c := &orderCursor{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("wrong cursor: %w", err)
+	}
+	return c, nil
+}
+
+func encodeOrderCursor(f *orderFilter, o *orderModel) string {
+	c := orderCursor{SortBy: f.sortBy, Desc: f.desc, ID: o.ID}
+	if f.sortBy == sortByPrice {
+		c.Value = strconv.Itoa(o.Price)
+	} else {
+		c.Value = o.CreatedAt.Format(time.RFC3339Nano)
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// query builds the listing statement. One more row than the page size is
+// requested to learn whether there is a next page.
+func (f *orderFilter) query() (string, []interface{}, error) {
+	conds := []string{}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if f.userID != 0 {
+		conds = append(conds, "user_id="+arg(f.userID))
+	}
+	if f.status != nil {
+		conds = append(conds, "status="+arg(*f.status))
+	}
+	if f.eventID != 0 {
+		conds = append(conds, "id IN (SELECT order_id FROM order_items WHERE event_id="+arg(f.eventID)+")")
+	}
+	if f.from != nil {
+		conds = append(conds, "created_at >= "+arg(*f.from))
+	}
+	if f.to != nil {
+		conds = append(conds, "created_at < "+arg(*f.to))
+	}
+	col := "created_at"
+	if f.sortBy == sortByPrice {
+		col = "price"
+	}
+	dir, cmp := "ASC", ">"
+	if f.desc {
+		dir, cmp = "DESC", "<"
+	}
+	if f.after != nil {
+		var v interface{}
+		if f.sortBy == sortByPrice {
+			price, err := strconv.Atoi(f.after.Value)
+			if err != nil {
+				return "", nil, fmt.Errorf("wrong cursor: %w", err)
+			}
+			v = price
+		} else {
+			t, err := time.Parse(time.RFC3339Nano, f.after.Value)
+			if err != nil {
+				return "", nil, fmt.Errorf("wrong cursor: %w", err)
+			}
+			v = t
+		}
+		conds = append(conds, fmt.Sprintf("(%s, id) %s (%s, %s)", col, cmp, arg(v), arg(f.after.ID)))
+	}
+	q := listOrdersTpl
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	q += fmt.Sprintf(" ORDER BY %s %s, id %s", col, dir, dir)
+	if f.limit > 0 {
+		q += " LIMIT " + arg(f.limit+1)
+	}
+	return q, args, nil
+}
+
+func listOrders(f *orderFilter) (*ordersPageModel, error) {
+	q, args, err := f.query()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := &ordersPageModel{Orders: make([]orderModel, 0, f.limit)}
+	for rows.Next() {
+		o := orderModel{}
+		if err = rows.Scan(&o.ID, &o.UserID, &o.EventID, &o.Price, &o.Status, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		o.StatusName = statusName(o.Status)
+		page.Orders = append(page.Orders, o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if f.limit > 0 && len(page.Orders) > f.limit {
+		page.Orders = page.Orders[:f.limit]
+		page.NextCursor = encodeOrderCursor(f, &page.Orders[f.limit-1])
+	}
+	if err = withOrderItems(page.Orders); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// withOrderItems loads the items of all the orders with one query.
+func withOrderItems(orders []orderModel) error {
+	ids := make([]int64, len(orders))
+	byID := make(map[int]*orderModel, len(orders))
+	for i := range orders {
+		ids[i] = int64(orders[i].ID)
+		orders[i].Items = []orderItemModel{}
+		byID[orders[i].ID] = &orders[i]
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := listOrderItemsStmt.Query(pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid int
+		it, err := scanOrderItem(rows, &oid)
+		if err != nil {
+			return err
+		}
+		if o, ok := byID[oid]; ok {
+			o.Items = append(o.Items, *it)
+		}
+	}
+	return rows.Err()
+}
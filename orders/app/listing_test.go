@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"lib/servicetest"
+)
+
+func TestOrderFilterQuery(t *testing.T) {
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		f        orderFilter
+		wantCond string
+		wantTail string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "every order",
+			f:        orderFilter{sortBy: sortByDate, desc: true},
+			wantTail: " ORDER BY created_at DESC, id DESC",
+		},
+		{
+			name:     "page of user",
+			f:        orderFilter{userID: 1, sortBy: sortByDate, desc: true, limit: 20},
+			wantCond: " WHERE user_id=$1",
+			wantTail: " ORDER BY created_at DESC, id DESC LIMIT $2",
+			wantArgs: []interface{}{1, 21},
+		},
+		{
+			name:     "after price",
+			f:        orderFilter{sortBy: sortByPrice, limit: 10, after: &orderCursor{SortBy: sortByPrice, Value: "30", ID: 11}},
+			wantCond: " WHERE (price, id) > ($1, $2)",
+			wantTail: " ORDER BY price ASC, id ASC LIMIT $3",
+			wantArgs: []interface{}{30, 11, 11},
+		},
+		{
+			name:     "after date",
+			f:        orderFilter{userID: 1, sortBy: sortByDate, desc: true, limit: 10, after: &orderCursor{SortBy: sortByDate, Desc: true, Value: at.Format(time.RFC3339Nano), ID: 5}},
+			wantCond: " WHERE user_id=$1 AND (created_at, id) < ($2, $3)",
+			wantTail: " ORDER BY created_at DESC, id DESC LIMIT $4",
+			wantArgs: []interface{}{1, at, 5, 11},
+		},
+		{
+			name:    "wrong price",
+			f:       orderFilter{sortBy: sortByPrice, limit: 10, after: &orderCursor{SortBy: sortByPrice, Value: "cheap", ID: 1}},
+			wantErr: true,
+		},
+		{
+			name:    "wrong date",
+			f:       orderFilter{sortBy: sortByDate, limit: 10, after: &orderCursor{SortBy: sortByDate, Value: "yesterday", ID: 1}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, args, err := tt.f.query()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("query() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := listOrdersTpl + tt.wantCond + tt.wantTail; q != want {
+				t.Errorf("query() = %q, want %q", q, want)
+			}
+			if len(args) != len(tt.wantArgs) || (len(args) > 0 && !reflect.DeepEqual(args, tt.wantArgs)) {
+				t.Errorf("query() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestParseOrderFilter(t *testing.T) {
+	f := orderFilter{sortBy: sortByPrice, desc: true}
+	priceCursor := encodeOrderCursor(&f, &orderModel{ID: 11, Price: 30})
+	tests := []struct {
+		name      string
+		query     string
+		role      string
+		wantUser  int
+		wantLimit int
+		wantPaged bool
+		wantErr   bool
+	}{
+		{name: "plain list", wantUser: servicetest.Owner},
+		{name: "page", query: "limit=10", wantUser: servicetest.Owner, wantLimit: 10, wantPaged: true},
+		{name: "default page", query: "sort=price&cursor=" + priceCursor, wantUser: servicetest.Owner, wantLimit: defaultOrdersPage, wantPaged: true},
+		{name: "page too large", query: "limit=1000", wantUser: servicetest.Owner, wantLimit: maxOrdersPage, wantPaged: true},
+		{name: "admin", role: roleAdmin},
+		{name: "admin for user", query: "user_id=3", role: roleAdmin, wantUser: 3},
+		{name: "user_id of user", query: "user_id=3", wantUser: servicetest.Owner},
+		{name: "cursor of other sorting", query: "cursor=" + priceCursor, wantErr: true},
+		{name: "wrong cursor", query: "cursor=!", wantErr: true},
+		{name: "wrong limit", query: "limit=0", wantErr: true},
+		{name: "wrong sort", query: "sort=name", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := servicetest.NewRequest(http.MethodGet, "/orders/get?"+tt.query, "", servicetest.Owner, tt.role, nil)
+			f, err := parseOrderFilter(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOrderFilter() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if f.userID != tt.wantUser || f.limit != tt.wantLimit || f.paged != tt.wantPaged {
+				t.Errorf("parseOrderFilter() = user %d, limit %d, paged %t, want %d, %d, %t", f.userID, f.limit, f.paged, tt.wantUser, tt.wantLimit, tt.wantPaged)
+			}
+		})
+	}
+}
+
+// TestListShape keeps the plain list for clients that don't page.
+func TestListShape(t *testing.T) {
+	setupTestDB(t)
+
+	oid := createTestOrder(t, servicetest.Owner, statusNeedToPay)
+	tests := []struct {
+		query string
+		paged bool
+	}{
+		{query: "", paged: false},
+		{query: "?limit=100", paged: true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		get(w, servicetest.NewRequest(http.MethodGet, "/orders/get"+tt.query, "", servicetest.Owner, "", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d", tt.query, w.Code)
+		}
+		orders := []orderModel{}
+		if tt.paged {
+			page := ordersPageModel{}
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatalf("%q: %s", tt.query, err)
+			}
+			orders = page.Orders
+		} else if err := json.Unmarshal(w.Body.Bytes(), &orders); err != nil {
+			t.Fatalf("%q: %s", tt.query, err)
+		}
+		found := false
+		for _, o := range orders {
+			if o.ID == oid {
+				found = true
+				if len(o.Items) != 1 {
+					t.Errorf("%q: order has %d items, want 1", tt.query, len(o.Items))
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%q: order [%d] is not listed in %s", tt.query, oid, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -15,9 +14,10 @@ import (
 	"time"
 
 	"app/tracing"
+	"lib/client"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 )
@@ -28,13 +28,62 @@ type orderModel struct {
 	EventID int `json:"event_id"`
 	Price   int `json:"price,omitempty"`
 	Status  int `json:"status,omitempty"`
+	// StatusName is the readable name of Status
+	StatusName string           `json:"status_name"`
+	Items      []orderItemModel `json:"items,omitempty"`
+	// Price is what is paid, the promo code's Discount is already taken off
+	PromoCode string `json:"promo_code,omitempty"`
+	Discount  int    `json:"discount,omitempty"`
+	// Kept is the part of the price not refunded on cancellation
+	Kept        int               `json:"kept,omitempty"`
+	RefundQuote *refundQuoteModel `json:"refund_quote,omitempty"`
+	// PayerID is set once the order was transferred to another user
+	PayerID int `json:"payer_id,omitempty"`
+	// Role of the user who made the order, ticket types may be limited to
+	// some roles
+	Role string `json:"-"`
+
+	HoldExpiresAt *time.Time `json:"hold_expires_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// orderItemModel is a single line of an order: a number of slots of one event.
+type orderItemModel struct {
+	EventID  int `json:"event_id"`
+	Quantity int `json:"quantity"`
+	Price    int `json:"price,omitempty"`
+	// TicketTypeID may be left out, events then picks the cheapest type the
+	// user may buy and it is filled in once the slots are occupied
+	TicketTypeID int `json:"ticket_type_id,omitempty"`
+	// SeatIDs picks the seats of a seated event, events assigns free ones
+	// when there are none; Seats are the taken seats, they go on the ticket
+	SeatIDs []int       `json:"seat_ids,omitempty"`
+	Seats   []seatModel `json:"seats,omitempty"`
+	// PricingRule is the rule of the event that set Price when the slots
+	// were occupied, it is kept as events sent it
+	PricingRule json.RawMessage `json:"pricing_rule,omitempty"`
+}
+
+type occupyRequestModel struct {
+	OrderID int              `json:"order_id"`
+	EventID int              `json:"event_id"`
+	Items   []orderItemModel `json:"items"`
+	Role    string           `json:"role,omitempty"`
 }
 
 type callbackOccupyModel struct {
-	OrderID int  `json:"order_id"`
-	UserID  int  `json:"user_id"`
-	Price   int  `json:"price"`
-	Status  bool `json:"status"`
+	OrderID   int              `json:"order_id"`
+	UserID    int              `json:"user_id"`
+	Price     int              `json:"price"`
+	Status    bool             `json:"status"`
+	Items     []orderItemModel `json:"items,omitempty"`
+	HeldUntil *time.Time       `json:"held_until,omitempty"`
+}
+
+type callbackExpiredModel struct {
+	OrderID int `json:"order_id"`
+	UserID  int `json:"user_id"`
 }
 
 type callbackPaymentModel struct {
@@ -43,6 +92,21 @@ type callbackPaymentModel struct {
 	Status  bool `json:"status"`
 }
 
+type paymentRequestModel struct {
+	OrderID       int `json:"order_id"`
+	WithdrawalSum int `json:"withdrawal_sum"`
+}
+
+type depositRequestModel struct {
+	Delta   int `json:"delta"`
+	OrderID int `json:"order_id"`
+}
+
+type notifyRequestModel struct {
+	OrderID int    `json:"order_id"`
+	Message string `json:"message"`
+}
+
 type configModel struct {
 	dbHost string
 	dbPort string
@@ -51,6 +115,21 @@ type configModel struct {
 	dbPass string
 	host   string
 	port   string
+
+	idempotencyTTL time.Duration
+
+	reconcileInterval time.Duration
+	reconcileRepair   bool
+
+	eventsURL     string
+	accountURL    string
+	notifURL      string
+	authURL       string
+	clientTimeout time.Duration
+	clientRetries int
+
+	ticketSigningKey string
+	ticketDevKey     bool
 }
 
 const (
@@ -64,30 +143,46 @@ const (
 )
 
 const (
-	createOrderTpl              = `INSERT INTO orders (user_id, event_id, price, status) VALUES ($1, $2, 0,0) returning id`
-	updateStatusTpl             = `UPDATE orders SET status=$2 WHERE id=$1`
-	setPriceTpl                 = `UPDATE orders SET price=$2 WHERE id=$1`
-	getOrderTpl                 = `SELECT id, user_id, event_id, price, status FROM orders WHERE id=$1`
-	getOrdersTpl                = `SELECT id, user_id, event_id, price, status FROM orders WHERE user_id=$1`
-	occupySlotEndpoint          = "http://events.proj.svc.cluster.local:9000/events/occupy"
-	cancelSlotEndpoint          = "http://events.proj.svc.cluster.local:9000/events/cancel"
-	paymentSlotEndpoint         = "http://account.proj.svc.cluster.local:9000/account/withdrawal"
-	paymentNewOperationEndpoint = "http://account.proj.svc.cluster.local:9000/account/genreq"
-	notifyEndpoint              = "http://notif.proj.svc.cluster.local:9000/notif/create"
-	occupySlotTpl               = `{"order_id":%d,"event_id":%d}`
-	payTpl                      = `{"order_id":%d,"withdrawal_sum":%d}`
-	notifyTpl                   = `{"order_id":%d,"message":"%s"}`
+	roleAdmin = "admin"
+	roleStaff = "staff"
+)
+
+const (
+	createOrderTpl          = `INSERT INTO orders (user_id, event_id, price, status, user_role) VALUES ($1, $2, 0,0, $3) returning id`
+	updateStatusTpl         = `WITH upd AS (UPDATE orders SET status=$2, version=version+1, updated_at=now() WHERE id=$1 AND status=$5 RETURNING id) INSERT INTO order_status_history (order_id, from_status, to_status, actor, reason) SELECT id, $5, $2, $3, $4 FROM upd`
+	getStatusTpl            = `SELECT status FROM orders WHERE id=$1`
+	setPriceTpl             = `UPDATE orders SET price=$2, discount=$3, updated_at=now() WHERE id=$1`
+	getOrderTpl             = `SELECT id, user_id, event_id, price, status, COALESCE(promo_code, ''), discount, kept, COALESCE(payer_id, 0), user_role, hold_expires_at, created_at, updated_at FROM orders WHERE id=$1`
+	setHoldTpl              = `UPDATE orders SET hold_expires_at=$2, updated_at=now() WHERE id=$1`
+	createOrderItemTpl      = `INSERT INTO order_items (order_id, event_id, quantity, price, ticket_type_id, seat_ids) VALUES ($1, $2, $3, 0, $4, $5)`
+	setOrderItemPriceTpl    = `UPDATE order_items SET price=$3, ticket_type_id=$4, seats=$5, pricing_rule=$6 WHERE order_id=$1 AND event_id=$2 AND ticket_type_id IN (0, $4)`
+	getOrderItemsTpl        = `SELECT event_id, quantity, price, ticket_type_id, seat_ids, seats, pricing_rule FROM order_items WHERE order_id=$1 ORDER BY id`
+	occupySlotPath          = "/events/occupy"
+	cancelSlotPath          = "/events/cancel"
+	confirmSlotPath         = "/events/confirm"
+	refundPath              = "/account/deposit"
+	paymentSlotPath         = "/account/withdrawal"
+	paymentNewOperationPath = "/account/genreq"
+	notifyPath              = "/notif/create"
 )
 
 var (
-	createOrderStmt  *sql.Stmt
-	updateStatusStmt *sql.Stmt
-	setPriceStmt     *sql.Stmt
-	getStatusStmt    *sql.Stmt
-	getOrderStmt     *sql.Stmt
-	getOrdersStmt    *sql.Stmt
-	tracer           opentracing.Tracer
-	closer           io.Closer
+	createOrderStmt       *sql.Stmt
+	updateStatusStmt      *sql.Stmt
+	setPriceStmt          *sql.Stmt
+	setHoldStmt           *sql.Stmt
+	getStatusStmt         *sql.Stmt
+	getOrderStmt          *sql.Stmt
+	createOrderItemStmt   *sql.Stmt
+	setOrderItemPriceStmt *sql.Stmt
+	getOrderItemsStmt     *sql.Stmt
+	db                    *sql.DB
+	eventsClient          *client.Client
+	accountClient         *client.Client
+	notifClient           *client.Client
+	authClient            *client.Client
+	tracer                opentracing.Tracer
+	closer                io.Closer
 )
 
 func readConf() *configModel {
@@ -99,6 +194,17 @@ func readConf() *configModel {
 		dbPass: "",
 		host:   "0.0.0.0",
 		port:   "80",
+
+		idempotencyTTL: defaultIdempotencyTTL,
+
+		reconcileInterval: defaultReconcileInterval,
+
+		eventsURL:     "http://events.proj.svc.cluster.local:9000",
+		accountURL:    "http://account.proj.svc.cluster.local:9000",
+		notifURL:      "http://notif.proj.svc.cluster.local:9000",
+		authURL:       "http://auth.proj.svc.cluster.local:9000",
+		clientTimeout: client.DefaultTimeout,
+		clientRetries: client.DefaultRetries,
 	}
 	dbHost := os.Getenv("DBHOST")
 	dbPort := os.Getenv("DBPORT")
@@ -107,6 +213,17 @@ func readConf() *configModel {
 	dbPass := os.Getenv("DBPASS")
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
+	idempotencyTTL := os.Getenv("IDEMPOTENCY_TTL")
+	reconcileInterval := os.Getenv("RECONCILE_INTERVAL")
+	reconcileRepair := os.Getenv("RECONCILE_REPAIR")
+	eventsURL := os.Getenv("EVENTS_URL")
+	accountURL := os.Getenv("ACCOUNT_URL")
+	notifURL := os.Getenv("NOTIF_URL")
+	authURL := os.Getenv("AUTH_URL")
+	clientTimeout := os.Getenv("CLIENT_TIMEOUT")
+	clientRetries := os.Getenv("CLIENT_RETRIES")
+	ticketSigningKey := os.Getenv("TICKET_SIGNING_KEY")
+	ticketDevKey := os.Getenv("TICKET_DEV_KEY")
 
 	if dbHost != "" {
 		cfg.dbHost = dbHost
@@ -129,6 +246,63 @@ func readConf() *configModel {
 	if port != "" {
 		cfg.port = port
 	}
+	if idempotencyTTL != "" {
+		if ttl, err := time.ParseDuration(idempotencyTTL); err == nil {
+			cfg.idempotencyTTL = ttl
+		} else {
+			log.Printf("Failed to parse [IDEMPOTENCY_TTL], using default %s: %s\n", cfg.idempotencyTTL, err)
+		}
+	}
+	if reconcileInterval != "" {
+		if interval, err := time.ParseDuration(reconcileInterval); err == nil {
+			cfg.reconcileInterval = interval
+		} else {
+			log.Printf("Failed to parse [RECONCILE_INTERVAL], using default %s: %s\n", cfg.reconcileInterval, err)
+		}
+	}
+	if reconcileRepair != "" {
+		if repair, err := strconv.ParseBool(reconcileRepair); err == nil {
+			cfg.reconcileRepair = repair
+		} else {
+			log.Printf("Failed to parse [RECONCILE_REPAIR], repairs are off: %s\n", err)
+		}
+	}
+	if eventsURL != "" {
+		cfg.eventsURL = eventsURL
+	}
+	if accountURL != "" {
+		cfg.accountURL = accountURL
+	}
+	if notifURL != "" {
+		cfg.notifURL = notifURL
+	}
+	if authURL != "" {
+		cfg.authURL = authURL
+	}
+	if clientTimeout != "" {
+		if timeout, err := time.ParseDuration(clientTimeout); err == nil {
+			cfg.clientTimeout = timeout
+		} else {
+			log.Printf("Failed to parse [CLIENT_TIMEOUT], using default %s: %s\n", cfg.clientTimeout, err)
+		}
+	}
+	if clientRetries != "" {
+		if retries, err := strconv.Atoi(clientRetries); err == nil {
+			cfg.clientRetries = retries
+		} else {
+			log.Printf("Failed to parse [CLIENT_RETRIES], using default %d: %s\n", cfg.clientRetries, err)
+		}
+	}
+	if ticketSigningKey != "" {
+		cfg.ticketSigningKey = ticketSigningKey
+	}
+	if ticketDevKey != "" {
+		if dev, err := strconv.ParseBool(ticketDevKey); err == nil {
+			cfg.ticketDevKey = dev
+		} else {
+			log.Printf("Failed to parse [TICKET_DEV_KEY], a signing key is required: %s\n", err)
+		}
+	}
 	return cfg
 }
 
@@ -151,7 +325,8 @@ func main() {
 
 	cfg := readConf()
 
-	db, err := makeDBConn(cfg)
+	var err error
+	db, err = makeDBConn(cfg)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -171,13 +346,50 @@ func main() {
 
 	mustPrepareStmts(ctx, db)
 
+	idempotencyTTL = cfg.idempotencyTTL
+	ticketKey = mustTicketKey(cfg.ticketSigningKey, cfg.ticketDevKey)
+	eventsClient = client.New(tracer, client.Config{BaseURL: cfg.eventsURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
+	accountClient = client.New(tracer, client.Config{BaseURL: cfg.accountURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
+	notifClient = client.New(tracer, client.Config{BaseURL: cfg.notifURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
+	authClient = client.New(tracer, client.Config{BaseURL: cfg.authURL, Timeout: cfg.clientTimeout, Retries: cfg.clientRetries})
+
+	reconcileInterval = cfg.reconcileInterval
+	reconcileRepair = cfg.reconcileRepair
+	go runReconciliation(ctx)
+	go expireIdempotencyKeys(ctx)
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/orders/get", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
 	r.HandleFunc("/orders/get/{id}", reqlog(isAuthenticatedMiddleware(get))).Methods("GET")
+	r.HandleFunc("/orders/get/{id}/history", reqlog(isAuthenticatedMiddleware(getHistory))).Methods("GET")
 	r.HandleFunc("/orders/create", reqlog(isAuthenticatedMiddleware(create))).Methods("POST")
+	r.HandleFunc("/orders/quote", reqlog(isAuthenticatedMiddleware(quote))).Methods("POST")
+	r.HandleFunc("/orders/cancel/{id}", reqlog(isAuthenticatedMiddleware(requestCancel))).Methods("POST")
+	r.HandleFunc("/orders/ticket/key", reqlog(getTicketKey)).Methods("GET")
+	r.HandleFunc("/orders/ticket/{id}", reqlog(isAuthenticatedMiddleware(getTicket))).Methods("GET")
+	r.HandleFunc("/orders/calendar", reqlog(isAuthenticatedMiddleware(getCalendar))).Methods("GET")
+	r.HandleFunc("/orders/calendar/reset", reqlog(isAuthenticatedMiddleware(resetCalendar))).Methods("POST")
+	r.HandleFunc("/orders/calendar/feed/{token:[A-Za-z0-9_-]+}.ics", reqlog(getCalendarFeed)).Methods("GET")
+	r.HandleFunc("/orders/checkin", reqlog(isAuthenticatedMiddleware(checkin))).Methods("POST")
+	r.HandleFunc("/orders/{id:[0-9]+}/transfer", reqlog(isAuthenticatedMiddleware(offerTransfer))).Methods("POST")
+	r.HandleFunc("/orders/transfers", reqlog(isAuthenticatedMiddleware(getTransfers))).Methods("GET")
+	r.HandleFunc("/orders/transfers/{id}/{action:accept|decline}", reqlog(isAuthenticatedMiddleware(resolveTransfer))).Methods("POST")
+	r.HandleFunc("/orders/cart", reqlog(isAuthenticatedMiddleware(getCart))).Methods("GET")
+	r.HandleFunc("/orders/cart/add", reqlog(isAuthenticatedMiddleware(addToCart))).Methods("POST")
+	r.HandleFunc("/orders/cart/remove", reqlog(isAuthenticatedMiddleware(removeFromCart))).Methods("POST")
+	r.HandleFunc("/orders/cart/checkout", reqlog(isAuthenticatedMiddleware(checkout))).Methods("POST")
+	r.HandleFunc("/orders/promo", reqlog(isAuthenticatedMiddleware(getPromos))).Methods("GET")
+	r.HandleFunc("/orders/promo/create", reqlog(isAuthenticatedMiddleware(createPromo))).Methods("POST")
+	r.HandleFunc("/orders/promo/manage/{code}", reqlog(isAuthenticatedMiddleware(updatePromo))).Methods("POST")
+	r.HandleFunc("/orders/admin/reconcile", reqlog(isAuthenticatedMiddleware(reconcileNow))).Methods("POST")
+	r.HandleFunc("/orders/admin/event-sales", reqlog(isAuthenticatedMiddleware(getEventSales))).Methods("GET")
+	r.HandleFunc("/orders/admin/events/{id}", reqlog(isAuthenticatedMiddleware(getEventOrders))).Methods("GET")
+	r.HandleFunc("/orders/admin/events/{id}/cancel", reqlog(isAuthenticatedMiddleware(cancelEvent))).Methods("POST")
 	r.HandleFunc("/orders/callback/events", reqlog(isAuthenticatedMiddleware(callbackEvents))).Methods("POST")
 	r.HandleFunc("/orders/callback/account", reqlog(isAuthenticatedMiddleware(callbackPayment))).Methods("POST")
+	r.HandleFunc("/orders/callback/expired", reqlog(isAuthenticatedMiddleware(callbackExpired))).Methods("POST")
+	r.HandleFunc("/orders/callback/waitlist", reqlog(isAuthenticatedMiddleware(callbackWaitlist))).Methods("POST")
 
 	bindOn := fmt.Sprintf("%s:%s", cfg.host, cfg.port)
 	if err := http.ListenAndServe(bindOn, r); err != nil {
@@ -198,72 +410,266 @@ func mustPrepareStmts(ctx context.Context, db *sql.DB) {
 		panic(err)
 	}
 
+	getStatusStmt, err = db.PrepareContext(ctx, getStatusTpl)
+	if err != nil {
+		panic(err)
+	}
+
 	setPriceStmt, err = db.PrepareContext(ctx, setPriceTpl)
 	if err != nil {
 		panic(err)
 	}
 
+	setHoldStmt, err = db.PrepareContext(ctx, setHoldTpl)
+	if err != nil {
+		panic(err)
+	}
+
 	getOrderStmt, err = db.PrepareContext(ctx, getOrderTpl)
 	if err != nil {
 		panic(err)
 	}
 
-	getOrdersStmt, err = db.PrepareContext(ctx, getOrdersTpl)
+	createOrderItemStmt, err = db.PrepareContext(ctx, createOrderItemTpl)
 	if err != nil {
 		panic(err)
 	}
 
+	setOrderItemPriceStmt, err = db.PrepareContext(ctx, setOrderItemPriceTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getOrderItemsStmt, err = db.PrepareContext(ctx, getOrderItemsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	mustPrepareIdempotencyStmts(ctx, db)
+	mustPrepareHistoryStmts(ctx, db)
+	mustPrepareCartStmts(ctx, db)
+	mustPreparePromoStmts(ctx, db)
+	mustPrepareRefundStmts(ctx, db)
+	mustPrepareTicketStmts(ctx, db)
+	mustPrepareTransferStmts(ctx, db)
+	mustPrepareQuoteStmts(ctx, db)
+	mustPrepareEventCancelStmts(ctx, db)
+	mustPrepareCalendarStmts(ctx, db)
+	mustPrepareListingStmts(ctx, db)
 }
 
-func order(spanCtx opentracing.SpanContext, userID int, o *orderModel) (int, error) {
+// normalizeItems turns a single-event request into a one-item order and
+// validates the items of a multi-event one.
+func normalizeItems(o *orderModel) error {
+	if len(o.Items) == 0 {
+		if o.EventID == 0 {
+			return errors.New("order has no items")
+		}
+		o.Items = []orderItemModel{{EventID: o.EventID, Quantity: 1}}
+	}
+	// an event is listed once without a ticket type or once per ticket type,
+	// so the item of a picked type can still be told apart
+	seen := map[[2]int]bool{}
+	listed := map[int]bool{}
+	for i := range o.Items {
+		if o.Items[i].Quantity == 0 {
+			o.Items[i].Quantity = 1
+			if len(o.Items[i].SeatIDs) > 0 {
+				o.Items[i].Quantity = len(o.Items[i].SeatIDs)
+			}
+		}
+		if err := checkSeats(&o.Items[i]); err != nil {
+			return err
+		}
+		if o.Items[i].EventID == 0 || o.Items[i].Quantity < 0 || o.Items[i].TicketTypeID < 0 {
+			return fmt.Errorf("wrong item for event [%d] with quantity [%d]", o.Items[i].EventID, o.Items[i].Quantity)
+		}
+		eid, tid := o.Items[i].EventID, o.Items[i].TicketTypeID
+		if seen[[2]int{eid, tid}] || seen[[2]int{eid, 0}] || (tid == 0 && listed[eid]) {
+			return fmt.Errorf("event [%d] is listed twice", o.Items[i].EventID)
+		}
+		seen[[2]int{eid, tid}] = true
+		listed[eid] = true
+	}
+	o.EventID = o.Items[0].EventID
+	return nil
+}
+
+// order stores the order, the idempotency key of the request, when there is
+// one, is bound to it in the same transaction.
+func order(spanCtx opentracing.SpanContext, userID int, o *orderModel, key string) (int, error) {
 	span := tracer.StartSpan("querying for order from DB", opentracing.ChildOf(spanCtx))
 	defer span.Finish()
 
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	oid, err := orderTx(tx, userID, o)
+	if err != nil {
+		return 0, err
+	}
+	if key != "" {
+		if err = bindIdempotencyKeyTx(tx, userID, key, oid); err != nil {
+			return 0, err
+		}
+	}
+	return oid, tx.Commit()
+}
+
+// orderTx stores the order with its items inside the caller's transaction.
+func orderTx(tx *sql.Tx, userID int, o *orderModel) (int, error) {
 	id := new(int)
-	err := createOrderStmt.QueryRow(userID, o.EventID).Scan(id)
-	return *id, err
+	if err := tx.Stmt(createOrderStmt).QueryRow(userID, o.EventID, o.Role).Scan(id); err != nil {
+		return 0, err
+	}
+	for _, it := range o.Items {
+		if _, err := tx.Stmt(createOrderItemStmt).Exec(*id, it.EventID, it.Quantity, it.TicketTypeID, pq.Array(it.SeatIDs)); err != nil {
+			return 0, err
+		}
+	}
+	if o.PromoCode != "" {
+		if err := redeemPromoTx(tx, *id, userID, o); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Stmt(addHistoryStmt).Exec(*id, statusCreated, actorUser, "order created"); err != nil {
+		return 0, err
+	}
+	return *id, nil
 }
 
 func getOrder(oid int) (*orderModel, error) {
 	o := orderModel{}
-	err := getOrderStmt.QueryRow(oid).Scan(&o.ID, &o.UserID, &o.EventID, &o.Price, &o.Status)
+	hold := sql.NullTime{}
+	err := getOrderStmt.QueryRow(oid).Scan(&o.ID, &o.UserID, &o.EventID, &o.Price, &o.Status, &o.PromoCode, &o.Discount, &o.Kept, &o.PayerID, &o.Role, &hold, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return &o, err
+	}
+	if hold.Valid {
+		o.HoldExpiresAt = &hold.Time
+	}
+	o.StatusName = statusName(o.Status)
+	o.Items, err = getOrderItems(oid)
 	return &o, err
 }
 
-func cancelOrder(spanCtx opentracing.SpanContext, oid int) error {
+func getOrderItems(oid int) ([]orderItemModel, error) {
+	rows, err := getOrderItemsStmt.Query(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []orderItemModel{}
+	for rows.Next() {
+		it, err := scanOrderItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *it)
+	}
+	return items, rows.Err()
+}
+
+// scanOrderItem scans the columns of getOrderItemsTpl, the columns before
+// them go to prefix.
+func scanOrderItem(rows *sql.Rows, prefix ...interface{}) (*orderItemModel, error) {
+	it := orderItemModel{}
+	seatIDs := pq.Int64Array{}
+	seats, rule := []byte{}, []byte{}
+	dest := append(prefix, &it.EventID, &it.Quantity, &it.Price, &it.TicketTypeID, &seatIDs, &seats, &rule)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if len(rule) > 0 {
+		it.PricingRule = rule
+	}
+	if err := scanSeats(&it, seatIDs, seats); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// cancelOrder cancels the order that is in the status from, see
+// modifyOrderStatus.
+func cancelOrder(spanCtx opentracing.SpanContext, oid, from int, actor, reason string) error {
 	span := tracer.StartSpan("canceling the order", opentracing.ChildOf(spanCtx))
 	defer span.Finish()
 
-	_, err := updateStatusStmt.Exec(oid, statusCancelled)
+	err := modifyOrderStatus(oid, from, statusCancelled, actor, reason)
 	if err != nil {
 		ext.LogError(span, err)
+		return err
+	}
+	if err = releasePromo(oid); err != nil {
+		log.Printf("Failed to release promo code of order [%d]: %s\n", oid, err)
+	}
+	if err = revokeTicket(oid); err != nil {
+		log.Printf("Failed to revoke ticket of order [%d]: %s\n", oid, err)
+	}
+	return nil
+}
+
+// payer is the user who paid for the order, refunds go back to them.
+func (o *orderModel) payer() int {
+	if o.PayerID != 0 {
+		return o.PayerID
 	}
-	_ = modifyOrderStatus(oid, statusCancelled)
+	return o.UserID
+}
+
+func setOrderPrice(oid, price, discount int) error {
+	_, err := setPriceStmt.Exec(oid, price, discount)
 	return err
 }
 
-func modifyOrderStatus(oid, status int) error {
-	_, err := updateStatusStmt.Exec(oid, status)
+func setOrderHold(oid int, until *time.Time) error {
+	_, err := setHoldStmt.Exec(oid, until)
 	return err
 }
 
-func setOrderPrice(oid, price int) error {
-	_, err := setPriceStmt.Exec(oid, price)
+// holdExpired reports whether the slots of the order are no longer held for it.
+func holdExpired(o *orderModel) bool {
+	return o.HoldExpiresAt != nil && time.Now().After(*o.HoldExpiresAt)
+}
+
+// setOrderItemPrice sets the price of the occupied item, the pricing rule
+// that set it and the ticket type events picked for it.
+func setOrderItemPrice(oid int, it *orderItemModel) error {
+	var seats []byte
+	if len(it.Seats) > 0 {
+		var err error
+		if seats, err = json.Marshal(it.Seats); err != nil {
+			return err
+		}
+	}
+	var rule interface{}
+	if len(it.PricingRule) > 0 {
+		rule = string(it.PricingRule)
+	}
+	_, err := setOrderItemPriceStmt.Exec(oid, it.EventID, it.Price, it.TicketTypeID, seats, rule)
 	return err
 }
 
-func actionOrderStatus(spanCtx opentracing.SpanContext, oid int) error {
+func actionOrderStatus(ctx context.Context, spanCtx opentracing.SpanContext, oid int) error {
 	o, err := getOrder(oid)
 	if err != nil {
 		log.Printf("Failed to get order [%d]: %s\n", oid, err)
 		return err
 	}
+	// compensations of a failed step run even when the caller went away
+	undo := context.WithoutCancel(ctx)
 	switch o.Status {
 	case statusCreated:
 		log.Println("Order is created, now we need to occupy the slot")
-		modifyOrderStatus(oid, statusNeedToOccupy)
-		if err = actionOrderStatus(spanCtx, oid); err != nil {
-			if err = cancelOrder(spanCtx, o.ID); err != nil {
+		if err = modifyOrderStatus(oid, o.Status, statusNeedToOccupy, actorOrders, "occupying slots"); err != nil {
+			log.Printf("Failed to modify status of order [%d]: %s\n", oid, err)
+			break
+		}
+		if err = actionOrderStatus(ctx, spanCtx, oid); err != nil {
+			if err = cancelOrder(spanCtx, o.ID, statusNeedToOccupy, actorOrders, "failed to occupy slots"); err != nil {
 				log.Printf("Failed to cancel order [%d]\n", o.ID)
 			}
 			log.Printf("Failed to perform action for order [%d] with status [%d]:%s\n", oid, statusNeedToOccupy, err)
@@ -272,39 +678,69 @@ func actionOrderStatus(spanCtx opentracing.SpanContext, oid int) error {
 		log.Println("Order is canceled, do nothing")
 	case statusNeedToOccupy:
 		log.Printf("Order [%d] is created, now need to occupy slot\n", o.ID)
-		if err = occupySlot(spanCtx, o.ID, o.EventID, o.UserID); err != nil {
-			log.Printf("Failed to occupy slot for event [%d] for user [%d], need to cancel order. Error: %s\n", o.EventID, o.UserID, err)
-			notify(spanCtx, o.UserID, o.ID, "Failed to occupy slot, canceling order")
-			if err = cancelOrder(spanCtx, o.ID); err != nil {
+		if err = occupySlot(ctx, spanCtx, o); err != nil {
+			log.Printf("Failed to occupy slots for order [%d] for user [%d], need to cancel order. Error: %s\n", o.ID, o.UserID, err)
+			notify(undo, spanCtx, o.UserID, o.ID, "Failed to occupy slot, canceling order")
+			if err = cancelOrder(spanCtx, o.ID, o.Status, actorOrders, "failed to request slots"); err != nil {
 				log.Printf("Failed to cancel order [%d]\n", o.ID)
 			}
 		}
 	case statusOccupied:
 		log.Println("Slot is occupied, now we need to pay for order")
-		modifyOrderStatus(oid, statusNeedToPay)
-		if err = actionOrderStatus(spanCtx, oid); err != nil {
-			if err = cancelOrder(spanCtx, o.ID); err != nil {
+		if err = modifyOrderStatus(oid, o.Status, statusNeedToPay, actorOrders, "paying for order"); err != nil {
+			log.Printf("Failed to modify status of order [%d]: %s\n", oid, err)
+			break
+		}
+		if err = actionOrderStatus(ctx, spanCtx, oid); err != nil {
+			if err = cancelOrder(spanCtx, o.ID, statusNeedToPay, actorOrders, "failed to pay for order"); err != nil {
 				log.Printf("Failed to cancel order [%d]\n", o.ID)
 			}
 			log.Printf("Failed to perform action for order [%d] with status [%d]:%s\n", oid, statusNeedToOccupy, err)
 		}
 	case statusNeedToPay:
 		log.Println("Event's slot is occupied, so we need to pay for event")
-		if err = payForOrder(spanCtx, o); err != nil { // i need to know price for event, so i have to get it from events service
+		if holdExpired(o) {
+			log.Printf("Hold of slots for order [%d] has expired, need to cancel order\n", o.ID)
+			notify(undo, spanCtx, o.UserID, o.ID, "Slot hold has expired before payment, canceling order")
+			if err = cancelOrder(spanCtx, o.ID, o.Status, actorOrders, "slot hold has expired"); err != nil {
+				log.Printf("Failed to cancel order [%d]: %s\n", o.ID, err)
+			}
+			if err = cancelSlot(undo, spanCtx, o); err != nil {
+				log.Printf("Failed to cancel slot [%d]: %s\n", o.ID, err)
+			}
+			break
+		}
+		if err = payForOrder(ctx, spanCtx, o); err != nil { // i need to know price for event, so i have to get it from events service
 			log.Printf("Failed to pay the for event [%d] for user [%d], need to cancel order: %s\n", o.EventID, o.UserID, err)
 			// also we have to cancel slot, but not now
-			notify(spanCtx, o.UserID, o.ID, "Failed to pay for order, canceling order and slot")
-			if err = cancelOrder(spanCtx, o.ID); err != nil {
+			notify(undo, spanCtx, o.UserID, o.ID, "Failed to pay for order, canceling order and slot")
+			if err = cancelOrder(spanCtx, o.ID, o.Status, actorOrders, "failed to pay for order"); err != nil {
 				log.Printf("Failed to cancel order [%d]: %s\n", o.ID, err)
 			}
-			if err = cancelSlot(spanCtx, o); err != nil {
+			if err = cancelSlot(undo, spanCtx, o); err != nil {
 				log.Printf("Failed to cancel slot [%d]: %s\n", o.ID, err)
 			}
 		}
 	case StatusPaid:
-		log.Println("Event's slot is paid, so the order is complete")
-		notify(spanCtx, o.UserID, o.ID, "Order was successfully completed")
-		// need to notify here
+		log.Println("Event's slot is paid, so we need to confirm the held slot")
+		if err = confirmSlot(ctx, spanCtx, o); err != nil {
+			log.Printf("Failed to confirm slots for order [%d], need to refund and cancel order: %s\n", o.ID, err)
+			notify(undo, spanCtx, o.UserID, o.ID, "Slot hold has expired, refunding payment and canceling order")
+			if err = refundOrder(undo, spanCtx, o); err != nil {
+				log.Printf("Failed to refund order [%d]: %s\n", o.ID, err)
+			}
+			if err = cancelOrder(spanCtx, o.ID, o.Status, actorEvents, "failed to confirm slots, payment refunded"); err != nil {
+				log.Printf("Failed to cancel order [%d]: %s\n", o.ID, err)
+			}
+			break
+		}
+		log.Println("Event's slot is paid and confirmed, issuing the ticket")
+		if err = issueTicket(o); err != nil {
+			// the ticket is issued again when the user asks for it
+			log.Printf("Failed to issue ticket for order [%d]: %s\n", o.ID, err)
+			err = nil
+		}
+		notify(ctx, spanCtx, o.UserID, o.ID, "Order was successfully paid, the ticket is ready")
 	default:
 		log.Println("This should not be happen never")
 	}
@@ -319,6 +755,8 @@ func get(w http.ResponseWriter, r *http.Request) {
 	uid, err := getUserID(r)
 	if err != nil {
 		log.Printf("Failed to get user id: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	vars := mux.Vars(r)
@@ -331,43 +769,42 @@ func get(w http.ResponseWriter, r *http.Request) {
 		}
 		var o *orderModel
 		o, err = getOrder(oid)
-		if err != nil {
-			log.Printf("Could not find any event with id [%d]\n", oid)
-			w.WriteHeader(http.StatusBadRequest)
+		if err != nil || !canAccess(r, o.UserID) {
+			log.Printf("Could not find any order with id [%d] for user [%d]\n", oid, uid)
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if o.Status == StatusPaid {
+			if o.RefundQuote, err = quoteRefund(r.Context(), span.Context(), o, isAdmin(r)); err != nil {
+				log.Printf("Failed to quote refund of order [%d]: %s\n", oid, err)
+			}
+		}
 		data, _ := json.MarshalIndent(o, "", "\t")
 		w.WriteHeader(http.StatusOK)
 		w.Write(data)
 		return
 	}
 
-	rows, err := getOrdersStmt.Query(uid)
+	f, err := parseOrderFilter(r)
+	if err != nil {
+		log.Printf("Failed to parse orders filter: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Failed to parse orders filter: %s", err)
+		return
+	}
+	page, err := listOrders(f)
 	if err != nil {
 		log.Printf("Failed to get orders list: %s\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	id := new(int)
-	user_id := new(int)
-	event_id := new(int)
-	price := new(int)
-	status := new(int)
-	orders := make([]orderModel, 0)
-	for rows.Next() {
-		err := rows.Scan(id, user_id, event_id, price, status)
-		if err != nil {
-			log.Println("Failed to scan current row:", err)
-		}
-		orders = append(orders, orderModel{
-			ID:      *id,
-			UserID:  *user_id,
-			EventID: *event_id,
-			Price:   *price,
-			Status:  *status,
-		})
+	// clients that don't page keep getting the plain list
+	var data []byte
+	if f.paged {
+		data, _ = json.MarshalIndent(page, "", "\t")
+	} else {
+		data, _ = json.MarshalIndent(page.Orders, "", "\t")
 	}
-	data, _ := json.MarshalIndent(orders, "", "\t")
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
@@ -384,143 +821,213 @@ func create(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Got wrong header [X-User-Id]: %s", err)
 		return
 	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to read request body user id [%d]: %s\n", uid, err)
+		return
+	}
 	o := orderModel{}
-	if err = json.NewDecoder(r.Body).Decode(&o); err != nil {
+	if err = json.Unmarshal(body, &o); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
-	oid, err := order(spanCtx, uid, &o)
+	o.Role = headers.Get("X-User-Role")
+	if err = normalizeItems(&o); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Got wrong order from user [%d]: %s\n", uid, err)
+		return
+	}
+	key := headers.Get(idempotencyKeyHeader)
+	if key != "" {
+		fp := fingerprint(body)
+		reserved, err := reserveIdempotencyKey(uid, key, fp)
+		if err != nil {
+			log.Printf("Failed to reserve idempotency key [%s] for user [%d]: %s\n", key, uid, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			replayOrder(w, uid, key, fp)
+			return
+		}
+	}
+	oid, err := order(spanCtx, uid, &o, key)
 	if err != nil {
 		log.Printf("Failed to order event [%d] for user [%d]: %s\n", o.EventID, uid, err)
+		if key != "" {
+			if err := releaseIdempotencyKey(uid, key); err != nil {
+				log.Printf("Failed to release idempotency key [%s] for user [%d]: %s\n", key, uid, err)
+			}
+		}
+		if isPromoError(err) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Failed to apply promo code [%s]: %s", o.PromoCode, err)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	log.Printf("Successfully ordered event [%d] for user [%d]\n", o.EventID, uid)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, `{"success":true, "order_id":%d}`, oid)
-	if err = actionOrderStatus(spanCtx, oid); err != nil {
+	if err = actionOrderStatus(r.Context(), spanCtx, oid); err != nil {
 		log.Printf("Failed to perform action based on order's status: %s\n", err)
 	}
 }
 
-func occupySlot(spanCtx opentracing.SpanContext, bid, eid, uid int) error {
+// occupySlot asks events to reserve the slots of every order item at once.
+// Events holds the slots of an order only once, so the request is retried.
+func occupySlot(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel) error {
 	span := tracer.StartSpan("sending occupy slot request", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(occupySlotTpl, bid, eid)))
-	req, err := http.NewRequest(http.MethodPost, occupySlotEndpoint, bodyReader)
+	_, err := eventsClient.Do(ctx, span.Context(), &client.Request{
+		Method:     http.MethodPost,
+		Path:       occupySlotPath,
+		UserID:     o.UserID,
+		Body:       occupyRequestModel{OrderID: o.ID, EventID: o.EventID, Items: o.Items, Role: o.Role},
+		Idempotent: true,
+	}, nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to occupy slot: %w", err)
 	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(uid))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	return nil
+}
+
+// newAccountOperation asks account for a request id, which makes the
+// following balance change happen only once.
+func newAccountOperation(ctx context.Context, spanCtx opentracing.SpanContext, uid int) (string, error) {
+	resp, err := accountClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       paymentNewOperationPath,
+		UserID:     uid,
+		Idempotent: true,
+	}, nil)
 	if err != nil {
-		return err
+		return "", err
 	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to occupy slot")
+	rid := resp.Header.Get("X-Request-Id")
+	if rid == "" {
+		return "", errors.New("failed to prepare new account operation")
 	}
-	return nil
+	return rid, nil
 }
 
-func payForOrder(spanCtx opentracing.SpanContext, b *orderModel) error {
+// payForOrder withdraws the order's price. The withdrawal is not retried: a
+// repeat with the same request id is rejected and would look like a failure.
+func payForOrder(ctx context.Context, spanCtx opentracing.SpanContext, b *orderModel) error {
 	span := tracer.StartSpan("paying for order request request", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
-	c := http.Client{}
-
-	req, err := http.NewRequest(http.MethodGet, paymentNewOperationEndpoint, bytes.NewReader([]byte{}))
+	rid, err := newAccountOperation(ctx, span.Context(), b.UserID)
 	if err != nil {
-		log.Printf("Failed make request [%s] endpoint: %s", paymentSlotEndpoint, err)
+		log.Printf("Failed to prepare new account operation: %s\n", err)
 		return err
 	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(b.UserID))
-	resp, err := c.Do(req)
+	_, err = accountClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   paymentSlotPath,
+		UserID: b.UserID,
+		// account records the order of a withdrawal from services only
+		Header: http.Header{"X-Request-Id": {rid}, "X-User-Role": {roleAdmin}},
+		Body:   paymentRequestModel{OrderID: b.ID, WithdrawalSum: b.Price},
+	}, nil)
 	if err != nil {
-		log.Printf("Failed to request [%s] endpoint: %s", paymentNewOperationEndpoint, err)
-		return err
+		log.Printf("Failed to request [%s] endpoint: %s", paymentSlotPath, err)
+		return fmt.Errorf("failed to pay for order: %w", err)
 	}
-	resp.Body.Close()
+	return nil
+}
 
-	rid := resp.Header.Get("X-Request-Id")
-	if rid == "" {
-		log.Println("Failed to prepare new account operation")
-		return errors.New("failed to prepare new account operation")
-	}
+// refundOrder returns the price of the order back to the account of its
+// payer, who differs from the owner once the order was transferred.
+func refundOrder(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel) error {
+	span := tracer.StartSpan("refunding order request", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
 
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(payTpl, b.ID, b.Price)))
-	req, err = http.NewRequest(http.MethodPost, paymentSlotEndpoint, bodyReader)
+	uid := o.payer()
+	rid, err := newAccountOperation(ctx, span.Context(), uid)
 	if err != nil {
-		log.Printf("Failed make request [%s] endpoint: %s", paymentSlotEndpoint, err)
 		return err
 	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(b.UserID))
-	req.Header.Set("X-Request-Id", rid)
-	resp, err = c.Do(req)
+	_, err = accountClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   refundPath,
+		UserID: uid,
+		// account takes order refunds from services only
+		Header: http.Header{"X-Request-Id": {rid}, "X-User-Role": {roleAdmin}},
+		Body:   depositRequestModel{Delta: o.Price, OrderID: o.ID},
+	}, nil)
 	if err != nil {
-		log.Printf("Failed to request [%s] endpoint: %s", paymentSlotEndpoint, err)
-		return err
-	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to pay for order, got response status: " + resp.Status)
+		return fmt.Errorf("failed to refund order: %w", err)
 	}
 	return nil
 }
 
-func notify(spanCtx opentracing.SpanContext, uid, oid int, message string) {
+func notify(ctx context.Context, spanCtx opentracing.SpanContext, uid, oid int, message string) {
 	span := tracer.StartSpan("sending request for notify", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(notifyTpl, oid, message)))
-	req, err := http.NewRequest(http.MethodPost, notifyEndpoint, bodyReader)
+	_, err := notifClient.Do(ctx, span.Context(), &client.Request{
+		Method: http.MethodPost,
+		Path:   notifyPath,
+		UserID: uid,
+		Body:   notifyRequestModel{OrderID: oid, Message: message},
+	}, nil)
 	if err != nil {
-		log.Printf("Failed to create request endpoint [%s] for new notfy: %s", notifyEndpoint, err)
-		return
-	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(uid))
-	c := http.Client{}
-	resp, err := c.Do(req)
-	if err != nil {
-		log.Printf("Failed to create send endpoint [%s] for new notfy: %s", notifyEndpoint, err)
-		return
-	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		log.Println("Got bad response from notif service:", resp.Status)
+		log.Printf("Failed to send [%s] request for new notfy: %s", notifyPath, err)
 	}
 }
 
-func cancelSlot(spanCtx opentracing.SpanContext, o *orderModel) error {
+func cancelSlot(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel) error {
 	span := tracer.StartSpan("canceling slot request", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
-	bodyReader := bytes.NewReader([]byte(fmt.Sprintf(occupySlotTpl, o.ID, o.EventID)))
-	req, err := http.NewRequest(http.MethodPost, cancelSlotEndpoint, bodyReader)
+	_, err := eventsClient.Do(ctx, span.Context(), &client.Request{
+		Method:     http.MethodPost,
+		Path:       cancelSlotPath,
+		UserID:     o.UserID,
+		Body:       occupyRequestModel{OrderID: o.ID, EventID: o.EventID},
+		Idempotent: true,
+	}, nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to cancel slot: %w", err)
 	}
-	tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-	req.Header.Set("X-User-Id", strconv.Itoa(o.UserID))
-	c := http.Client{}
-	resp, err := c.Do(req)
+	return nil
+}
+
+func confirmSlot(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel) error {
+	span := tracer.StartSpan("confirming slot request", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	_, err := eventsClient.Do(ctx, span.Context(), &client.Request{
+		Method:     http.MethodPost,
+		Path:       confirmSlotPath,
+		UserID:     o.UserID,
+		Body:       occupyRequestModel{OrderID: o.ID, EventID: o.EventID},
+		Idempotent: true,
+	}, nil)
 	if err != nil {
-		return err
-	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("failed to cancel slot")
+		return fmt.Errorf("failed to confirm slot: %w", err)
 	}
 	return nil
 }
 
+// cancelOccupiedOrder cancels the order that got its slots but can't be
+// charged, and releases the slots.
+func cancelOccupiedOrder(ctx context.Context, spanCtx opentracing.SpanContext, oid, uid int, reason string) {
+	if err := cancelOrder(spanCtx, oid, statusOccupied, actorOrders, reason); err != nil {
+		log.Printf("Failed to cancel order [%d]: %s\n", oid, err)
+		return
+	}
+	if err := cancelSlot(ctx, spanCtx, &orderModel{ID: oid, UserID: uid}); err != nil {
+		log.Printf("Failed to cancel slot [%d]: %s\n", oid, err)
+	}
+	notify(ctx, spanCtx, uid, oid, "Failed to price the order, canceling order")
+}
+
 func callbackEvents(w http.ResponseWriter, r *http.Request) {
 	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
 	span := tracer.StartSpan("got callback from [events] service", ext.RPCServerOption(spanCtx))
@@ -532,22 +1039,55 @@ func callbackEvents(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
+	o, err := getOrder(c.OrderID)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d] for callback\n", c.OrderID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if c.Status {
-		if err := modifyOrderStatus(c.OrderID, statusOccupied); err != nil {
-			log.Printf("Failed to set order price:%s\n", err)
+		if err := modifyOrderStatus(c.OrderID, o.Status, statusOccupied, actorEvents, "slots occupied"); err != nil {
+			log.Printf("Failed to set order status:%s\n", err)
+			if errors.Is(err, errIllegalTransition) || errors.Is(err, errConcurrentUpdate) {
+				// the order was cancelled meanwhile, so the late slots are released;
+				// a repeated callback of an order that went on is ignored
+				if cur, err := getOrder(c.OrderID); err == nil && cur.Status == statusCancelled {
+					if err = cancelSlot(r.Context(), spanCtx, &orderModel{ID: c.OrderID, UserID: c.UserID}); err != nil {
+						log.Printf("Failed to cancel slot [%d]: %s\n", c.OrderID, err)
+					}
+				}
+			}
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err := setOrderHold(c.OrderID, c.HeldUntil); err != nil {
+			log.Printf("Failed to set order hold:%s\n", err)
+		}
+		// the order is not charged without its discount nor without a price
+		discount, err := orderDiscount(o.PromoCode, c.Items, c.Price)
+		if err != nil {
+			log.Printf("Failed to get discount of promo code [%s] for order [%d]: %s Cancel the order\n", o.PromoCode, c.OrderID, err)
+			cancelOccupiedOrder(context.WithoutCancel(r.Context()), spanCtx, c.OrderID, c.UserID, "failed to apply promo code")
+			return
 		}
-		if err := setOrderPrice(c.OrderID, c.Price); err != nil {
+		if err := setOrderPrice(c.OrderID, c.Price-discount, discount); err != nil {
 			log.Printf("Failed to set order price:%s Cancel the order\n", err)
-			_ = modifyOrderStatus(c.OrderID, statusCancelled)
+			cancelOccupiedOrder(context.WithoutCancel(r.Context()), spanCtx, c.OrderID, c.UserID, "failed to set price")
+			return
+		}
+		for i, it := range c.Items {
+			if err := setOrderItemPrice(c.OrderID, &c.Items[i]); err != nil {
+				log.Printf("Failed to set price of event [%d] in order [%d]: %s\n", it.EventID, c.OrderID, err)
+			}
 		}
-		if err := actionOrderStatus(spanCtx, c.OrderID); err != nil {
+		if err := actionOrderStatus(r.Context(), spanCtx, c.OrderID); err != nil {
 			log.Printf("Failed to action for current order's status\n")
 		}
 		return
 	}
 	log.Printf("Failed to occupy event's slot, order will canceled")
-	notify(spanCtx, c.UserID, c.OrderID, "Failed to occupy slot, canceling order")
-	if err := cancelOrder(spanCtx, c.OrderID); err != nil {
+	notify(r.Context(), spanCtx, c.UserID, c.OrderID, "Failed to occupy slot, canceling order")
+	if err := cancelOrder(spanCtx, c.OrderID, o.Status, actorEvents, "no available slots"); err != nil {
 		log.Printf("Failed to cancel order [%d]\n", c.OrderID)
 	}
 }
@@ -563,21 +1103,70 @@ func callbackPayment(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to parse request body user id []: %s\n", err)
 		return
 	}
+	o, err := getOrder(c.OrderID)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d] for callback\n", c.OrderID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if c.Status {
-		modifyOrderStatus(c.OrderID, StatusPaid)
+		if err := modifyOrderStatus(c.OrderID, o.Status, StatusPaid, actorAccount, "payment succeeded"); err != nil {
+			log.Printf("Failed to set order status:%s\n", err)
+			if errors.Is(err, errIllegalTransition) || errors.Is(err, errConcurrentUpdate) {
+				// the order was cancelled meanwhile, so the late payment is returned;
+				// a repeated callback of a paid order is ignored
+				if o, err := getOrder(c.OrderID); err == nil && o.Status == statusCancelled {
+					if err = refundOrder(r.Context(), spanCtx, o); err != nil {
+						log.Printf("Failed to refund order [%d]: %s\n", c.OrderID, err)
+					}
+				}
+			}
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 
-		if err := actionOrderStatus(spanCtx, c.OrderID); err != nil {
+		if err := actionOrderStatus(r.Context(), spanCtx, c.OrderID); err != nil {
 			log.Printf("Failed to action for current order's status\n")
 		}
 		return
 	}
 	log.Printf("Failed to pay event's slot, order will canceled")
-	notify(spanCtx, c.UserID, c.OrderID, "Failed to pay for order, canceling order and slot")
-	if err := cancelOrder(spanCtx, c.OrderID); err != nil {
+	notify(r.Context(), spanCtx, c.UserID, c.OrderID, "Failed to pay for order, canceling order and slot")
+	if err := cancelOrder(spanCtx, c.OrderID, o.Status, actorAccount, "payment failed"); err != nil {
 		log.Printf("Failed to cancel order [%d]\n", c.OrderID)
 	}
 }
 
+// callbackExpired is called by events when the hold of an unpaid order runs
+// out and its slots have already been released.
+func callbackExpired(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got expired hold callback from [events] service", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	c := callbackExpiredModel{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to parse request body user id []: %s\n", err)
+		return
+	}
+	o, err := getOrder(c.OrderID)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d] for callback\n", c.OrderID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if o.Status == statusCancelled || o.Status >= StatusPaid {
+		log.Printf("Order [%d] with status [%d] is not waiting for payment, skip expired hold\n", o.ID, o.Status)
+		return
+	}
+	log.Printf("Hold of slots for order [%d] has expired, order will canceled\n", o.ID)
+	notify(r.Context(), spanCtx, o.UserID, o.ID, "Slot hold has expired before payment, canceling order")
+	if err = cancelOrder(spanCtx, o.ID, o.Status, actorEvents, "slot hold has expired"); err != nil {
+		log.Printf("Failed to cancel order [%d]\n", o.ID)
+	}
+}
+
 func isAuthenticatedMiddleware(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		headers := r.Header
@@ -601,3 +1190,17 @@ func reqlog(h http.HandlerFunc) http.HandlerFunc {
 func getUserID(r *http.Request) (int, error) {
 	return strconv.Atoi(r.Header.Get("X-User-Id"))
 }
+
+func isAdmin(r *http.Request) bool {
+	return r.Header.Get("X-User-Role") == roleAdmin
+}
+
+// canAccess reports whether the caller owns the resource or is an admin.
+// Handlers answer 404 when it is false so foreign ids are not leaked.
+func canAccess(r *http.Request, ownerID int) bool {
+	if isAdmin(r) {
+		return true
+	}
+	uid, err := getUserID(r)
+	return err == nil && uid == ownerID
+}
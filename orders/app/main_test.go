@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lib/client"
+	"lib/servicetest"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// testRecipient is the user auth finds for every login.
+const testRecipient = 3
+
+// setupTestDB prepares the service against the test database. The other
+// services are replaced with a stub that accepts every call.
+func setupTestDB(t *testing.T) {
+	servicetest.Setup(t, setupService)
+}
+
+func setupService(dsn string) error {
+	conn, err := servicetest.OpenDB(dsn, "../chart/templates/initdb.yaml")
+	if err != nil {
+		return err
+	}
+	db = conn
+	tracer = opentracing.NoopTracer{}
+	mustPrepareStmts(context.Background(), db)
+
+	ticketKey = mustTicketKey("", true)
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == lookupUserPath {
+			fmt.Fprintf(w, `{"id":%d, "login":"recipient"}`, testRecipient)
+			return
+		}
+		// every event belongs to the test owner
+		if strings.HasPrefix(r.URL.Path, getEventPath) {
+			fmt.Fprintf(w, `{"owner_id":%d}`, servicetest.Owner)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	cfg := client.Config{BaseURL: stub.URL, Timeout: time.Second}
+	eventsClient = client.New(tracer, cfg)
+	accountClient = client.New(tracer, cfg)
+	notifClient = client.New(tracer, cfg)
+	authClient = client.New(tracer, cfg)
+	return nil
+}
+
+// createTestOrder creates an order of the user in the status with one item.
+func createTestOrder(t *testing.T, uid, status int) int {
+	t.Helper()
+	var oid int
+	err := db.QueryRow(`INSERT INTO orders (user_id, event_id, price, status, user_role) VALUES ($1, 1, 100, $2, '') RETURNING id`, uid, status).Scan(&oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`INSERT INTO order_items (order_id, event_id, quantity, price) VALUES ($1, 1, 1, 100)`, oid); err != nil {
+		t.Fatal(err)
+	}
+	return oid
+}
+
+// TestCallbackEventsUnknownPromo has the promo code of an occupied order
+// disappear: the order must be cancelled rather than charged in full.
+func TestCallbackEventsUnknownPromo(t *testing.T) {
+	setupTestDB(t)
+
+	oid := createTestOrder(t, servicetest.Owner, statusNeedToOccupy)
+	if _, err := db.Exec(`UPDATE orders SET promo_code='missing' WHERE id=$1`, oid); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"order_id":%d,"user_id":%d,"price":100,"status":true}`, oid, servicetest.Owner)
+	callbackEvents(httptest.NewRecorder(), servicetest.NewRequest(http.MethodPost, "/orders/callback/events", body, servicetest.Admin, roleAdmin, nil))
+
+	o, err := getOrder(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != statusCancelled {
+		t.Errorf("status = %s, want %s", statusName(o.Status), statusName(statusCancelled))
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lib/client"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	promoPercent = "percent"
+	promoFixed   = "fixed"
+)
+
+const (
+	createPromoTpl     = `INSERT INTO promo_codes (code, event_id, kind, value, max_uses, per_user_limit, valid_from, valid_until, owner_id) VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7, $8, NULLIF($9, 0)) ON CONFLICT (code) DO NOTHING RETURNING code`
+	getPromosTpl       = `SELECT ` + promoColumns + ` FROM promo_codes WHERE $1=0 OR owner_id=$1 ORDER BY created_at DESC`
+	getPromoFullTpl    = `SELECT ` + promoColumns + ` FROM promo_codes WHERE code=$1`
+	updatePromoTpl     = `UPDATE promo_codes SET max_uses=$2, per_user_limit=$3, valid_from=$4, valid_until=$5, disabled=$6 WHERE code=$1`
+	getPromoTpl        = `SELECT code, COALESCE(event_id, 0), kind, value FROM promo_codes WHERE code=$1`
+	usePromoTpl        = `UPDATE promo_codes SET used=used+1 WHERE code=$1 AND NOT disabled AND (max_uses=0 OR used < max_uses) AND (valid_from IS NULL OR valid_from <= now()) AND (valid_until IS NULL OR valid_until > now()) RETURNING COALESCE(event_id, 0), per_user_limit`
+	userRedemptionsTpl = `SELECT COUNT(1) FROM promo_redemptions WHERE code=$1 AND user_id=$2`
+	redeemPromoTpl     = `INSERT INTO promo_redemptions (code, order_id, user_id) VALUES ($1, $2, $3)`
+	setOrderPromoTpl   = `UPDATE orders SET promo_code=$2 WHERE id=$1`
+	releasePromoTpl    = `WITH r AS (DELETE FROM promo_redemptions WHERE order_id=$1 RETURNING code) UPDATE promo_codes p SET used=p.used-1 FROM r WHERE p.code=r.code AND p.used > 0`
+)
+
+// promoColumns are the columns scanPromo reads.
+const promoColumns = `code, COALESCE(event_id, 0), kind, value, max_uses, per_user_limit, valid_from, valid_until, used, COALESCE(owner_id, 0), disabled, created_at`
+
+var (
+	createPromoStmt     *sql.Stmt
+	getPromosStmt       *sql.Stmt
+	getPromoFullStmt    *sql.Stmt
+	updatePromoStmt     *sql.Stmt
+	getPromoStmt        *sql.Stmt
+	usePromoStmt        *sql.Stmt
+	userRedemptionsStmt *sql.Stmt
+	redeemPromoStmt     *sql.Stmt
+	setOrderPromoStmt   *sql.Stmt
+	releasePromoStmt    *sql.Stmt
+)
+
+var (
+	errPromoUnavailable   = errors.New("promo code does not exist, is not valid now or is used up")
+	errPromoNotApplicable = errors.New("promo code is not applicable to the ordered events")
+	errPromoUserLimit     = errors.New("promo code was already used the allowed number of times")
+)
+
+// promoModel is a discount code. A zero EventID makes it valid for any
+// event, zero MaxUses and PerUserLimit mean no limit. A code of an event is
+// managed by the event's owner too, a disabled code can't be redeemed.
+type promoModel struct {
+	Code         string     `json:"code"`
+	EventID      int        `json:"event_id,omitempty"`
+	Kind         string     `json:"kind"`
+	Value        int        `json:"value"`
+	MaxUses      int        `json:"max_uses"`
+	PerUserLimit int        `json:"per_user_limit"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	ValidUntil   *time.Time `json:"valid_until,omitempty"`
+	Used         int        `json:"used"`
+	OwnerID      int        `json:"owner_id,omitempty"`
+	Disabled     bool       `json:"disabled"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// promoUpdateModel changes the limits of a code or disables it, the fields
+// left out keep their values.
+type promoUpdateModel struct {
+	MaxUses      *int       `json:"max_uses,omitempty"`
+	PerUserLimit *int       `json:"per_user_limit,omitempty"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	ValidUntil   *time.Time `json:"valid_until,omitempty"`
+	Disabled     *bool      `json:"disabled,omitempty"`
+}
+
+func mustPreparePromoStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	createPromoStmt, err = db.PrepareContext(ctx, createPromoTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getPromosStmt, err = db.PrepareContext(ctx, getPromosTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getPromoFullStmt, err = db.PrepareContext(ctx, getPromoFullTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	updatePromoStmt, err = db.PrepareContext(ctx, updatePromoTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	getPromoStmt, err = db.PrepareContext(ctx, getPromoTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	usePromoStmt, err = db.PrepareContext(ctx, usePromoTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	userRedemptionsStmt, err = db.PrepareContext(ctx, userRedemptionsTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	redeemPromoStmt, err = db.PrepareContext(ctx, redeemPromoTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	setOrderPromoStmt, err = db.PrepareContext(ctx, setOrderPromoTpl)
+	if err != nil {
+		panic(err)
+	}
+
+	releasePromoStmt, err = db.PrepareContext(ctx, releasePromoTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func isPromoError(err error) bool {
+	return errors.Is(err, errPromoUnavailable) || errors.Is(err, errPromoNotApplicable) || errors.Is(err, errPromoUserLimit)
+}
+
+// redeemPromoTx takes one use of the order's promo code inside the order's
+// transaction, so a rejected code rejects the whole order. Taking the use
+// locks the code's row until commit, so concurrent orders can't overrun the
+// usage or per-user limits.
+func redeemPromoTx(tx *sql.Tx, oid, uid int, o *orderModel) error {
+	var eventID, perUser int
+	err := tx.Stmt(usePromoStmt).QueryRow(o.PromoCode).Scan(&eventID, &perUser)
+	if err == sql.ErrNoRows {
+		return errPromoUnavailable
+	}
+	if err != nil {
+		return err
+	}
+	if eventID != 0 {
+		found := false
+		for _, it := range o.Items {
+			if it.EventID == eventID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errPromoNotApplicable
+		}
+	}
+	if perUser > 0 {
+		n := 0
+		if err = tx.Stmt(userRedemptionsStmt).QueryRow(o.PromoCode, uid).Scan(&n); err != nil {
+			return err
+		}
+		if n >= perUser {
+			return errPromoUserLimit
+		}
+	}
+	if _, err = tx.Stmt(redeemPromoStmt).Exec(o.PromoCode, oid, uid); err != nil {
+		return err
+	}
+	_, err = tx.Stmt(setOrderPromoStmt).Exec(oid, o.PromoCode)
+	return err
+}
+
+// releasePromo gives the use of a cancelled order's promo code back.
+func releasePromo(oid int) error {
+	_, err := releasePromoStmt.Exec(oid)
+	return err
+}
+
+// orderDiscount calculates the discount of the order's promo code once the
+// prices of the items are known. A code scoped to an event discounts only
+// that event's items. The discount never exceeds the discounted amount.
+func orderDiscount(code string, items []orderItemModel, total int) (int, error) {
+	if code == "" {
+		return 0, nil
+	}
+	p := promoModel{}
+	if err := getPromoStmt.QueryRow(code).Scan(&p.Code, &p.EventID, &p.Kind, &p.Value); err != nil {
+		return 0, err
+	}
+	return promoDiscount(&p, items, total), nil
+}
+
+func promoDiscount(p *promoModel, items []orderItemModel, total int) int {
+	base := total
+	if p.EventID != 0 {
+		base = 0
+		for _, it := range items {
+			if it.EventID == p.EventID {
+				base += it.Price * it.Quantity
+			}
+		}
+	}
+	discount := p.Value
+	if p.Kind == promoPercent {
+		discount = base * p.Value / 100
+	}
+	if discount > base {
+		discount = base
+	}
+	return discount
+}
+
+func validatePromo(p *promoModel) error {
+	if p.Code == "" {
+		return errors.New("code is empty")
+	}
+	switch p.Kind {
+	case promoPercent:
+		if p.Value <= 0 || p.Value > 100 {
+			return fmt.Errorf("wrong percent value [%d]", p.Value)
+		}
+	case promoFixed:
+		if p.Value <= 0 {
+			return fmt.Errorf("wrong fixed value [%d]", p.Value)
+		}
+	default:
+		return fmt.Errorf("wrong kind [%s]", p.Kind)
+	}
+	if p.MaxUses < 0 || p.PerUserLimit < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if p.ValidFrom != nil && p.ValidUntil != nil && !p.ValidFrom.Before(*p.ValidUntil) {
+		return errors.New("valid_from must be before valid_until")
+	}
+	return nil
+}
+
+// scanPromo reads the promoColumns of a code.
+func scanPromo(row interface{ Scan(...interface{}) error }) (*promoModel, error) {
+	p := promoModel{}
+	from, until := sql.NullTime{}, sql.NullTime{}
+	if err := row.Scan(&p.Code, &p.EventID, &p.Kind, &p.Value, &p.MaxUses, &p.PerUserLimit, &from, &until, &p.Used, &p.OwnerID, &p.Disabled, &p.CreatedAt); err != nil {
+		return nil, err
+	}
+	if from.Valid {
+		p.ValidFrom = &from.Time
+	}
+	if until.Valid {
+		p.ValidUntil = &until.Time
+	}
+	return &p, nil
+}
+
+// promoEventOwner returns the owner of the event a code is scoped to. The
+// event is asked for as a service, so drafts are found too.
+func promoEventOwner(ctx context.Context, spanCtx opentracing.SpanContext, eid int) (int, error) {
+	e := &eventInfoModel{}
+	_, err := eventsClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       getEventPath + strconv.Itoa(eid),
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, e)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get event [%d]: %w", eid, err)
+	}
+	return e.OwnerID, nil
+}
+
+// createPromo handles POST /orders/promo/create. Admins create any code,
+// the owner of an event creates codes of that event only.
+func createPromo(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("creating promo code", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	p := promoModel{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse promo code: %s\n", err)
+		return
+	}
+	if p.EventID == 0 && !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Only admins create codes for every event")
+		return
+	}
+	if err := validatePromo(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong promo code: %s", err)
+		return
+	}
+	if p.EventID != 0 {
+		owner, err := promoEventOwner(r.Context(), span.Context(), p.EventID)
+		if err != nil || !canAccess(r, owner) {
+			log.Printf("Could not find event [%d] for promo code [%s]: %v\n", p.EventID, p.Code, err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		p.OwnerID = owner
+	}
+	var code string
+	err := createPromoStmt.QueryRow(p.Code, p.EventID, p.Kind, p.Value, p.MaxUses, p.PerUserLimit, p.ValidFrom, p.ValidUntil, p.OwnerID).Scan(&code)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Promo code [%s] already exists", p.Code)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create promo code [%s]: %s\n", p.Code, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Successfully created promo code [%s]\n", p.Code)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+// getPromos handles GET /orders/promo, admins get every code, other users
+// the codes of their events.
+func getPromos(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("getting promo codes", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if isAdmin(r) {
+		uid = 0
+	}
+	rows, err := getPromosStmt.Query(uid)
+	if err != nil {
+		log.Printf("Failed to get promo codes: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	promos := []promoModel{}
+	for rows.Next() {
+		p, err := scanPromo(rows)
+		if err != nil {
+			log.Printf("Failed to scan promo code: %s\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		promos = append(promos, *p)
+	}
+	data, _ := json.MarshalIndent(promos, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// updatePromo handles POST /orders/promo/manage/{code}. It changes the
+// limits and validity of a code or disables it, so a leaked code can be
+// revoked; the orders that already redeemed it keep their discount.
+func updatePromo(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("updating promo code", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	code := mux.Vars(r)["code"]
+	p, err := scanPromo(getPromoFullStmt.QueryRow(code))
+	if err != nil || (p.OwnerID == 0 && !isAdmin(r)) || !canAccess(r, p.OwnerID) {
+		log.Printf("Could not find promo code [%s]: %v\n", code, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	u := promoUpdateModel{}
+	if err = json.NewDecoder(r.Body).Decode(&u); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse update of promo code [%s]: %s\n", code, err)
+		return
+	}
+	u.apply(p)
+	if err = validatePromo(p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong promo code: %s", err)
+		return
+	}
+	if _, err = updatePromoStmt.Exec(p.Code, p.MaxUses, p.PerUserLimit, p.ValidFrom, p.ValidUntil, p.Disabled); err != nil {
+		log.Printf("Failed to update promo code [%s]: %s\n", code, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Promo code [%s] was updated, disabled [%t]\n", code, p.Disabled)
+	data, _ := json.MarshalIndent(p, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (u *promoUpdateModel) apply(p *promoModel) {
+	if u.MaxUses != nil {
+		p.MaxUses = *u.MaxUses
+	}
+	if u.PerUserLimit != nil {
+		p.PerUserLimit = *u.PerUserLimit
+	}
+	if u.ValidFrom != nil {
+		p.ValidFrom = u.ValidFrom
+	}
+	if u.ValidUntil != nil {
+		p.ValidUntil = u.ValidUntil
+	}
+	if u.Disabled != nil {
+		p.Disabled = *u.Disabled
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lib/servicetest"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// createTestPromo creates a code of event 1 as its owner.
+func createTestPromo(t *testing.T) string {
+	t.Helper()
+	code := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	body := fmt.Sprintf(`{"code":%q,"kind":"percent","value":10,"event_id":1}`, code)
+	w := httptest.NewRecorder()
+	createPromo(w, servicetest.NewRequest(http.MethodPost, "/orders/promo/create", body, servicetest.Owner, "", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("createPromo() status = %d: %s", w.Code, w.Body)
+	}
+	return code
+}
+
+func TestCreatePromoAccess(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name    string
+		uid     int
+		role    string
+		eventID int
+		want    int
+	}{
+		{name: "stranger", uid: servicetest.Stranger, eventID: 1, want: http.StatusNotFound},
+		{name: "owner", uid: servicetest.Owner, eventID: 1, want: http.StatusOK},
+		{name: "admin", uid: servicetest.Admin, role: roleAdmin, eventID: 1, want: http.StatusOK},
+		{name: "owner for every event", uid: servicetest.Owner, want: http.StatusForbidden},
+		{name: "admin for every event", uid: servicetest.Admin, role: roleAdmin, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"code":"%s-%d","kind":"fixed","value":5,"event_id":%d}`, t.Name(), time.Now().UnixNano(), tt.eventID)
+			w := httptest.NewRecorder()
+			createPromo(w, servicetest.NewRequest(http.MethodPost, "/orders/promo/create", body, tt.uid, tt.role, nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestUpdatePromoAccess(t *testing.T) {
+	setupTestDB(t)
+
+	for _, c := range servicetest.AccessCallers {
+		t.Run(c.Name, func(t *testing.T) {
+			code := createTestPromo(t)
+			w := httptest.NewRecorder()
+			r := servicetest.NewRequest(http.MethodPost, "/orders/promo/manage/"+code, `{"max_uses":5}`, c.UID, c.Role, map[string]string{"code": code})
+			updatePromo(w, r)
+			if w.Code != c.Want {
+				t.Errorf("status = %d, want %d: %s", w.Code, c.Want, w.Body)
+			}
+		})
+	}
+}
+
+func TestPromoListAccess(t *testing.T) {
+	setupTestDB(t)
+
+	code := createTestPromo(t)
+	for _, c := range servicetest.AccessCallers {
+		t.Run(c.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			getPromos(w, servicetest.NewRequest(http.MethodGet, "/orders/promo", "", c.UID, c.Role, nil))
+			promos := []promoModel{}
+			if err := json.Unmarshal(w.Body.Bytes(), &promos); err != nil {
+				t.Fatal(err)
+			}
+			listed := false
+			for _, p := range promos {
+				listed = listed || p.Code == code
+			}
+			if want := c.Want == http.StatusOK; listed != want {
+				t.Errorf("code listed = %t, want %t", listed, want)
+			}
+		})
+	}
+}
+
+func TestDisabledPromo(t *testing.T) {
+	setupTestDB(t)
+
+	code := createTestPromo(t)
+	w := httptest.NewRecorder()
+	updatePromo(w, servicetest.NewRequest(http.MethodPost, "/orders/promo/manage/"+code, `{"disabled":true}`, servicetest.Owner, "", map[string]string{"code": code}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("updatePromo() status = %d: %s", w.Code, w.Body)
+	}
+	o := orderModel{EventID: 1, PromoCode: code, Items: []orderItemModel{{EventID: 1, Quantity: 1}}}
+	if _, err := order(opentracing.NoopTracer{}.StartSpan("test").Context(), servicetest.Owner, &o, ""); !errors.Is(err, errPromoUnavailable) {
+		t.Errorf("order() = %v, want %v", err, errPromoUnavailable)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"lib/client"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	checkPromoTpl = `SELECT code, COALESCE(event_id, 0), kind, value, per_user_limit FROM promo_codes WHERE code=$1 AND NOT disabled AND (max_uses=0 OR used < max_uses) AND (valid_from IS NULL OR valid_from <= now()) AND (valid_until IS NULL OR valid_until > now())`
+	balancePath   = "/account/get"
+)
+
+// Reasons an order would be cancelled or rejected if it was created now.
+const (
+	reasonEventNotFound      = "event_not_found"
+	reasonEventClosed        = "event_closed"
+	reasonTicketType         = "ticket_type_unavailable"
+	reasonNotEnoughSlots     = "not_enough_slots"
+	reasonPromoUnavailable   = "promo_unavailable"
+	reasonPromoNotApplicable = "promo_not_applicable"
+	reasonPromoUserLimit     = "promo_user_limit"
+	reasonNotEnoughBalance   = "not_enough_balance"
+)
+
+var (
+	checkPromoStmt *sql.Stmt
+)
+
+type blockingReasonModel struct {
+	Reason  string `json:"reason"`
+	EventID int    `json:"event_id,omitempty"`
+	Message string `json:"message"`
+}
+
+type quoteItemModel struct {
+	EventID        int    `json:"event_id"`
+	Name           string `json:"event_name,omitempty"`
+	TicketTypeID   int    `json:"ticket_type_id,omitempty"`
+	TicketType     string `json:"ticket_type,omitempty"`
+	Quantity       int    `json:"quantity"`
+	Price          int    `json:"price"`
+	AvailableSlots int    `json:"available_slots"`
+}
+
+// quoteModel is what the order would cost right now and why it would fail.
+// Nothing is held or charged, so the answer may be outdated a moment later.
+type quoteModel struct {
+	Items     []quoteItemModel      `json:"items"`
+	Total     int                   `json:"total"`
+	PromoCode string                `json:"promo_code,omitempty"`
+	Discount  int                   `json:"discount"`
+	Price     int                   `json:"price"`
+	Balance   int                   `json:"balance"`
+	OK        bool                  `json:"ok"`
+	Blocking  []blockingReasonModel `json:"blocking"`
+}
+
+type balanceModel struct {
+	Balance int `json:"balance"`
+}
+
+func mustPrepareQuoteStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	checkPromoStmt, err = db.PrepareContext(ctx, checkPromoTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// checkPromo applies the same rules as redeemPromoTx without taking a use of
+// the code.
+func checkPromo(uid int, code string, items []orderItemModel, total int) (int, error) {
+	p := promoModel{}
+	err := checkPromoStmt.QueryRow(code).Scan(&p.Code, &p.EventID, &p.Kind, &p.Value, &p.PerUserLimit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errPromoUnavailable
+	}
+	if err != nil {
+		return 0, err
+	}
+	if p.EventID != 0 {
+		found := false
+		for _, it := range items {
+			if it.EventID == p.EventID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errPromoNotApplicable
+		}
+	}
+	if p.PerUserLimit > 0 {
+		n := 0
+		if err = userRedemptionsStmt.QueryRow(code, uid).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n >= p.PerUserLimit {
+			return 0, errPromoUserLimit
+		}
+	}
+	return promoDiscount(&p, items, total), nil
+}
+
+func getBalance(ctx context.Context, spanCtx opentracing.SpanContext, uid int) (int, error) {
+	b := balanceModel{}
+	_, err := accountClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       balancePath,
+		UserID:     uid,
+		Idempotent: true,
+	}, &b)
+	return b.Balance, err
+}
+
+// eligible mirrors the role check of events.
+func (t *ticketTypeModel) eligible(role string) bool {
+	if len(t.Roles) == 0 {
+		return true
+	}
+	for _, r := range t.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteTicketType finds the ticket type of the item the way events does: the
+// named one, or the cheapest the user may buy now. It returns why the type
+// can't be taken, if so.
+func quoteTicketType(e *eventInfoModel, it *orderItemModel, role string) (*ticketTypeModel, string) {
+	usable := func(t *ticketTypeModel) string {
+		switch {
+		case !t.OnSale:
+			return fmt.Sprintf("ticket type %s is not on sale", t.Name)
+		case !t.eligible(role):
+			return fmt.Sprintf("ticket type %s is not for your role", t.Name)
+		case t.MaxPerOrder > 0 && it.Quantity > t.MaxPerOrder:
+			return fmt.Sprintf("ticket type %s is limited to %d per order", t.Name, t.MaxPerOrder)
+		}
+		return ""
+	}
+	if it.TicketTypeID != 0 {
+		for i := range e.TicketTypes {
+			if t := &e.TicketTypes[i]; t.ID == it.TicketTypeID {
+				return t, usable(t)
+			}
+		}
+		return nil, fmt.Sprintf("event %d has no ticket type %d", e.ID, it.TicketTypeID)
+	}
+	for i := range e.TicketTypes {
+		if t := &e.TicketTypes[i]; usable(t) == "" && t.Available >= it.Quantity {
+			return t, ""
+		}
+	}
+	return nil, fmt.Sprintf("no ticket type of event %d can be bought now", e.ID)
+}
+
+// quoteOrder runs the checks of the order's saga against the current state of
+// events, account and the promo code.
+func quoteOrder(ctx context.Context, spanCtx opentracing.SpanContext, uid int, o *orderModel) (*quoteModel, error) {
+	span := tracer.StartSpan("quoting order", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	q := &quoteModel{Items: []quoteItemModel{}, PromoCode: o.PromoCode, Blocking: []blockingReasonModel{}}
+	block := func(reason string, eid int, format string, args ...interface{}) {
+		q.Blocking = append(q.Blocking, blockingReasonModel{Reason: reason, EventID: eid, Message: fmt.Sprintf(format, args...)})
+	}
+	priced := []orderItemModel{}
+	for _, it := range o.Items {
+		e, err := getEventInfo(ctx, span.Context(), uid, it.EventID)
+		var se *client.StatusError
+		if errors.As(err, &se) && se.StatusCode < 500 {
+			block(reasonEventNotFound, it.EventID, "event %d does not exist", it.EventID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		qi := quoteItemModel{EventID: e.ID, Name: e.Name, Quantity: it.Quantity, Price: e.CurrentPrice, AvailableSlots: e.AvailableSlots}
+		if len(e.TicketTypes) > 0 {
+			t, reason := quoteTicketType(e, &it, o.Role)
+			if t == nil || reason != "" {
+				block(reasonTicketType, e.ID, "%s", reason)
+			}
+			if t != nil {
+				qi.TicketTypeID, qi.TicketType, qi.Price, qi.AvailableSlots = t.ID, t.Name, t.CurrentPrice, t.Available
+			}
+		}
+		q.Items = append(q.Items, qi)
+		priced = append(priced, orderItemModel{EventID: e.ID, Quantity: it.Quantity, Price: qi.Price, TicketTypeID: qi.TicketTypeID})
+		q.Total += qi.Price * it.Quantity
+		if !e.RegistrationOpen {
+			block(reasonEventClosed, e.ID, "event %d is not open for orders", e.ID)
+		} else if qi.AvailableSlots < it.Quantity {
+			block(reasonNotEnoughSlots, e.ID, "%d slots requested, %d available", it.Quantity, qi.AvailableSlots)
+		}
+	}
+	if o.PromoCode != "" {
+		discount, err := checkPromo(uid, o.PromoCode, priced, q.Total)
+		switch {
+		case errors.Is(err, errPromoUnavailable):
+			block(reasonPromoUnavailable, 0, "%s", err)
+		case errors.Is(err, errPromoNotApplicable):
+			block(reasonPromoNotApplicable, 0, "%s", err)
+		case errors.Is(err, errPromoUserLimit):
+			block(reasonPromoUserLimit, 0, "%s", err)
+		case err != nil:
+			return nil, err
+		}
+		q.Discount = discount
+	}
+	q.Price = q.Total - q.Discount
+	balance, err := getBalance(ctx, span.Context(), uid)
+	if err != nil {
+		return nil, err
+	}
+	q.Balance = balance
+	if balance < q.Price {
+		block(reasonNotEnoughBalance, 0, "price is %d, balance is %d", q.Price, balance)
+	}
+	q.OK = len(q.Blocking) == 0
+	return q, nil
+}
+
+// quote handles POST /orders/quote. It takes the same body as create and
+// returns the final price and the reasons the order would fail, if any.
+func quote(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for order quote", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o := orderModel{}
+	if err = json.NewDecoder(r.Body).Decode(&o); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse quote request of user [%d]: %s\n", uid, err)
+		return
+	}
+	if err = normalizeItems(&o); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Wrong order: %s", err)
+		return
+	}
+	o.Role = r.Header.Get("X-User-Role")
+	q, err := quoteOrder(r.Context(), span.Context(), uid, &o)
+	if err != nil {
+		log.Printf("Failed to quote order of user [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	data, _ := json.MarshalIndent(q, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
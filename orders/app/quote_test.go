@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"lib/client"
+	"lib/servicetest"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestQuoteTicketType(t *testing.T) {
+	e := &eventInfoModel{ID: 47, TicketTypes: []ticketTypeModel{
+		{ID: 1, Name: "early", CurrentPrice: 10, Available: 5},
+		{ID: 2, Name: "staff", CurrentPrice: 15, Available: 5, OnSale: true, Roles: []string{"staff"}},
+		{ID: 3, Name: "standard", CurrentPrice: 20, Available: 1, OnSale: true, MaxPerOrder: 2},
+		{ID: 4, Name: "vip", CurrentPrice: 50, Available: 10, OnSale: true},
+	}}
+	tests := []struct {
+		name       string
+		item       orderItemModel
+		role       string
+		wantID     int
+		wantReason bool
+	}{
+		{name: "named", item: orderItemModel{TicketTypeID: 3, Quantity: 1}, wantID: 3},
+		{name: "not on sale", item: orderItemModel{TicketTypeID: 1, Quantity: 1}, wantID: 1, wantReason: true},
+		{name: "not for the role", item: orderItemModel{TicketTypeID: 2, Quantity: 1}, wantID: 2, wantReason: true},
+		{name: "for the role", item: orderItemModel{TicketTypeID: 2, Quantity: 1}, role: "staff", wantID: 2},
+		{name: "over the order limit", item: orderItemModel{TicketTypeID: 3, Quantity: 3}, wantID: 3, wantReason: true},
+		{name: "unknown", item: orderItemModel{TicketTypeID: 9, Quantity: 1}, wantReason: true},
+		{name: "first usable", item: orderItemModel{Quantity: 1}, wantID: 3},
+		{name: "first usable for the role", item: orderItemModel{Quantity: 1}, role: "staff", wantID: 2},
+		{name: "first with enough left", item: orderItemModel{Quantity: 2}, wantID: 4},
+		{name: "none with enough left", item: orderItemModel{Quantity: 20}, wantReason: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := quoteTicketType(e, &tt.item, tt.role)
+			id := 0
+			if got != nil {
+				id = got.ID
+			}
+			if id != tt.wantID || (reason != "") != tt.wantReason {
+				t.Errorf("quoteTicketType() = %d, %q, want %d, reason %t", id, reason, tt.wantID, tt.wantReason)
+			}
+		})
+	}
+}
+
+// stubQuoteServices replaces events and account with a stub that knows the
+// events and answers the balance.
+func stubQuoteServices(t *testing.T, events map[int]eventInfoModel, balance int) {
+	t.Helper()
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == balancePath {
+			json.NewEncoder(w).Encode(balanceModel{Balance: balance})
+			return
+		}
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, getEventPath))
+		e, ok := events[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(e)
+	}))
+	prevTracer, prevEvents, prevAccount := tracer, eventsClient, accountClient
+	t.Cleanup(func() {
+		stub.Close()
+		tracer, eventsClient, accountClient = prevTracer, prevEvents, prevAccount
+	})
+	tracer = opentracing.NoopTracer{}
+	cfg := client.Config{BaseURL: stub.URL, Timeout: time.Second}
+	eventsClient = client.New(tracer, cfg)
+	accountClient = client.New(tracer, cfg)
+}
+
+func TestQuoteOrderBlocking(t *testing.T) {
+	events := map[int]eventInfoModel{
+		1: {ID: 1, CurrentPrice: 10, AvailableSlots: 5, RegistrationOpen: true},
+		2: {ID: 2, CurrentPrice: 10, AvailableSlots: 5},
+		3: {ID: 3, CurrentPrice: 10, AvailableSlots: 1, RegistrationOpen: true},
+		4: {ID: 4, AvailableSlots: 5, RegistrationOpen: true, TicketTypes: []ticketTypeModel{{ID: 7, Name: "staff", CurrentPrice: 30, Available: 5, OnSale: true, Roles: []string{"staff"}}}},
+	}
+	tests := []struct {
+		name      string
+		items     []orderItemModel
+		role      string
+		balance   int
+		wantPrice int
+		want      []string
+	}{
+		{name: "ok", items: []orderItemModel{{EventID: 1, Quantity: 2}}, balance: 20, wantPrice: 20, want: []string{}},
+		{name: "missing event", items: []orderItemModel{{EventID: 9, Quantity: 1}}, want: []string{reasonEventNotFound}},
+		{name: "closed event", items: []orderItemModel{{EventID: 2, Quantity: 1}}, balance: 10, wantPrice: 10, want: []string{reasonEventClosed}},
+		{name: "sold out", items: []orderItemModel{{EventID: 3, Quantity: 2}}, balance: 20, wantPrice: 20, want: []string{reasonNotEnoughSlots}},
+		{name: "ticket type", items: []orderItemModel{{EventID: 4, Quantity: 1}}, balance: 100, want: []string{reasonTicketType}},
+		{name: "ticket type for the role", items: []orderItemModel{{EventID: 4, Quantity: 1}}, role: "staff", balance: 30, wantPrice: 30, want: []string{}},
+		{name: "balance", items: []orderItemModel{{EventID: 1, Quantity: 1}}, balance: 5, wantPrice: 10, want: []string{reasonNotEnoughBalance}},
+		{name: "every reason", items: []orderItemModel{{EventID: 9, Quantity: 1}, {EventID: 2, Quantity: 1}, {EventID: 3, Quantity: 3}}, wantPrice: 40, want: []string{reasonEventNotFound, reasonEventClosed, reasonNotEnoughSlots, reasonNotEnoughBalance}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubQuoteServices(t, events, tt.balance)
+			q, err := quoteOrder(context.Background(), opentracing.NoopTracer{}.StartSpan("test").Context(), servicetest.Owner, &orderModel{Items: tt.items, Role: tt.role})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, b := range q.Blocking {
+				got = append(got, b.Reason)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("blocking = %v, want %v", got, tt.want)
+			}
+			if q.Price != tt.wantPrice || q.OK != (len(tt.want) == 0) {
+				t.Errorf("price = %d, ok = %t, want %d, %t", q.Price, q.OK, tt.wantPrice, len(tt.want) == 0)
+			}
+		})
+	}
+}
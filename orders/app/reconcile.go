@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"lib/client"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	reconcileOrdersTpl       = `SELECT o.id, o.user_id, COALESCE(o.payer_id, o.user_id), o.status, o.price, o.kept, o.updated_at, COALESCE(SUM(i.quantity), 0) FROM orders o LEFT JOIN order_items i ON i.order_id=o.id GROUP BY o.id`
+	orderSlotsPath           = "/events/admin/slots"
+	orderLedgersPath         = "/account/admin/orders"
+	defaultReconcileInterval = time.Hour
+	// orders changed more recently may still be in the middle of the saga
+	reconcileGrace = 10 * time.Minute
+)
+
+// Mismatch categories. Only the ones marked safe are repaired automatically,
+// the rest need a look from an admin.
+const (
+	// a paid order has fewer confirmed slots than ordered; safe to confirm
+	// when the missing slots are still held
+	mismatchPaidWithoutSlots = "paid_without_slots"
+	// a cancelled order still has slots; safe to release them
+	mismatchSlotsOfCancelled = "slots_of_cancelled_order"
+	// slots belong to an order orders doesn't know; safe to release them
+	mismatchSlotsOfUnknown = "slots_of_unknown_order"
+	// an order waiting for payment has not as many slots as ordered
+	mismatchSlotCount = "slot_count_mismatch"
+	// money was kept for an order that is not paid beyond what its refund
+	// policy allows; safe to refund when the order is cancelled
+	mismatchChargeWithoutPaid = "charge_without_paid_order"
+	// a paid order was charged less than its price
+	mismatchPaidWithoutCharge = "paid_without_charge"
+	// money was moved for an order orders doesn't know
+	mismatchChargeOfUnknown = "charge_of_unknown_order"
+)
+
+var (
+	reconcileInterval = defaultReconcileInterval
+	reconcileRepair   bool
+)
+
+type mismatchModel struct {
+	Category    string `json:"category"`
+	OrderID     int    `json:"order_id"`
+	UserID      int    `json:"user_id"`
+	Details     string `json:"details"`
+	Repaired    bool   `json:"repaired,omitempty"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+type reconcileReportModel struct {
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt time.Time       `json:"finished_at"`
+	Repair     bool            `json:"repair"`
+	Counts     map[string]int  `json:"counts"`
+	Mismatches []mismatchModel `json:"mismatches"`
+}
+
+type orderSlotsModel struct {
+	OrderID   int `json:"order_id"`
+	UserID    int `json:"user_id"`
+	Held      int `json:"held"`
+	Confirmed int `json:"confirmed"`
+}
+
+type orderLedgerModel struct {
+	OrderID   int `json:"order_id"`
+	UserID    int `json:"user_id"`
+	Withdrawn int `json:"withdrawn"`
+	Refunded  int `json:"refunded"`
+}
+
+type reconcileOrderModel struct {
+	ID        int
+	UserID    int
+	PayerID   int
+	Status    int
+	Price     int
+	Kept      int
+	UpdatedAt time.Time
+	Quantity  int
+}
+
+// adminHeader lets orders call the admin endpoints of the other services.
+func adminHeader() http.Header {
+	return http.Header{"X-User-Id": {"0"}, "X-User-Role": {roleAdmin}}
+}
+
+func getReconcileOrders() (map[int]*reconcileOrderModel, error) {
+	rows, err := db.Query(reconcileOrdersTpl)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := map[int]*reconcileOrderModel{}
+	for rows.Next() {
+		o := &reconcileOrderModel{}
+		if err = rows.Scan(&o.ID, &o.UserID, &o.PayerID, &o.Status, &o.Price, &o.Kept, &o.UpdatedAt, &o.Quantity); err != nil {
+			return nil, err
+		}
+		orders[o.ID] = o
+	}
+	return orders, rows.Err()
+}
+
+// sumLedgers adds up the ledger of each order. Account reports an entry per
+// order and user: a transferred order is charged to the payer and may be
+// refunded to someone else.
+func sumLedgers(ledgers []orderLedgerModel) map[int]orderLedgerModel {
+	ledgerOf := map[int]orderLedgerModel{}
+	for _, l := range ledgers {
+		sum, ok := ledgerOf[l.OrderID]
+		if !ok {
+			sum = orderLedgerModel{OrderID: l.OrderID, UserID: l.UserID}
+		}
+		sum.Withdrawn += l.Withdrawn
+		sum.Refunded += l.Refunded
+		ledgerOf[l.OrderID] = sum
+	}
+	return ledgerOf
+}
+
+// reconcile compares orders with the slots of events and the ledger of
+// account. Slots and ledger are read before the orders, so anything they
+// mention was created before the orders were read.
+func reconcile(ctx context.Context, spanCtx opentracing.SpanContext, repair bool) (*reconcileReportModel, error) {
+	span := tracer.StartSpan("reconciling orders, slots and ledger", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	report := &reconcileReportModel{StartedAt: time.Now(), Repair: repair, Counts: map[string]int{}, Mismatches: []mismatchModel{}}
+	slots := []orderSlotsModel{}
+	_, err := eventsClient.Do(ctx, span.Context(), &client.Request{
+		Method:     http.MethodGet,
+		Path:       orderSlotsPath,
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, &slots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get slots: %w", err)
+	}
+	ledgers := []orderLedgerModel{}
+	_, err = accountClient.Do(ctx, span.Context(), &client.Request{
+		Method:     http.MethodGet,
+		Path:       orderLedgersPath,
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, &ledgers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ledgers: %w", err)
+	}
+	orders, err := getReconcileOrders()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orders: %w", err)
+	}
+	settled := time.Now().Add(-reconcileGrace)
+	add := func(m mismatchModel, fix func() error) {
+		if repair && fix != nil {
+			if err := fix(); err != nil {
+				m.RepairError = err.Error()
+			} else {
+				m.Repaired = true
+			}
+		}
+		report.Counts[m.Category]++
+		report.Mismatches = append(report.Mismatches, m)
+	}
+
+	slotsOf := map[int]orderSlotsModel{}
+	for _, s := range slots {
+		slotsOf[s.OrderID] = s
+		o, ok := orders[s.OrderID]
+		if !ok {
+			s := s
+			add(mismatchModel{Category: mismatchSlotsOfUnknown, OrderID: s.OrderID, UserID: s.UserID,
+				Details: fmt.Sprintf("%d held and %d confirmed slots", s.Held, s.Confirmed)},
+				func() error { return cancelSlot(ctx, span.Context(), &orderModel{ID: s.OrderID, UserID: s.UserID}) })
+			continue
+		}
+		if o.Status == statusCancelled && o.UpdatedAt.Before(settled) {
+			add(mismatchModel{Category: mismatchSlotsOfCancelled, OrderID: o.ID, UserID: o.UserID,
+				Details: fmt.Sprintf("%d held and %d confirmed slots", s.Held, s.Confirmed)},
+				func() error { return cancelSlot(ctx, span.Context(), &orderModel{ID: o.ID, UserID: o.UserID}) })
+		}
+	}
+	for _, o := range orders {
+		if o.UpdatedAt.After(settled) {
+			continue
+		}
+		o := o
+		s := slotsOf[o.ID]
+		switch o.Status {
+		case StatusPaid, statusCompleted:
+			if s.Confirmed >= o.Quantity {
+				break
+			}
+			var fix func() error
+			if s.Confirmed+s.Held >= o.Quantity {
+				fix = func() error { return confirmSlot(ctx, span.Context(), &orderModel{ID: o.ID, UserID: o.UserID}) }
+			}
+			add(mismatchModel{Category: mismatchPaidWithoutSlots, OrderID: o.ID, UserID: o.UserID,
+				Details: fmt.Sprintf("%d ordered, %d confirmed and %d held slots", o.Quantity, s.Confirmed, s.Held)}, fix)
+		case statusOccupied, statusNeedToPay:
+			if s.Held+s.Confirmed != o.Quantity {
+				add(mismatchModel{Category: mismatchSlotCount, OrderID: o.ID, UserID: o.UserID,
+					Details: fmt.Sprintf("%d ordered, %d held and %d confirmed slots", o.Quantity, s.Held, s.Confirmed)}, nil)
+			}
+		}
+	}
+
+	ledgerOf := sumLedgers(ledgers)
+	for _, l := range ledgerOf {
+		if _, ok := orders[l.OrderID]; !ok {
+			add(mismatchModel{Category: mismatchChargeOfUnknown, OrderID: l.OrderID, UserID: l.UserID,
+				Details: fmt.Sprintf("withdrawn %d, refunded %d", l.Withdrawn, l.Refunded)}, nil)
+		}
+	}
+	for _, o := range orders {
+		if o.UpdatedAt.After(settled) {
+			continue
+		}
+		o := o
+		l := ledgerOf[o.ID]
+		charged := l.Withdrawn - l.Refunded
+		paid := o.Status == StatusPaid || o.Status == statusCompleted
+		if !paid && charged > o.Kept {
+			var fix func() error
+			if o.Status == statusCancelled {
+				fix = func() error {
+					return refundOrder(ctx, span.Context(), &orderModel{ID: o.ID, UserID: o.PayerID, Price: charged - o.Kept})
+				}
+			}
+			add(mismatchModel{Category: mismatchChargeWithoutPaid, OrderID: o.ID, UserID: o.UserID,
+				Details: fmt.Sprintf("order has status [%s], charged %d, kept %d", statusName(o.Status), charged, o.Kept)}, fix)
+		}
+		if paid && charged < o.Price {
+			add(mismatchModel{Category: mismatchPaidWithoutCharge, OrderID: o.ID, UserID: o.UserID,
+				Details: fmt.Sprintf("price %d, charged %d", o.Price, charged)}, nil)
+		}
+	}
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+func logReport(report *reconcileReportModel) {
+	if len(report.Mismatches) == 0 {
+		log.Println("Reconciliation found no mismatches")
+		return
+	}
+	log.Printf("Reconciliation found [%d] mismatches: %v\n", len(report.Mismatches), report.Counts)
+	for _, m := range report.Mismatches {
+		log.Printf("Mismatch [%s] for order [%d] of user [%d]: %s, repaired [%t] %s\n", m.Category, m.OrderID, m.UserID, m.Details, m.Repaired, m.RepairError)
+	}
+}
+
+// runReconciliation checks the services periodically. A zero interval
+// turns the job off, it can still be run by an admin.
+func runReconciliation(ctx context.Context) {
+	if reconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := reconcile(ctx, nil, reconcileRepair)
+		if err != nil {
+			log.Printf("Failed to reconcile: %s\n", err)
+			continue
+		}
+		logReport(report)
+	}
+}
+
+// reconcileNow runs the reconciliation for an admin. Repairs are applied
+// only when asked for with repair=true.
+func reconcileNow(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for reconciliation", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	report, err := reconcile(r.Context(), span.Context(), r.URL.Query().Get("repair") == "true")
+	if err != nil {
+		log.Printf("Failed to reconcile: %s\n", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Failed to reconcile: %s", err)
+		return
+	}
+	logReport(report)
+	data, _ := json.MarshalIndent(report, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSumLedgers(t *testing.T) {
+	ledgers := []orderLedgerModel{
+		{OrderID: 1, UserID: 10, Withdrawn: 100},
+		{OrderID: 1, UserID: 20, Refunded: 60},
+		{OrderID: 2, UserID: 10, Withdrawn: 50, Refunded: 50},
+	}
+	got := sumLedgers(ledgers)
+	want := map[int]orderLedgerModel{
+		1: {OrderID: 1, UserID: 10, Withdrawn: 100, Refunded: 60},
+		2: {OrderID: 2, UserID: 10, Withdrawn: 50, Refunded: 50},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d orders, want %d", len(got), len(want))
+	}
+	for oid, w := range want {
+		if got[oid] != w {
+			t.Errorf("ledger of order [%d] = %+v, want %+v", oid, got[oid], w)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"lib/client"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	setKeptTpl   = `UPDATE orders SET kept=$2 WHERE id=$1`
+	getEventPath = "/events/get/"
+)
+
+var (
+	setKeptStmt *sql.Stmt
+)
+
+var errRefundChanged = errors.New("refund amount has changed")
+
+// refundRuleModel refunds Percent of the price when the order is cancelled
+// at least HoursBefore hours before the event starts.
+type refundRuleModel struct {
+	HoursBefore int `json:"hours_before"`
+	Percent     int `json:"percent"`
+}
+
+// eventCancelled is the status events reports for a cancelled event.
+const eventCancelled = "cancelled"
+
+// eventInfoModel is the part of an event orders depends on.
+type eventInfoModel struct {
+	ID                int               `json:"id"`
+	Name              string            `json:"event_name"`
+	Price             int               `json:"price"`
+	CurrentPrice      int               `json:"current_price"`
+	AvailableSlots    int               `json:"available_slots"`
+	RegistrationOpen  bool              `json:"registration_open"`
+	StartsAt          *time.Time        `json:"starts_at,omitempty"`
+	RefundPolicy      []refundRuleModel `json:"refund_policy,omitempty"`
+	TransfersDisabled bool              `json:"transfers_disabled,omitempty"`
+	TicketTypes       []ticketTypeModel `json:"ticket_types,omitempty"`
+	OwnerID           int               `json:"owner_id,omitempty"`
+
+	// the rest goes to the calendar feed
+	Status      string     `json:"status,omitempty"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	Venue       string     `json:"venue,omitempty"`
+	Address     string     `json:"address,omitempty"`
+	Description string     `json:"description,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// ticketTypeModel is a kind of ticket of an event with its own price and
+// quota, as events reports it.
+type ticketTypeModel struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name"`
+	Price        int      `json:"price"`
+	CurrentPrice int      `json:"current_price"`
+	Roles        []string `json:"roles,omitempty"`
+	MaxPerOrder  int      `json:"max_per_order,omitempty"`
+	Available    int      `json:"available"`
+	OnSale       bool     `json:"on_sale"`
+}
+
+// refundItemModel shows how the refund of one order item was found: the
+// event's policy and the rule that applies now, if any.
+type refundItemModel struct {
+	EventID  int               `json:"event_id"`
+	StartsAt *time.Time        `json:"starts_at,omitempty"`
+	Policy   []refundRuleModel `json:"policy,omitempty"`
+	Rule     *refundRuleModel  `json:"rule,omitempty"`
+	Percent  int               `json:"percent"`
+}
+
+// refundQuoteModel is what the user gets back when the order is cancelled
+// right now. The quote expires with the next rule, it is checked again on
+// cancellation.
+type refundQuoteModel struct {
+	Amount   int               `json:"amount"`
+	Items    []refundItemModel `json:"items"`
+	QuotedAt time.Time         `json:"quoted_at"`
+}
+
+type cancelRequestModel struct {
+	// Refund is the amount the user agreed to, the check is skipped without it
+	Refund *int `json:"refund,omitempty"`
+}
+
+func mustPrepareRefundStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	setKeptStmt, err = db.PrepareContext(ctx, setKeptTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// refundPercent picks the rule with the most hours before the start that
+// still holds. An event without a start or a policy is refunded in full,
+// with a policy but no matching rule nothing is refunded.
+func refundPercent(e *eventInfoModel, now time.Time) (int, *refundRuleModel) {
+	if e.StartsAt == nil || len(e.RefundPolicy) == 0 {
+		return 100, nil
+	}
+	rules := append([]refundRuleModel{}, e.RefundPolicy...)
+	sort.Slice(rules, func(i, j int) bool { return rules[i].HoursBefore > rules[j].HoursBefore })
+	for i := range rules {
+		if !now.After(e.StartsAt.Add(-time.Duration(rules[i].HoursBefore) * time.Hour)) {
+			return rules[i].Percent, &rules[i]
+		}
+	}
+	return 0, nil
+}
+
+func getEventInfo(ctx context.Context, spanCtx opentracing.SpanContext, uid, eid int) (*eventInfoModel, error) {
+	e := &eventInfoModel{}
+	_, err := eventsClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       getEventPath + strconv.Itoa(eid),
+		UserID:     uid,
+		Idempotent: true,
+	}, e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event [%d]: %w", eid, err)
+	}
+	return e, nil
+}
+
+// quoteRefund calculates the refund of a paid order. Each item is refunded by
+// its event's policy, the promo discount is spread over the items in
+// proportion to their price. A full refund skips the policies, it is used
+// when the order is cancelled by an admin.
+func quoteRefund(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel, full bool) (*refundQuoteModel, error) {
+	span := tracer.StartSpan("quoting refund", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if full {
+		return &refundQuoteModel{Items: []refundItemModel{}, Amount: o.Price, QuotedAt: time.Now()}, nil
+	}
+	events := map[int]*eventInfoModel{}
+	for _, it := range o.Items {
+		if _, ok := events[it.EventID]; ok {
+			continue
+		}
+		e, err := getEventInfo(ctx, span.Context(), o.UserID, it.EventID)
+		if err != nil {
+			return nil, err
+		}
+		events[it.EventID] = e
+	}
+	return refundQuote(o, events, time.Now()), nil
+}
+
+// refundQuote applies the policies of the order's events at now, events
+// holds the event of every item.
+func refundQuote(o *orderModel, events map[int]*eventInfoModel, now time.Time) *refundQuoteModel {
+	q := &refundQuoteModel{Items: []refundItemModel{}, QuotedAt: now}
+	gross, refunded := 0, 0
+	for _, it := range o.Items {
+		e := events[it.EventID]
+		pct, rule := refundPercent(e, now)
+		q.Items = append(q.Items, refundItemModel{EventID: it.EventID, StartsAt: e.StartsAt, Policy: e.RefundPolicy, Rule: rule, Percent: pct})
+		gross += it.Price * it.Quantity
+		refunded += it.Price * it.Quantity * pct
+	}
+	if gross > 0 {
+		q.Amount = refunded * o.Price / (gross * 100)
+	}
+	return q
+}
+
+func setOrderKept(oid, kept int) error {
+	_, err := setKeptStmt.Exec(oid, kept)
+	return err
+}
+
+// cancelByRequest cancels the order on behalf of its owner or an admin. A
+// paid order is refunded by the quote; when the caller agreed to another
+// amount the order is left untouched and the fresh quote is returned. The
+// order is cancelled only while it still has the status the quote was made
+// for, otherwise errConcurrentUpdate is returned: an order paid meanwhile is
+// not cancelled without its refund.
+func cancelByRequest(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel, actor string, expected *int) (*refundQuoteModel, error) {
+	q := &refundQuoteModel{Items: []refundItemModel{}, QuotedAt: time.Now()}
+	if o.Status == StatusPaid {
+		var err error
+		if q, err = quoteRefund(ctx, spanCtx, o, actor == actorAdmin); err != nil {
+			return nil, err
+		}
+	}
+	if expected != nil && *expected != q.Amount {
+		return q, errRefundChanged
+	}
+	if err := cancelOrder(spanCtx, o.ID, o.Status, actor, "cancelled on request"); err != nil {
+		return nil, err
+	}
+	// the order is cancelled, its slots and refund follow even when the
+	// caller goes away
+	ctx = context.WithoutCancel(ctx)
+	if err := cancelSlot(ctx, spanCtx, o); err != nil {
+		log.Printf("Failed to cancel slot [%d]: %s\n", o.ID, err)
+	}
+	if o.Status != StatusPaid {
+		return q, nil
+	}
+	if err := setOrderKept(o.ID, o.Price-q.Amount); err != nil {
+		log.Printf("Failed to set kept amount of order [%d]: %s\n", o.ID, err)
+	}
+	if q.Amount > 0 {
+		if err := refundOrder(ctx, spanCtx, &orderModel{ID: o.ID, UserID: o.payer(), Price: q.Amount}); err != nil {
+			// the reconciliation returns the money later
+			log.Printf("Failed to refund order [%d]: %s\n", o.ID, err)
+		}
+	}
+	return q, nil
+}
+
+// requestCancel handles POST /orders/cancel/{id}. The body may carry the refund the
+// user saw in the order's quote.
+func requestCancel(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("cancelling order on request", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	oid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c := cancelRequestModel{}
+	if err = json.NewDecoder(r.Body).Decode(&c); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse cancel request for order [%d]: %s\n", oid, err)
+		return
+	}
+	o, err := getOrder(oid)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d] to cancel\n", oid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !canTransition(o.Status, statusCancelled) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Order with status [%s] can't be cancelled", statusName(o.Status))
+		return
+	}
+	actor := actorUser
+	if isAdmin(r) {
+		actor = actorAdmin
+	}
+	q, err := cancelByRequest(r.Context(), span.Context(), o, actor, c.Refund)
+	if errors.Is(err, errRefundChanged) {
+		data, _ := json.MarshalIndent(q, "", "\t")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(data)
+		return
+	}
+	if errors.Is(err, errIllegalTransition) || errors.Is(err, errConcurrentUpdate) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Order changed while cancelling, try again")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to cancel order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	notify(r.Context(), span.Context(), o.UserID, o.ID, fmt.Sprintf("Order was cancelled, refund %d", q.Amount))
+	data, _ := json.MarshalIndent(q, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
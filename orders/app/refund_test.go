@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestCancelByRequestStale(t *testing.T) {
+	setupTestDB(t)
+
+	oid := createTestOrder(t, 1, statusNeedToPay)
+	o, err := getOrder(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the payment lands between reading the order and cancelling it
+	if err = modifyOrderStatus(oid, statusNeedToPay, StatusPaid, actorAccount, "paid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cancelByRequest(context.Background(), opentracing.NoopTracer{}.StartSpan("test").Context(), o, actorUser, nil); !errors.Is(err, errConcurrentUpdate) {
+		t.Fatalf("cancelByRequest() = %v, want %v", err, errConcurrentUpdate)
+	}
+	if o, err = getOrder(oid); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != StatusPaid {
+		t.Errorf("status = %s, want %s", statusName(o.Status), statusName(StatusPaid))
+	}
+}
+
+func TestRefundPercent(t *testing.T) {
+	start := time.Date(2026, 10, 20, 19, 0, 0, 0, time.UTC)
+	policy := []refundRuleModel{{HoursBefore: 24, Percent: 50}, {HoursBefore: 72, Percent: 100}}
+	tests := []struct {
+		name     string
+		e        eventInfoModel
+		now      time.Time
+		want     int
+		wantRule *refundRuleModel
+	}{
+		{name: "no start", e: eventInfoModel{RefundPolicy: policy}, now: start, want: 100},
+		{name: "no policy", e: eventInfoModel{StartsAt: &start}, now: start, want: 100},
+		{name: "early", e: eventInfoModel{StartsAt: &start, RefundPolicy: policy}, now: start.Add(-100 * time.Hour), want: 100, wantRule: &policy[1]},
+		{name: "on the edge of the early rule", e: eventInfoModel{StartsAt: &start, RefundPolicy: policy}, now: start.Add(-72 * time.Hour), want: 100, wantRule: &policy[1]},
+		{name: "past the early rule", e: eventInfoModel{StartsAt: &start, RefundPolicy: policy}, now: start.Add(-48 * time.Hour), want: 50, wantRule: &policy[0]},
+		{name: "late", e: eventInfoModel{StartsAt: &start, RefundPolicy: policy}, now: start.Add(-time.Hour), want: 0},
+		{name: "after the start", e: eventInfoModel{StartsAt: &start, RefundPolicy: policy}, now: start.Add(time.Hour), want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rule := refundPercent(&tt.e, tt.now)
+			if got != tt.want {
+				t.Errorf("refundPercent() = %d, want %d", got, tt.want)
+			}
+			if (rule == nil) != (tt.wantRule == nil) || (rule != nil && *rule != *tt.wantRule) {
+				t.Errorf("refundPercent() rule = %v, want %v", rule, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestRefundQuote(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	soon, later := now.Add(12*time.Hour), now.Add(100*time.Hour)
+	policy := []refundRuleModel{{HoursBefore: 24, Percent: 50}, {HoursBefore: 72, Percent: 100}}
+	events := map[int]*eventInfoModel{
+		1: {ID: 1, StartsAt: &later, RefundPolicy: policy},
+		2: {ID: 2, StartsAt: &soon, RefundPolicy: []refundRuleModel{{HoursBefore: 6, Percent: 50}}},
+		3: {ID: 3, StartsAt: &soon, RefundPolicy: policy},
+		4: {ID: 4},
+	}
+	tests := []struct {
+		name  string
+		price int
+		items []orderItemModel
+		want  int
+	}{
+		{name: "full refund", price: 60, items: []orderItemModel{{EventID: 1, Price: 30, Quantity: 2}}, want: 60},
+		{name: "half refund", price: 40, items: []orderItemModel{{EventID: 2, Price: 40, Quantity: 1}}, want: 20},
+		{name: "no refund", price: 40, items: []orderItemModel{{EventID: 3, Price: 40, Quantity: 1}}, want: 0},
+		{name: "without policy", price: 10, items: []orderItemModel{{EventID: 4, Price: 10, Quantity: 1}}, want: 10},
+		// 60 of 100 refunded in full and 40 by half, 80% of the discounted 90
+		{name: "discount spread over items", price: 90, items: []orderItemModel{{EventID: 1, Price: 60, Quantity: 1}, {EventID: 2, Price: 40, Quantity: 1}}, want: 72},
+		{name: "free", price: 0, items: []orderItemModel{{EventID: 1, Quantity: 1}}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := refundQuote(&orderModel{Price: tt.price, Items: tt.items}, events, now)
+			if q.Amount != tt.want {
+				t.Errorf("refundQuote() amount = %d, want %d", q.Amount, tt.want)
+			}
+			if len(q.Items) != len(tt.items) {
+				t.Errorf("refundQuote() has %d items, want %d", len(q.Items), len(tt.items))
+			}
+		})
+	}
+}
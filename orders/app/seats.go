@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// seatModel is a named seat of a theater-style event, as events reports it.
+type seatModel struct {
+	ID      int    `json:"id"`
+	Section string `json:"section"`
+	Row     string `json:"row"`
+	Number  int    `json:"number"`
+}
+
+// checkSeats makes sure the picked seats match the quantity of the item and
+// none is picked twice.
+func checkSeats(it *orderItemModel) error {
+	if len(it.SeatIDs) == 0 {
+		return nil
+	}
+	if len(it.SeatIDs) != it.Quantity {
+		return fmt.Errorf("[%d] seats picked for [%d] tickets of event [%d]", len(it.SeatIDs), it.Quantity, it.EventID)
+	}
+	seen := map[int]bool{}
+	for _, id := range it.SeatIDs {
+		if seen[id] || id <= 0 {
+			return fmt.Errorf("wrong seat [%d] of event [%d]", id, it.EventID)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func scanSeats(it *orderItemModel, seatIDs pq.Int64Array, seats []byte) error {
+	for _, id := range seatIDs {
+		it.SeatIDs = append(it.SeatIDs, int(id))
+	}
+	if len(seats) == 0 {
+		return nil
+	}
+	return json.Unmarshal(seats, &it.Seats)
+}
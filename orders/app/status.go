@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	errIllegalTransition = errors.New("illegal order status transition")
+	errConcurrentUpdate  = errors.New("order was modified concurrently")
+)
+
+var statusNames = map[int]string{
+	statusCreated:      "created",
+	statusNeedToOccupy: "need_to_occupy",
+	statusOccupied:     "occupied",
+	statusNeedToPay:    "need_to_pay",
+	StatusPaid:         "paid",
+	statusCompleted:    "completed",
+	statusCancelled:    "cancelled",
+}
+
+// orderTransitions lists every status an order may move to from the given
+// one. Cancelled and completed orders are final.
+var orderTransitions = map[int][]int{
+	statusCreated:      {statusNeedToOccupy, statusCancelled},
+	statusNeedToOccupy: {statusOccupied, statusCancelled},
+	statusOccupied:     {statusNeedToPay, statusCancelled},
+	statusNeedToPay:    {StatusPaid, statusCancelled},
+	StatusPaid:         {statusCompleted, statusCancelled},
+	statusCompleted:    {},
+	statusCancelled:    {},
+}
+
+func statusName(status int) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// parseStatus accepts either a status name or its numeric code.
+func parseStatus(s string) (int, error) {
+	for status, name := range statusNames {
+		if name == s {
+			return status, nil
+		}
+	}
+	status, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown status [%s]", s)
+	}
+	if _, ok := statusNames[status]; !ok {
+		return 0, fmt.Errorf("unknown status [%d]", status)
+	}
+	return status, nil
+}
+
+func canTransition(from, to int) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyOrderStatus moves the order from the status the caller decided on
+// to the new one and appends the transition with its actor and reason to the
+// order's history. When the order is no longer in from, the caller acted on
+// stale state and errConcurrentUpdate is returned; the caller reads the order
+// again if it wants to retry.
+func modifyOrderStatus(oid, from, to int, actor, reason string) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("%w for order [%d]: %s -> %s", errIllegalTransition, oid, statusName(from), statusName(to))
+	}
+	res, err := updateStatusStmt.Exec(oid, to, actor, reason, from)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+	var current int
+	if err = getStatusStmt.QueryRow(oid).Scan(&current); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: order [%d] is %s, expected %s", errConcurrentUpdate, oid, statusName(current), statusName(from))
+}
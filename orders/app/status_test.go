@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]int]bool{
+		{statusCreated, statusNeedToOccupy}:   true,
+		{statusCreated, statusCancelled}:      true,
+		{statusNeedToOccupy, statusOccupied}:  true,
+		{statusNeedToOccupy, statusCancelled}: true,
+		{statusOccupied, statusNeedToPay}:     true,
+		{statusOccupied, statusCancelled}:     true,
+		{statusNeedToPay, StatusPaid}:         true,
+		{statusNeedToPay, statusCancelled}:    true,
+		{StatusPaid, statusCompleted}:         true,
+		{StatusPaid, statusCancelled}:         true,
+	}
+	// every pair of statuses, so a transition added to orderTransitions
+	// without a test fails here
+	for from := range statusNames {
+		for to := range statusNames {
+			want := allowed[[2]int{from, to}]
+			if got := canTransition(from, to); got != want {
+				t.Errorf("canTransition(%s, %s) = %t, want %t", statusName(from), statusName(to), got, want)
+			}
+		}
+	}
+	if canTransition(statusCreated, 42) || canTransition(42, statusCancelled) {
+		t.Error("unknown statuses must not transition")
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "paid", want: StatusPaid},
+		{in: "cancelled", want: statusCancelled},
+		{in: "-1", want: statusCancelled},
+		{in: "0", want: statusCreated},
+		{in: "1", want: statusNeedToOccupy},
+		{in: "42", wantErr: true},
+		{in: "refunded", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStatus(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseStatus(%q) = %d, %v, want %d, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestModifyOrderStatus(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		name    string
+		current int
+		from    int
+		to      int
+		wantErr error
+	}{
+		{name: "allowed", current: statusNeedToPay, from: statusNeedToPay, to: StatusPaid},
+		{name: "forbidden", current: statusCancelled, from: statusCancelled, to: StatusPaid, wantErr: errIllegalTransition},
+		{name: "stale state", current: StatusPaid, from: statusNeedToPay, to: statusCancelled, wantErr: errConcurrentUpdate},
+		{name: "stale final state", current: statusCancelled, from: statusNeedToPay, to: StatusPaid, wantErr: errConcurrentUpdate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oid := createTestOrder(t, 1, tt.current)
+			err := modifyOrderStatus(oid, tt.from, tt.to, actorOrders, "test")
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("modifyOrderStatus() = %v, want %v", err, tt.wantErr)
+			}
+			want := tt.to
+			if tt.wantErr != nil {
+				want = tt.current
+			}
+			o, err := getOrder(oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o.Status != want {
+				t.Errorf("status = %s, want %s", statusName(o.Status), statusName(want))
+			}
+		})
+	}
+}
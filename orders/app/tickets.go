@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	issueTicketTpl     = `INSERT INTO tickets (order_id, user_id, code, token, issued_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (order_id) DO NOTHING`
+	getTicketTpl       = `SELECT order_id, user_id, code, token, issued_at, used_at, revoked_at FROM tickets WHERE order_id=$1`
+	getTicketByCodeTpl = `SELECT order_id, user_id, code, token, issued_at, used_at, revoked_at FROM tickets WHERE code=$1`
+	useTicketTpl       = `UPDATE tickets t SET used_at=now(), checked_in_by=$4 FROM orders o WHERE t.code=$1 AND t.token=$2 AND t.used_at IS NULL AND t.revoked_at IS NULL AND o.id=t.order_id AND o.status=$3 RETURNING t.order_id`
+	unuseTicketTpl     = `UPDATE tickets SET used_at=NULL, checked_in_by=NULL WHERE code=$1`
+	revokeTicketTpl    = `UPDATE tickets SET revoked_at=now() WHERE order_id=$1 AND used_at IS NULL AND revoked_at IS NULL`
+	reissueTicketTpl   = `INSERT INTO tickets (order_id, user_id, code, token, issued_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (order_id) DO UPDATE SET user_id=EXCLUDED.user_id, code=EXCLUDED.code, token=EXCLUDED.token, issued_at=EXCLUDED.issued_at, revoked_at=NULL`
+)
+
+var (
+	issueTicketStmt     *sql.Stmt
+	getTicketStmt       *sql.Stmt
+	getTicketByCodeStmt *sql.Stmt
+	useTicketStmt       *sql.Stmt
+	unuseTicketStmt     *sql.Stmt
+	revokeTicketStmt    *sql.Stmt
+	reissueTicketStmt   *sql.Stmt
+)
+
+var (
+	ticketKey ed25519.PrivateKey
+
+	errInvalidTicket = errors.New("invalid ticket")
+)
+
+// ticketClaimsModel is the signed part of a ticket. It carries everything
+// needed at the entrance, so the token can be checked without the service.
+type ticketClaimsModel struct {
+	Code     string            `json:"code"`
+	OrderID  int               `json:"order_id"`
+	UserID   int               `json:"user_id"`
+	Items    []ticketItemModel `json:"items"`
+	IssuedAt int64             `json:"issued_at"`
+}
+
+type ticketItemModel struct {
+	EventID      int         `json:"event_id"`
+	Quantity     int         `json:"quantity"`
+	TicketTypeID int         `json:"ticket_type_id,omitempty"`
+	Seats        []seatModel `json:"seats,omitempty"`
+}
+
+type ticketModel struct {
+	OrderID   int        `json:"order_id"`
+	UserID    int        `json:"user_id"`
+	Code      string     `json:"code"`
+	Token     string     `json:"token"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type checkinRequestModel struct {
+	Token string `json:"token"`
+}
+
+func mustPrepareTicketStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	issueTicketStmt, err = db.PrepareContext(ctx, issueTicketTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTicketStmt, err = db.PrepareContext(ctx, getTicketTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTicketByCodeStmt, err = db.PrepareContext(ctx, getTicketByCodeTpl)
+	if err != nil {
+		panic(err)
+	}
+	useTicketStmt, err = db.PrepareContext(ctx, useTicketTpl)
+	if err != nil {
+		panic(err)
+	}
+	unuseTicketStmt, err = db.PrepareContext(ctx, unuseTicketTpl)
+	if err != nil {
+		panic(err)
+	}
+	revokeTicketStmt, err = db.PrepareContext(ctx, revokeTicketTpl)
+	if err != nil {
+		panic(err)
+	}
+	reissueTicketStmt, err = db.PrepareContext(ctx, reissueTicketTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// mustTicketKey decodes the base64 ed25519 seed tickets are signed with.
+// The seed is required unless dev is set: then a key is generated and
+// tickets issued with it can't be verified after a restart.
+func mustTicketKey(seed string, dev bool) ed25519.PrivateKey {
+	if seed == "" {
+		if !dev {
+			panic("ticket signing key is not set, set [TICKET_SIGNING_KEY] or [TICKET_DEV_KEY] for a temporary one")
+		}
+		log.Println("Ticket signing key is not set, generating a temporary one")
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		return key
+	}
+	data, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil || len(data) != ed25519.SeedSize {
+		panic(fmt.Sprintf("ticket signing key must be a base64 encoded %d bytes seed", ed25519.SeedSize))
+	}
+	return ed25519.NewKeyFromSeed(data)
+}
+
+// signTicket returns the token printed on the ticket: the claims and their
+// signature, both base64url encoded and joined with a dot.
+func signTicket(c *ticketClaimsModel) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(ticketKey, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func verifyTicket(token string) (*ticketClaimsModel, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidTicket
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidTicket
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !ed25519.Verify(ticketKey.Public().(ed25519.PublicKey), payload, sig) {
+		return nil, errInvalidTicket
+	}
+	c := &ticketClaimsModel{}
+	if err = json.Unmarshal(payload, c); err != nil {
+		return nil, errInvalidTicket
+	}
+	return c, nil
+}
+
+func newTicketCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newTicket signs a ticket of the order for the given owner.
+func newTicket(o *orderModel, uid int) (*ticketClaimsModel, string, error) {
+	code, err := newTicketCode()
+	if err != nil {
+		return nil, "", err
+	}
+	c := &ticketClaimsModel{Code: code, OrderID: o.ID, UserID: uid, Items: []ticketItemModel{}, IssuedAt: time.Now().Unix()}
+	for _, it := range o.Items {
+		c.Items = append(c.Items, ticketItemModel{EventID: it.EventID, Quantity: it.Quantity, TicketTypeID: it.TicketTypeID, Seats: it.Seats})
+	}
+	token, err := signTicket(c)
+	return c, token, err
+}
+
+// issueTicket signs a ticket for a paid order. An order has a single ticket,
+// issuing it again keeps the first one.
+func issueTicket(o *orderModel) error {
+	c, token, err := newTicket(o, o.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = issueTicketStmt.Exec(o.ID, o.UserID, c.Code, token, time.Unix(c.IssuedAt, 0))
+	return err
+}
+
+// reissueTicketTx replaces the ticket of the order with a new one for uid,
+// the old token stops working at the entrance.
+func reissueTicketTx(tx *sql.Tx, o *orderModel, uid int) error {
+	c, token, err := newTicket(o, uid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(reissueTicketStmt).Exec(o.ID, uid, c.Code, token, time.Unix(c.IssuedAt, 0))
+	return err
+}
+
+func revokeTicket(oid int) error {
+	_, err := revokeTicketStmt.Exec(oid)
+	return err
+}
+
+func scanTicket(row *sql.Row) (*ticketModel, error) {
+	t := &ticketModel{}
+	used, revoked := sql.NullTime{}, sql.NullTime{}
+	if err := row.Scan(&t.OrderID, &t.UserID, &t.Code, &t.Token, &t.IssuedAt, &used, &revoked); err != nil {
+		return nil, err
+	}
+	if used.Valid {
+		t.UsedAt = &used.Time
+	}
+	if revoked.Valid {
+		t.RevokedAt = &revoked.Time
+	}
+	return t, nil
+}
+
+func isStaff(r *http.Request) bool {
+	return isAdmin(r) || r.Header.Get("X-User-Role") == roleStaff
+}
+
+// getTicket returns the ticket of the order. A paid order missing its ticket,
+// because issuing failed after the payment, gets it now.
+func getTicket(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for ticket", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	oid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o, err := getOrder(oid)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d] for ticket\n", oid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	t, err := scanTicket(getTicketStmt.QueryRow(oid))
+	if errors.Is(err, sql.ErrNoRows) && o.Status == StatusPaid {
+		if err = issueTicket(o); err != nil {
+			log.Printf("Failed to issue ticket for order [%d]: %s\n", oid, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		t, err = scanTicket(getTicketStmt.QueryRow(oid))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Order with status [%s] has no ticket", statusName(o.Status))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get ticket of order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.MarshalIndent(t, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getTicketKey publishes the public key, so scanners can check the tickets
+// offline.
+func getTicketKey(w http.ResponseWriter, r *http.Request) {
+	pub := ticketKey.Public().(ed25519.PublicKey)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"algorithm":"ed25519", "public_key":"%s"}`, base64.StdEncoding.EncodeToString(pub))
+}
+
+// checkin lets staff in with a ticket. The ticket is used only once and its
+// order becomes completed.
+func checkin(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got check-in request", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	if !isStaff(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	staffID, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := checkinRequestModel{}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse check-in request: %s\n", err)
+		return
+	}
+	c, err := verifyTicket(req.Token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Failed to check in: %s", err)
+		return
+	}
+	var oid int
+	err = useTicketStmt.QueryRow(c.Code, req.Token, StatusPaid, staffID).Scan(&oid)
+	if errors.Is(err, sql.ErrNoRows) {
+		t, err := scanTicket(getTicketByCodeStmt.QueryRow(c.Code))
+		switch {
+		case err != nil || t.Token != req.Token:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Ticket is not valid anymore")
+		case t.UsedAt != nil:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Ticket was already used at %s", t.UsedAt.Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, "Ticket was revoked")
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to use ticket [%s]: %s\n", c.Code, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = modifyOrderStatus(oid, StatusPaid, statusCompleted, actorStaff, "checked in"); err != nil {
+		log.Printf("Failed to complete order [%d]: %s\n", oid, err)
+		if _, err := unuseTicketStmt.Exec(c.Code); err != nil {
+			log.Printf("Failed to release ticket [%s]: %s\n", c.Code, err)
+		}
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	log.Printf("Ticket [%s] of order [%d] was checked in by [%d]\n", c.Code, oid, staffID)
+	notify(r.Context(), span.Context(), c.UserID, oid, "Ticket was checked in, enjoy the event")
+	data, _ := json.MarshalIndent(c, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMustTicketKey(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", ed25519.SeedSize)))
+	tests := []struct {
+		name      string
+		seed      string
+		dev       bool
+		wantPanic bool
+	}{
+		{name: "configured", seed: seed},
+		{name: "configured in dev mode", seed: seed, dev: true},
+		{name: "missing", wantPanic: true},
+		{name: "missing in dev mode", dev: true},
+		{name: "malformed", seed: "not a seed", wantPanic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.wantPanic {
+					t.Errorf("mustTicketKey() panic = %v, want panic %t", r, tt.wantPanic)
+				}
+			}()
+			if key := mustTicketKey(tt.seed, tt.dev); len(key) != ed25519.PrivateKeySize {
+				t.Errorf("key size = %d, want %d", len(key), ed25519.PrivateKeySize)
+			}
+		})
+	}
+}
+
+func TestVerifyTicket(t *testing.T) {
+	ticketKey = ed25519.NewKeyFromSeed([]byte(strings.Repeat("k", ed25519.SeedSize)))
+	otherKey := ed25519.NewKeyFromSeed([]byte(strings.Repeat("o", ed25519.SeedSize)))
+
+	claims := &ticketClaimsModel{Code: "c0de", OrderID: 11, UserID: 1, Items: []ticketItemModel{{EventID: 47, Quantity: 2}}, IssuedAt: 1760000000}
+	token, err := signTicket(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	// the payload of another ticket under the signature of this one
+	forged := *claims
+	forged.UserID = 2
+	forgedToken, err := signTicket(&forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedPayload, _, _ := strings.Cut(forgedToken, ".")
+	raw, _ := base64.RawURLEncoding.DecodeString(sig)
+	raw[0] ^= 0xff
+	notJSON := []byte("not json")
+
+	tests := []struct {
+		name  string
+		token string
+		key   ed25519.PrivateKey
+		valid bool
+	}{
+		{name: "signed", token: token, valid: true},
+		{name: "other payload", token: forgedPayload + "." + sig},
+		{name: "changed signature", token: payload + "." + base64.RawURLEncoding.EncodeToString(raw)},
+		{name: "signed by other key", token: token, key: otherKey},
+		{name: "no signature", token: payload},
+		{name: "extra part", token: token + ".x"},
+		{name: "malformed payload", token: "!." + sig},
+		{name: "malformed signature", token: payload + ".!"},
+		{name: "signed garbage", token: base64.RawURLEncoding.EncodeToString(notJSON) + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(ticketKey, notJSON))},
+	}
+	signer := ticketKey
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ticketKey = signer
+			if tt.key != nil {
+				ticketKey = tt.key
+			}
+			got, err := verifyTicket(tt.token)
+			if tt.valid {
+				if err != nil || !reflect.DeepEqual(got, claims) {
+					t.Errorf("verifyTicket() = %+v, %v, want %+v", got, err, claims)
+				}
+				return
+			}
+			if !errors.Is(err, errInvalidTicket) {
+				t.Errorf("verifyTicket() = %+v, %v, want %v", got, err, errInvalidTicket)
+			}
+		})
+	}
+	ticketKey = signer
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"lib/client"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	transferPending = iota + 1
+	transferAccepted
+	transferDeclined
+	transferCancelled
+)
+
+const (
+	createTransferTpl  = `INSERT INTO order_transfers (order_id, from_user_id, to_user_id) VALUES ($1, $2, $3) ON CONFLICT (order_id) WHERE status = 1 DO NOTHING RETURNING id`
+	getTransferTpl     = `SELECT id, order_id, from_user_id, to_user_id, status, created_at, resolved_at FROM order_transfers WHERE id=$1`
+	getTransfersTpl    = `SELECT id, order_id, from_user_id, to_user_id, status, created_at, resolved_at FROM order_transfers WHERE from_user_id=$1 OR to_user_id=$1 ORDER BY id DESC LIMIT 100`
+	lockTransferTpl    = `SELECT order_id, from_user_id FROM order_transfers WHERE id=$1 AND to_user_id=$2 AND status=$3 FOR UPDATE`
+	resolveTransferTpl = `UPDATE order_transfers SET status=$2, resolved_at=now() WHERE id=$1 AND status=$3`
+	transferOrderTpl   = `UPDATE orders SET user_id=$3, payer_id=COALESCE(payer_id, user_id), version=version+1, updated_at=now() WHERE id=$1 AND user_id=$2 AND status=$4`
+	transferHistoryTpl = `INSERT INTO order_status_history (order_id, from_status, to_status, actor, reason) VALUES ($1, $2, $2, $3, $4)`
+	lookupUserPath     = "/users/lookup"
+)
+
+var (
+	createTransferStmt  *sql.Stmt
+	getTransferStmt     *sql.Stmt
+	getTransfersStmt    *sql.Stmt
+	lockTransferStmt    *sql.Stmt
+	resolveTransferStmt *sql.Stmt
+	transferOrderStmt   *sql.Stmt
+	transferHistoryStmt *sql.Stmt
+)
+
+var (
+	errTransfersDisabled = errors.New("transfers are disabled for the event")
+	errTransferNotFound  = errors.New("there is no pending transfer")
+	errTransferStale     = errors.New("order can't be transferred anymore")
+)
+
+var transferStatusNames = map[int]string{
+	transferPending:   "pending",
+	transferAccepted:  "accepted",
+	transferDeclined:  "declined",
+	transferCancelled: "cancelled",
+}
+
+// transferModel is an offer of the order's ticket to another user. Only the
+// recipient can accept it, either side can decline it.
+type transferModel struct {
+	ID         int        `json:"id"`
+	OrderID    int        `json:"order_id"`
+	FromUserID int        `json:"from_user_id"`
+	ToUserID   int        `json:"to_user_id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+type transferRequestModel struct {
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+type userModel struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+func mustPrepareTransferStmts(ctx context.Context, db *sql.DB) {
+	var err error
+
+	createTransferStmt, err = db.PrepareContext(ctx, createTransferTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTransferStmt, err = db.PrepareContext(ctx, getTransferTpl)
+	if err != nil {
+		panic(err)
+	}
+	getTransfersStmt, err = db.PrepareContext(ctx, getTransfersTpl)
+	if err != nil {
+		panic(err)
+	}
+	lockTransferStmt, err = db.PrepareContext(ctx, lockTransferTpl)
+	if err != nil {
+		panic(err)
+	}
+	resolveTransferStmt, err = db.PrepareContext(ctx, resolveTransferTpl)
+	if err != nil {
+		panic(err)
+	}
+	transferOrderStmt, err = db.PrepareContext(ctx, transferOrderTpl)
+	if err != nil {
+		panic(err)
+	}
+	transferHistoryStmt, err = db.PrepareContext(ctx, transferHistoryTpl)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransfer(row rowScanner) (*transferModel, error) {
+	t := &transferModel{}
+	var status int
+	resolved := sql.NullTime{}
+	if err := row.Scan(&t.ID, &t.OrderID, &t.FromUserID, &t.ToUserID, &status, &t.CreatedAt, &resolved); err != nil {
+		return nil, err
+	}
+	t.Status = transferStatusNames[status]
+	if resolved.Valid {
+		t.ResolvedAt = &resolved.Time
+	}
+	return t, nil
+}
+
+// lookupUser asks auth for the user with the given login or email.
+func lookupUser(ctx context.Context, spanCtx opentracing.SpanContext, login, email string) (*userModel, error) {
+	q := url.Values{}
+	q.Set("login", login)
+	q.Set("email", email)
+	u := &userModel{}
+	_, err := authClient.Do(ctx, spanCtx, &client.Request{
+		Method:     http.MethodGet,
+		Path:       lookupUserPath + "?" + q.Encode(),
+		Header:     adminHeader(),
+		Idempotent: true,
+	}, u)
+	return u, err
+}
+
+// checkTransferable makes sure every event of the order allows transfers.
+func checkTransferable(ctx context.Context, spanCtx opentracing.SpanContext, o *orderModel) error {
+	for _, it := range o.Items {
+		e, err := getEventInfo(ctx, spanCtx, o.UserID, it.EventID)
+		if err != nil {
+			return err
+		}
+		if e.TransfersDisabled {
+			return fmt.Errorf("%w [%d]", errTransfersDisabled, it.EventID)
+		}
+	}
+	return nil
+}
+
+// acceptTransfer moves the order to the recipient and reissues its ticket in
+// one transaction. The order must still be paid and belong to the sender.
+func acceptTransfer(tid, uid int, o *orderModel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oid, from int
+	err = tx.Stmt(lockTransferStmt).QueryRow(tid, uid, transferPending).Scan(&oid, &from)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errTransferNotFound
+	}
+	if err != nil {
+		return err
+	}
+	res, err := tx.Stmt(transferOrderStmt).Exec(oid, from, uid, StatusPaid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTransferStale
+	}
+	reason := fmt.Sprintf("transferred from user [%d] to user [%d]", from, uid)
+	if _, err = tx.Stmt(transferHistoryStmt).Exec(oid, StatusPaid, actorUser, reason); err != nil {
+		return err
+	}
+	if err = reissueTicketTx(tx, o, uid); err != nil {
+		return err
+	}
+	if _, err = tx.Stmt(resolveTransferStmt).Exec(tid, transferAccepted, transferPending); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// offerTransfer handles POST /orders/{id}/transfer. The ticket of a paid
+// order is offered to the user with the given login or email.
+func offerTransfer(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for order transfer", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	oid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t := transferRequestModel{}
+	if err = json.NewDecoder(r.Body).Decode(&t); err != nil || (t.Login == "" && t.Email == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Login or email of the recipient is required")
+		return
+	}
+	o, err := getOrder(oid)
+	if err != nil || !canAccess(r, o.UserID) {
+		log.Printf("Could not find any order with id [%d] to transfer\n", oid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if o.Status != StatusPaid {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Order with status [%s] can't be transferred", statusName(o.Status))
+		return
+	}
+	if err = checkTransferable(r.Context(), span.Context(), o); err != nil {
+		if errors.Is(err, errTransfersDisabled) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err)
+			return
+		}
+		log.Printf("Failed to check transfers of order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	to, err := lookupUser(r.Context(), span.Context(), t.Login, t.Email)
+	if err != nil {
+		var se *client.StatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Recipient is not found")
+			return
+		}
+		log.Printf("Failed to look up recipient of order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if to.ID == o.UserID {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Order can't be transferred to its owner")
+		return
+	}
+	var tid int
+	err = createTransferStmt.QueryRow(oid, o.UserID, to.ID).Scan(&tid)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Order already has a pending transfer")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create transfer of order [%d]: %s\n", oid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Order [%d] is offered to user [%d] by user [%d]\n", oid, to.ID, o.UserID)
+	notify(r.Context(), span.Context(), to.ID, oid, fmt.Sprintf("You were offered the ticket of order %d, accept transfer %d to get it", oid, tid))
+	notify(r.Context(), span.Context(), o.UserID, oid, fmt.Sprintf("Ticket of order %d was offered to %s", oid, to.Login))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "transfer_id":%d}`, tid)
+}
+
+// getTransfers lists the transfers the user sent or received.
+func getTransfers(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for transfers", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rows, err := getTransfersStmt.Query(uid)
+	if err != nil {
+		log.Printf("Failed to get transfers of user [%d]: %s\n", uid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	ts := []transferModel{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			log.Printf("Failed to scan transfer: %s\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ts = append(ts, *t)
+	}
+	data, _ := json.MarshalIndent(ts, "", "\t")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// resolveTransfer accepts or declines the transfer from the url. Accepting
+// checks the event's transfers once more, they may have been disabled since
+// the offer.
+func resolveTransfer(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got request for resolving transfer", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	vars := mux.Vars(r)
+	tid, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	uid, err := getUserID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t, err := scanTransfer(getTransferStmt.QueryRow(tid))
+	if err != nil || (uid != t.ToUserID && uid != t.FromUserID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if t.Status != transferStatusNames[transferPending] {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Transfer is already %s", t.Status)
+		return
+	}
+	if vars["action"] == "decline" {
+		status := transferDeclined
+		if uid == t.FromUserID {
+			status = transferCancelled
+		}
+		if _, err = resolveTransferStmt.Exec(tid, status, transferPending); err != nil {
+			log.Printf("Failed to decline transfer [%d]: %s\n", tid, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		notify(r.Context(), span.Context(), t.FromUserID, t.OrderID, fmt.Sprintf("Transfer of order %d was %s", t.OrderID, transferStatusNames[status]))
+		notify(r.Context(), span.Context(), t.ToUserID, t.OrderID, fmt.Sprintf("Transfer of order %d was %s", t.OrderID, transferStatusNames[status]))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"success":true}`))
+		return
+	}
+	if uid != t.ToUserID {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	o, err := getOrder(t.OrderID)
+	if err != nil {
+		log.Printf("Failed to get order [%d] of transfer [%d]: %s\n", t.OrderID, tid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = checkTransferable(r.Context(), span.Context(), o); err != nil {
+		if errors.Is(err, errTransfersDisabled) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err)
+			return
+		}
+		log.Printf("Failed to check transfers of order [%d]: %s\n", o.ID, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	err = acceptTransfer(tid, uid, o)
+	if errors.Is(err, errTransferStale) {
+		if _, err := resolveTransferStmt.Exec(tid, transferCancelled, transferPending); err != nil {
+			log.Printf("Failed to cancel transfer [%d]: %s\n", tid, err)
+		}
+	}
+	if errors.Is(err, errTransferNotFound) || errors.Is(err, errTransferStale) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to accept transfer [%d]: %s\n", tid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Order [%d] was transferred from user [%d] to user [%d]\n", t.OrderID, t.FromUserID, uid)
+	notify(r.Context(), span.Context(), t.FromUserID, t.OrderID, fmt.Sprintf("Ticket of order %d was transferred", t.OrderID))
+	notify(r.Context(), span.Context(), uid, t.OrderID, fmt.Sprintf("Ticket of order %d is yours now", t.OrderID))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
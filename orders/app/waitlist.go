@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+type callbackWaitlistModel struct {
+	EventID int `json:"event_id"`
+	UserID  int `json:"user_id"`
+}
+
+// callbackWaitlist is called by events when a slot was freed and a user was
+// promoted from the event's waitlist. A new order is created on the user's
+// behalf and runs through occupying and payment like any other order.
+func callbackWaitlist(w http.ResponseWriter, r *http.Request) {
+	spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := tracer.StartSpan("got waitlist promotion from [events] service", ext.RPCServerOption(spanCtx))
+	defer span.Finish()
+
+	c := callbackWaitlistModel{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Failed to parse request body user id []: %s\n", err)
+		return
+	}
+	if c.EventID == 0 || !canAccess(r, c.UserID) {
+		log.Printf("Got wrong waitlist promotion for event [%d] and user [%d]\n", c.EventID, c.UserID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o := orderModel{EventID: c.EventID}
+	if err := normalizeItems(&o); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Got wrong waitlist order from user [%d]: %s\n", c.UserID, err)
+		return
+	}
+	oid, err := order(spanCtx, c.UserID, &o, "")
+	if err != nil {
+		log.Printf("Failed to order event [%d] for waitlisted user [%d]: %s\n", c.EventID, c.UserID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Successfully ordered event [%d] for waitlisted user [%d]\n", c.EventID, c.UserID)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "order_id":%d}`, oid)
+	// events waits for the order id only, not for the whole order to be
+	// processed, and hangs up once it has it
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	ctx := context.WithoutCancel(r.Context())
+	notify(ctx, spanCtx, c.UserID, oid, "A slot became available, you were promoted from the waitlist and an order was created")
+	if err = actionOrderStatus(ctx, spanCtx, oid); err != nil {
+		log.Printf("Failed to perform action based on order's status: %s\n", err)
+	}
+}